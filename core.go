@@ -0,0 +1,937 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+var (
+	// ErrNotConnected means that an operation was started while there was no connection to the broker
+	ErrNotConnected = errors.New("mqtt: not connected")
+	// ErrConnectionLost means that the connection was lost before the broker acknowledged an operation
+	ErrConnectionLost = errors.New("mqtt: connection lost before the operation completed")
+	// ErrPingTimeout means that the broker did not answer a keepalive ping in time
+	ErrPingTimeout = errors.New("mqtt: ping response not received")
+	// ErrConnectionRefused means that the broker refused the connection, the errors below wrap it with the reason
+	ErrConnectionRefused = errors.New("mqtt: connection refused")
+	// ErrIdentifierRejected means that the broker does not allow the client id
+	ErrIdentifierRejected = fmt.Errorf("%w: identifier rejected", ErrConnectionRefused)
+	// ErrServerUnavailable means that the broker is up but the mqtt service is not available
+	ErrServerUnavailable = fmt.Errorf("%w: server unavailable", ErrConnectionRefused)
+	// ErrBadCredentials means that the broker did not accept the username or password
+	ErrBadCredentials = fmt.Errorf("%w: bad username or password", ErrConnectionRefused)
+	// ErrNotAuthorized means that the client is not allowed to connect
+	ErrNotAuthorized = fmt.Errorf("%w: not authorized", ErrConnectionRefused)
+)
+
+// SubscriptionRejectedError means that the broker refused a subscription to the topic
+type SubscriptionRejectedError struct {
+	Topic string
+	Code  ReasonCode // Why an mqtt 5 broker rejected the subscription, mqtt 3.1.1 only has ReasonUnspecifiedError
+}
+
+func (e *SubscriptionRejectedError) Error() string {
+	if e.Code != ReasonUnspecifiedError {
+		return fmt.Sprintf("mqtt: the broker rejected the subscription to %v: %v", e.Topic, e.Code)
+	}
+	return fmt.Sprintf("mqtt: the broker rejected the subscription to %v", e.Topic)
+}
+
+// Keys of the packets in the store, they are followed by the packet id
+const (
+	outboundPrefix = "o."
+	inboundPrefix  = "i."
+)
+
+// coreOptions configures the protocol handling of a core
+type coreOptions struct {
+	servers        *selector
+	clientID       string
+	credentials    CredentialsProvider
+	transport      Transport
+	keepAlive      time.Duration
+	pingTimeout    time.Duration
+	connectTimeout time.Duration
+	cleanSession   bool
+	will           *packets.Will
+	protocol       ProtocolVersion
+	sessionExpiry  time.Duration // How long persistent mqtt 5 sessions are kept, 0 keeps them forever
+	aliasMaximum   uint16        // The highest topic alias the broker may use with mqtt 5
+	maxInflight    uint16        // How many QoS 1 and 2 publishes may wait for their acknowledgement at once
+	maxPacketSize  int           // The largest packet read from the broker, 0 uses the default of the packets package
+	store          Store
+	onStoreError   ErrorHandler
+	logger         Logger
+	metrics        Metrics
+
+	onConnect        func()          // Called in its own goroutine after every successful connect
+	onConnectionLost func(error)     // Called in its own goroutine when the connection drops unexpectedly
+	onMessage        func(m Message) // Called in order with every received message
+}
+
+// operation is a publish, subscribe or unsubscribe that waits for the broker to acknowledge it
+type operation struct {
+	token  *token
+	packet packets.Packet // The publish or pubrel to resend after reconnecting, nil for subscribes and unsubscribes
+}
+
+// core speaks the mqtt protocol with the brokers. It keeps the in-flight operations and the session state
+// across connections, so operations of persistent sessions survive reconnects.
+type core struct {
+	options  coreOptions
+	codec    packets.Codec
+	lock     sync.Mutex
+	conn     *connection // Nil while not connected
+	pending  map[uint16]*operation
+	sending  int             // The pending operations that are publishes, they count against the send quota
+	freed    chan struct{}   // Closed and replaced whenever a pending publish completes, so waiting publishes retry
+	received map[uint16]bool // QoS 2 publishes that were received but not released yet
+	nextID   uint16
+}
+
+func newCore(options coreOptions) *core {
+	c := &core{options: options, pending: map[uint16]*operation{}, freed: make(chan struct{}), received: map[uint16]bool{}}
+	c.codec.MaxSize = options.maxPacketSize
+	if options.protocol == ProtocolV5 {
+		c.codec.Level = packets.ProtocolLevelV5
+	}
+	return c
+}
+
+func (c *core) report(err error) {
+	if err != nil {
+		c.options.logger.Error("store failed", "error", err)
+	}
+	if err != nil && c.options.onStoreError != nil {
+		c.options.onStoreError(fmt.Errorf("mqtt: store failed: %w", err))
+	}
+}
+
+// measurePending reports the number of pending operations, the lock must be held
+func (c *core) measurePending() {
+	c.options.metrics.QueueDepth("inflight", len(c.pending))
+}
+
+// forget removes a pending operation and wakes the publishes that wait for the send quota, the lock must be held
+func (c *core) forget(id uint16) {
+	if operation, ok := c.pending[id]; ok && operation.packet != nil {
+		c.sending--
+		close(c.freed)
+		c.freed = make(chan struct{})
+	}
+	delete(c.pending, id)
+}
+
+// connected is true while there is an open connection to a broker
+func (c *core) connected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn != nil
+}
+
+// whileConnected calls f if there is a connection, which can not be lost before f returned
+func (c *core) whileConnected(f func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		f()
+	}
+}
+
+// server returns the index of the server of the current connection, or -1 if there is none
+func (c *core) server() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		return -1
+	}
+	return c.conn.server
+}
+
+// connect opens a connection to the first server that accepts it, in the order of the server selection
+func (c *core) connect() *token {
+	t := newToken()
+	go func() {
+		var err error
+		for _, server := range c.options.servers.order() {
+			var conn *connection
+			var present bool
+			uri := c.options.servers.servers[server]
+			c.options.logger.Debug("connecting", "server", redact(uri))
+			conn, present, err = c.open(uri)
+			if err != nil {
+				c.options.logger.Warn("connecting failed", "server", redact(uri), "error", err)
+				c.options.servers.failed(server)
+				continue
+			}
+			c.options.logger.Info("connected", "server", redact(uri), "session_present", present)
+			c.options.servers.connected(server)
+			conn.server = server
+			t.sessionPresent = present
+			started := c.start(conn)
+			t.complete(nil)
+			if started {
+				go c.options.onConnect()
+			}
+			return
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+// open dials the server and performs the connect handshake. The default protocol version falls back to 3.1 if
+// the broker does not accept 3.1.1, mqtt 5 is only spoken if the options ask for it.
+func (c *core) open(server *url.URL) (*connection, bool, error) {
+	switch c.options.protocol {
+	case ProtocolV5:
+		return c.handshake(server, packets.ProtocolNameV5, packets.ProtocolLevelV5)
+	case ProtocolV31:
+		return c.handshake(server, packets.ProtocolNameV31, packets.ProtocolLevelV31)
+	case ProtocolV311:
+		return c.handshake(server, packets.ProtocolNameV311, packets.ProtocolLevelV311)
+	}
+	conn, present, err := c.handshake(server, packets.ProtocolNameV311, packets.ProtocolLevelV311)
+	if errors.Is(err, errUnacceptableProtocolVersion) {
+		return c.handshake(server, packets.ProtocolNameV31, packets.ProtocolLevelV31)
+	}
+	return conn, present, err
+}
+
+func (c *core) handshake(server *url.URL, name string, level byte) (*connection, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.connectTimeout)
+	defer cancel()
+	connect := &packets.Connect{
+		ProtocolName:  name,
+		ProtocolLevel: level,
+		CleanSession:  c.options.cleanSession,
+		KeepAlive:     uint16(c.options.keepAlive / time.Second),
+		ClientID:      c.options.clientID,
+		Will:          c.options.will,
+	}
+	if level == packets.ProtocolLevelV5 {
+		connect.Properties.SessionExpiry = c.options.sessionExpirySeconds()
+		if c.options.aliasMaximum > 0 {
+			connect.Properties.TopicAliasMaximum = &c.options.aliasMaximum
+		}
+		maxSize := uint32(packets.DefaultMaxSize)
+		if c.options.maxPacketSize > 0 {
+			maxSize = uint32(c.options.maxPacketSize)
+		}
+		connect.Properties.MaximumPacketSize = &maxSize
+	}
+	if c.options.credentials != nil {
+		username, password, err := c.options.credentials(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("mqtt: failed to get credentials: %w", err)
+		}
+		// the password is only sent along with a username
+		if username != "" {
+			connect.Username = &username
+			if password != "" {
+				connect.Password = []byte(password)
+			}
+		}
+	}
+
+	netConn, err := c.options.transport.Dial(ctx, server)
+	if err != nil {
+		return nil, false, err
+	}
+	netConn = &measuredConn{Conn: netConn, metrics: c.options.metrics}
+	conn := newConnection(netConn, c.codec)
+	conn.keepAlive = c.options.keepAlive
+	netConn.SetDeadline(time.Now().Add(c.options.connectTimeout))
+	err = conn.write(connect)
+	if err != nil {
+		conn.close()
+		return nil, false, err
+	}
+	packet, err := conn.read()
+	if err != nil {
+		conn.close()
+		return nil, false, err
+	}
+	connack, ok := packet.(*packets.Connack)
+	if !ok {
+		conn.close()
+		return nil, false, fmt.Errorf("mqtt: expected CONNACK but received %v", packet.Type())
+	}
+	if level == packets.ProtocolLevelV5 && connack.ReturnCode != packets.Accepted {
+		conn.close()
+		return nil, false, connackReasonError(connack.ReturnCode, &connack.Properties)
+	}
+	if connack.ReturnCode != packets.Accepted {
+		conn.close()
+		return nil, false, connackError(connack.ReturnCode)
+	}
+	conn.accept(&connack.Properties, c.options.aliasMaximum, c.options.maxInflight)
+	netConn.SetDeadline(time.Time{})
+	return conn, connack.SessionPresent, nil
+}
+
+// sessionExpirySeconds is the session expiry interval of mqtt 5. Clean sessions end with the connection, while
+// persistent ones are kept for the configured time or forever like with mqtt 3.1.1.
+func (o coreOptions) sessionExpirySeconds() *uint32 {
+	if o.cleanSession {
+		return nil
+	}
+	expiry := uint32(0xFFFFFFFF)
+	if o.sessionExpiry > 0 && o.sessionExpiry/time.Second < 0xFFFFFFFF {
+		expiry = uint32(o.sessionExpiry / time.Second)
+	}
+	return &expiry
+}
+
+var errUnacceptableProtocolVersion = fmt.Errorf("%w: unacceptable protocol version", ErrConnectionRefused)
+
+func connackError(code byte) error {
+	switch code {
+	case packets.UnacceptableProtocolVersion:
+		return errUnacceptableProtocolVersion
+	case packets.IdentifierRejected:
+		return ErrIdentifierRejected
+	case packets.ServerUnavailable:
+		return ErrServerUnavailable
+	case packets.BadUsernameOrPassword:
+		return ErrBadCredentials
+	case packets.NotAuthorized:
+		return ErrNotAuthorized
+	}
+	return fmt.Errorf("%w: return code %v", ErrConnectionRefused, code)
+}
+
+// start makes the connection the current one and resumes the session on it. Clean sessions start over, while
+// persistent sessions resend the unacknowledged publishes and releases of this and earlier processes. It returns
+// false if there already was a connection.
+func (c *core) start(conn *connection) bool {
+	c.lock.Lock()
+	if c.conn != nil {
+		// another connect won the race
+		c.lock.Unlock()
+		conn.close()
+		return false
+	}
+	c.conn = conn
+	resend := []packets.Packet{}
+	if c.options.cleanSession {
+		c.report(c.options.store.Reset())
+		for id, operation := range c.pending {
+			operation.token.complete(ErrConnectionLost)
+			c.forget(id)
+		}
+		c.received = map[uint16]bool{}
+	} else {
+		c.load()
+		ids := make([]int, 0, len(c.pending))
+		for id := range c.pending {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			packet := c.pending[uint16(id)].packet
+			if publish, ok := packet.(*packets.Publish); ok {
+				resent := *publish
+				resent.Dup = true
+				packet = &resent
+			}
+			if packet != nil {
+				resend = append(resend, packet)
+			}
+		}
+	}
+	c.measurePending()
+	c.lock.Unlock()
+
+	go c.read(conn)
+	go c.keepAlive(conn)
+	for _, packet := range resend {
+		c.send(conn, packet)
+	}
+	return true
+}
+
+// load adds the packets in the store that are not pending yet, which are left over from an earlier process
+func (c *core) load() {
+	keys, err := c.options.store.Keys()
+	c.report(err)
+	for _, key := range keys {
+		var prefix string
+		if strings.HasPrefix(key, outboundPrefix) {
+			prefix = outboundPrefix
+		} else if strings.HasPrefix(key, inboundPrefix) {
+			prefix = inboundPrefix
+		} else {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(key, prefix), 10, 16)
+		if err != nil {
+			continue
+		}
+		if prefix == inboundPrefix {
+			c.received[uint16(id)] = true
+			continue
+		}
+		if _, ok := c.pending[uint16(id)]; ok {
+			continue
+		}
+		data, err := c.options.store.Get(key)
+		if err != nil || data == nil {
+			c.report(err)
+			continue
+		}
+		// stored packets were encoded by the client, so they are not limited by the maximum packet size
+		codec := c.codec
+		codec.MaxSize = 5 + packets.MaxLength
+		packet, err := codec.Read(bytes.NewReader(data))
+		if err != nil {
+			c.report(err)
+			continue
+		}
+		c.pending[uint16(id)] = &operation{token: newToken(), packet: packet}
+		c.sending++
+	}
+}
+
+// lost tears down a connection that dropped unexpectedly. Pending operations fail, except for the publishes of
+// persistent sessions which are resent after reconnecting.
+func (c *core) lost(conn *connection, err error) {
+	c.lock.Lock()
+	if c.conn != conn {
+		c.lock.Unlock()
+		return
+	}
+	c.conn = nil
+	for id, operation := range c.pending {
+		if c.options.cleanSession || operation.packet == nil {
+			operation.token.complete(ErrConnectionLost)
+			c.forget(id)
+		}
+	}
+	c.measurePending()
+	c.lock.Unlock()
+	conn.close()
+	c.options.logger.Warn("connection lost", "server", redact(c.options.servers.servers[conn.server]), "error", err)
+	c.options.servers.failed(conn.server)
+	go c.options.onConnectionLost(err)
+}
+
+// disconnect sends a disconnect packet and closes the connection. All pending operations fail, the publishes of
+// persistent sessions stay in the store and are resent after connecting again.
+func (c *core) disconnect() {
+	c.lock.Lock()
+	conn := c.conn
+	c.conn = nil
+	for id, operation := range c.pending {
+		operation.token.complete(ErrConnectionLost)
+		c.forget(id)
+	}
+	c.measurePending()
+	c.lock.Unlock()
+	if conn != nil {
+		conn.write(&packets.Disconnect{})
+		conn.close()
+	}
+}
+
+// send writes a packet and drops the connection if that fails
+func (c *core) send(conn *connection, packet packets.Packet) error {
+	return c.sendContext(context.Background(), conn, packet)
+}
+
+// sendContext writes a packet unless the context is done before it gets its turn to write, and drops the
+// connection if the write fails
+func (c *core) sendContext(ctx context.Context, conn *connection, packet packets.Packet) error {
+	err := conn.writeContext(ctx, packet)
+	if err == nil {
+		c.options.logger.Debug("sent packet", "type", packet.Type())
+	}
+	if err != nil && err != ctx.Err() {
+		c.lost(conn, err)
+	}
+	return err
+}
+
+// abort forgets an operation that was canceled before its packet was written. If the connection changed in the
+// meantime the operation was either failed or resent already, so it is left alone.
+func (c *core) abort(conn *connection, id uint16, t *token, prefix string, err error) *token {
+	c.lock.Lock()
+	operation, ok := c.pending[id]
+	aborted := ok && operation.token == t && c.conn == conn
+	if aborted {
+		c.forget(id)
+		c.measurePending()
+	}
+	c.lock.Unlock()
+	if !aborted {
+		return t
+	}
+	if prefix != "" {
+		c.unstore(prefix, id)
+	}
+	return failedToken(&CanceledError{Err: err})
+}
+
+// allocate returns a free packet id, the lock must be held
+func (c *core) allocate() (uint16, error) {
+	for i := 0; i < 65535; i++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, ok := c.pending[c.nextID]; !ok {
+			return c.nextID, nil
+		}
+	}
+	return 0, errors.New("mqtt: no free packet ids")
+}
+
+// begin registers an operation and returns the current connection. Publishes, which are resent, first wait
+// until the send quota of the connection has room for them.
+func (c *core) begin(ctx context.Context, packet packets.Packet, resend bool) (*connection, *token, uint16, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for resend && c.conn != nil && c.sending >= c.conn.sendMaximum {
+		conn, freed := c.conn, c.freed
+		c.lock.Unlock()
+		select {
+		case <-freed:
+		case <-conn.closed:
+		case <-ctx.Done():
+			c.lock.Lock()
+			return nil, nil, 0, &CanceledError{Err: ctx.Err()}
+		}
+		c.lock.Lock()
+	}
+	if c.conn == nil {
+		return nil, nil, 0, ErrNotConnected
+	}
+	id, err := c.allocate()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	t := newToken()
+	operation := &operation{token: t}
+	if resend {
+		operation.packet = packet
+		c.sending++
+	}
+	c.pending[id] = operation
+	c.measurePending()
+	return c.conn, t, id, nil
+}
+
+// publish sends a message. QoS 0 completes once it is written, QoS 1 and 2 once the broker acknowledged it. If the
+// context is done before the packet is written the message is dropped.
+func (c *core) publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte, properties packets.Properties) *token {
+	packet := &packets.Publish{QOS: qos, Retain: retained, Topic: topic, Payload: payload, Properties: properties}
+	if qos == 0 {
+		c.lock.Lock()
+		conn := c.conn
+		c.lock.Unlock()
+		if conn == nil {
+			return failedToken(ErrNotConnected)
+		}
+		err := c.sendContext(ctx, conn, packet)
+		if err != nil && err == ctx.Err() {
+			err = &CanceledError{Err: err}
+		} else if err != nil {
+			err = fmt.Errorf("%w: %v", ErrConnectionLost, err)
+		}
+		return failedToken(err)
+	}
+	if qos > 2 {
+		return failedToken(fmt.Errorf("mqtt: invalid QoS %v", qos))
+	}
+
+	conn, t, id, err := c.begin(ctx, packet, true)
+	if err != nil {
+		return failedToken(err)
+	}
+	packet.PacketID = id
+	c.store(outboundPrefix, id, packet)
+	if err := c.sendContext(ctx, conn, packet); err != nil && err == ctx.Err() {
+		return c.abort(conn, id, t, outboundPrefix, err)
+	}
+	return t
+}
+
+// subscribe subscribes to the topics and completes with the granted QoS of every topic
+func (c *core) subscribe(ctx context.Context, subscriptions []packets.Subscription) *token {
+	packet := &packets.Subscribe{Subscriptions: subscriptions}
+	conn, t, id, err := c.begin(ctx, packet, false)
+	if err != nil {
+		return failedToken(err)
+	}
+	packet.PacketID = id
+	if err := c.sendContext(ctx, conn, packet); err != nil && err == ctx.Err() {
+		return c.abort(conn, id, t, "", err)
+	}
+	return t
+}
+
+// unsubscribe unsubscribes from the topics
+func (c *core) unsubscribe(ctx context.Context, topics []string) *token {
+	packet := &packets.Unsubscribe{Topics: topics}
+	conn, t, id, err := c.begin(ctx, packet, false)
+	if err != nil {
+		return failedToken(err)
+	}
+	packet.PacketID = id
+	if err := c.sendContext(ctx, conn, packet); err != nil && err == ctx.Err() {
+		return c.abort(conn, id, t, "", err)
+	}
+	return t
+}
+
+func (c *core) store(prefix string, id uint16, packet packets.Packet) {
+	data, err := c.codec.Encode(packet)
+	if err != nil {
+		c.report(err)
+		return
+	}
+	c.report(c.options.store.Put(prefix+strconv.Itoa(int(id)), data))
+}
+
+func (c *core) unstore(prefix string, id uint16) {
+	c.report(c.options.store.Delete(prefix + strconv.Itoa(int(id))))
+}
+
+// complete finishes the pending operation of a packet id, err is the failure an mqtt 5 broker reported
+func (c *core) complete(id uint16, granted []byte, err error) {
+	c.lock.Lock()
+	operation, ok := c.pending[id]
+	c.forget(id)
+	c.measurePending()
+	c.lock.Unlock()
+	if ok {
+		if operation.packet != nil {
+			c.unstore(outboundPrefix, id)
+		}
+		operation.token.granted = granted
+		operation.token.complete(err)
+	}
+}
+
+// read handles the packets of a connection until it fails. Messages are handed to a separate goroutine so
+// handlers can not hold up acknowledgements and pings.
+func (c *core) read(conn *connection) {
+	messages := make(chan Message, 64)
+	defer close(messages)
+	go func() {
+		for message := range messages {
+			c.options.onMessage(message)
+			message.Acknowledge()
+		}
+	}()
+
+	for {
+		packet, err := conn.read()
+		if err != nil {
+			if errors.Is(err, packets.ErrTooLarge) && conn.codec.Level == packets.ProtocolLevelV5 {
+				c.send(conn, &packets.Disconnect{ReasonCode: byte(ReasonPacketTooLarge)})
+			}
+			c.lost(conn, err)
+			return
+		}
+		c.options.logger.Debug("received packet", "type", packet.Type())
+		switch packet := packet.(type) {
+		case *packets.Publish:
+			if err := conn.resolve(packet); err != nil {
+				c.send(conn, &packets.Disconnect{ReasonCode: byte(ReasonTopicAliasInvalid)})
+				c.lost(conn, err)
+				return
+			}
+			if message, ok := c.receive(conn, packet); ok {
+				select {
+				case messages <- message:
+				case <-conn.closed:
+					return
+				}
+			}
+		case *packets.Puback:
+			c.complete(packet.PacketID, nil, reasonError(packet.ReasonCode, &packet.Properties))
+		case *packets.Pubrec:
+			if err := reasonError(packet.ReasonCode, &packet.Properties); err != nil {
+				// the broker refused the message, so there is nothing to release
+				c.complete(packet.PacketID, nil, err)
+				continue
+			}
+			c.lock.Lock()
+			operation, ok := c.pending[packet.PacketID]
+			if ok {
+				operation.packet = &packets.Pubrel{PacketID: packet.PacketID}
+			}
+			c.lock.Unlock()
+			if ok {
+				c.store(outboundPrefix, packet.PacketID, operation.packet)
+			}
+			c.send(conn, &packets.Pubrel{PacketID: packet.PacketID})
+		case *packets.Pubrel:
+			c.lock.Lock()
+			delete(c.received, packet.PacketID)
+			c.lock.Unlock()
+			c.unstore(inboundPrefix, packet.PacketID)
+			c.send(conn, &packets.Pubcomp{PacketID: packet.PacketID})
+		case *packets.Pubcomp:
+			c.complete(packet.PacketID, nil, reasonError(packet.ReasonCode, &packet.Properties))
+		case *packets.Suback:
+			c.complete(packet.PacketID, packet.ReturnCodes, nil)
+		case *packets.Unsuback:
+			var err error
+			for _, code := range packet.ReasonCodes {
+				if err = reasonError(code, &packet.Properties); err != nil {
+					break
+				}
+			}
+			c.complete(packet.PacketID, nil, err)
+		case *packets.Pingresp:
+			conn.pong()
+		case *packets.Disconnect:
+			// mqtt 5 brokers tell why they close the connection
+			c.lost(conn, &ReasonCodeError{Code: ReasonCode(packet.ReasonCode), Reason: packet.Properties.ReasonString})
+			return
+		default:
+			c.lost(conn, fmt.Errorf("mqtt: unexpected %v from the broker", packet.Type()))
+			return
+		}
+	}
+}
+
+// receive turns a publish into a message that acknowledges it. QoS 2 publishes that were received before but not
+// released are only acknowledged again.
+func (c *core) receive(conn *connection, packet *packets.Publish) (Message, bool) {
+	message := Message{topic: packet.Topic, payload: packet.Payload, qos: QOS(packet.QOS), duplicate: packet.Dup, retained: packet.Retain}
+	message.properties = receivedProperties(&packet.Properties)
+	if packet.Properties.MessageExpiry != nil {
+		message.expiry = time.Duration(*packet.Properties.MessageExpiry) * time.Second
+	}
+	var ack packets.Packet
+	switch packet.QOS {
+	case 1:
+		ack = &packets.Puback{PacketID: packet.PacketID}
+	case 2:
+		ack = &packets.Pubrec{PacketID: packet.PacketID}
+		c.lock.Lock()
+		duplicate := c.received[packet.PacketID]
+		c.received[packet.PacketID] = true
+		c.lock.Unlock()
+		if duplicate {
+			c.send(conn, ack)
+			return message, false
+		}
+		c.store(inboundPrefix, packet.PacketID, packet)
+	}
+	if ack != nil {
+		var once sync.Once
+		message.ack = func() {
+			once.Do(func() {
+				c.send(conn, ack)
+			})
+		}
+	}
+	return message, true
+}
+
+// keepAlive pings the broker if nothing was sent for the keepalive interval and drops the connection if the
+// broker does not answer in time
+func (c *core) keepAlive(conn *connection) {
+	if conn.keepAlive <= 0 {
+		return
+	}
+	interval := conn.keepAlive
+	if c.options.pingTimeout < interval {
+		interval = c.options.pingTimeout
+	}
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+		}
+		sent, pinged := conn.activity()
+		if !pinged.IsZero() {
+			if time.Since(pinged) >= c.options.pingTimeout {
+				c.lost(conn, ErrPingTimeout)
+				return
+			}
+		} else if time.Since(sent) >= conn.keepAlive {
+			conn.ping()
+			if c.send(conn, &packets.Pingreq{}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// connection is a single network connection to a broker
+type connection struct {
+	conn      net.Conn
+	server    int // The index of the server in the client options
+	codec     packets.Codec
+	keepAlive time.Duration // The keepalive of the options, unless an mqtt 5 broker asked for another one
+	reader    *bufio.Reader
+	writing   chan struct{} // Holds a value while a packet is written, so writes do not interleave
+	lock      sync.Mutex
+	sent      time.Time // When the last packet was written
+	pinged    time.Time // When the outstanding ping was sent, zero if there is none
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	sendMaximum int // How many publishes may wait for their acknowledgement, the receive maximum of mqtt 5 brokers
+
+	// topic aliases of mqtt 5, the sent ones are only used while writing and the received ones while reading
+	sentAliases     map[string]uint16
+	sentMaximum     uint16 // The highest topic alias the broker accepts
+	receivedAliases map[uint16]string
+	receivedMaximum uint16 // The highest topic alias the broker may use
+}
+
+func newConnection(conn net.Conn, codec packets.Codec) *connection {
+	return &connection{
+		conn:            conn,
+		codec:           codec,
+		reader:          bufio.NewReader(conn),
+		sent:            time.Now(),
+		writing:         make(chan struct{}, 1),
+		closed:          make(chan struct{}),
+		sentAliases:     map[string]uint16{},
+		receivedAliases: map[uint16]string{},
+	}
+}
+
+// accept applies the properties of the connack of an mqtt 5 broker
+func (c *connection) accept(properties *packets.Properties, aliasMaximum, maxInflight uint16) {
+	c.sendMaximum = int(maxInflight)
+	if properties.ReceiveMaximum != nil && *properties.ReceiveMaximum > 0 && *properties.ReceiveMaximum < maxInflight {
+		c.sendMaximum = int(*properties.ReceiveMaximum)
+	}
+	if properties.ServerKeepAlive != nil {
+		c.keepAlive = time.Duration(*properties.ServerKeepAlive) * time.Second
+	}
+	if properties.TopicAliasMaximum != nil {
+		c.sentMaximum = *properties.TopicAliasMaximum
+	}
+	c.receivedMaximum = aliasMaximum
+}
+
+// read reads the next packet from the broker
+func (c *connection) read() (packets.Packet, error) {
+	return c.codec.Read(c.reader)
+}
+
+// alias replaces the topic of a publish with a topic alias while the broker accepts more of them. The first
+// publish on a topic sets its alias, the later ones only send the alias.
+func (c *connection) alias(publish *packets.Publish) *packets.Publish {
+	if c.sentMaximum == 0 {
+		return publish
+	}
+	aliased := *publish
+	alias, ok := c.sentAliases[publish.Topic]
+	if ok {
+		aliased.Topic = ""
+	} else if len(c.sentAliases) < int(c.sentMaximum) {
+		alias = uint16(len(c.sentAliases) + 1)
+		c.sentAliases[publish.Topic] = alias
+	} else {
+		return publish
+	}
+	aliased.Properties.TopicAlias = &alias
+	return &aliased
+}
+
+// resolve sets the topic of a received publish that only has a topic alias and remembers new aliases
+func (c *connection) resolve(publish *packets.Publish) error {
+	alias := publish.Properties.TopicAlias
+	if alias == nil {
+		return nil
+	}
+	if *alias == 0 || *alias > c.receivedMaximum {
+		return &ReasonCodeError{Code: ReasonTopicAliasInvalid, Reason: fmt.Sprintf("the broker used topic alias %v", *alias)}
+	}
+	if publish.Topic != "" {
+		c.receivedAliases[*alias] = publish.Topic
+		return nil
+	}
+	topic, ok := c.receivedAliases[*alias]
+	if !ok {
+		return &ReasonCodeError{Code: ReasonTopicAliasInvalid, Reason: fmt.Sprintf("the broker used topic alias %v before setting it", *alias)}
+	}
+	publish.Topic = topic
+	return nil
+}
+
+// write encodes and writes a packet, writes of different goroutines do not interleave
+func (c *connection) write(packet packets.Packet) error {
+	return c.writeContext(context.Background(), packet)
+}
+
+// writeContext writes a packet unless the context is done while waiting for other writes to finish. Once the
+// packet is being written it is written completely.
+func (c *connection) writeContext(ctx context.Context, packet packets.Packet) error {
+	select {
+	case c.writing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		<-c.writing
+		return err
+	}
+	// aliases are assigned in the order the publishes are written
+	if publish, ok := packet.(*packets.Publish); ok {
+		packet = c.alias(publish)
+	}
+	encoded, err := c.codec.Encode(packet)
+	if err != nil {
+		<-c.writing
+		return err
+	}
+	_, err = c.conn.Write(encoded)
+	<-c.writing
+	if err == nil {
+		c.lock.Lock()
+		c.sent = time.Now()
+		c.lock.Unlock()
+	}
+	return err
+}
+
+func (c *connection) activity() (time.Time, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sent, c.pinged
+}
+
+func (c *connection) ping() {
+	c.lock.Lock()
+	c.pinged = time.Now()
+	c.lock.Unlock()
+}
+
+func (c *connection) pong() {
+	c.lock.Lock()
+	c.pinged = time.Time{}
+	c.lock.Unlock()
+}
+
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,186 @@
+package mqtt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// A CredentialsProvider returns the username and password for a connection attempt. It gets called before every
+// connect and reconnect, so it can hand out short-lived tokens. ctx is done when the connect timeout passed.
+type CredentialsProvider func(ctx context.Context) (username, password string, err error)
+
+// JWTOptions configures the json web tokens minted by JWTCredentials
+type JWTOptions struct {
+	Username string        // The username sent along with every token
+	Key      interface{}   // A []byte secret for HS256, an *rsa.PrivateKey for RS256 or an *ecdsa.PrivateKey on P-256 for ES256
+	KeyFile  string        // A PEM private key for RS256 or ES256 that is used if Key is not set
+	Lifetime time.Duration // How long every token is valid, defaults to 1 hour
+
+	Issuer   string                 // The iss claim, left out if empty
+	Subject  string                 // The sub claim, left out if empty
+	Audience string                 // The aud claim, left out if empty
+	Claims   map[string]interface{} // Additional claims, they take precedence over the ones above
+}
+
+var (
+	// ErrUnsupportedKey means that the key in the jwt options can not be used to sign tokens
+	ErrUnsupportedKey = errors.New("mqtt: the jwt key must be a []byte, *rsa.PrivateKey or P-256 *ecdsa.PrivateKey")
+)
+
+// JWTCredentials returns a credentials provider that uses a signed json web token as the password. A token is
+// reused until a fifth of its lifetime is left, then a fresh one is minted, so clients keep reconnecting after
+// the first token expired.
+func JWTCredentials(options JWTOptions) (CredentialsProvider, error) {
+	if options.Lifetime <= 0 {
+		options.Lifetime = time.Hour
+	}
+	key := options.Key
+	if key == nil && options.KeyFile != "" {
+		var err error
+		key, err = readPrivateKey(options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signer, err := newJWTSigner(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var token string
+	var refresh time.Time
+	return func(ctx context.Context) (string, string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		now := time.Now()
+		if token == "" || !now.Before(refresh) {
+			minted, err := signer.mint(options, now)
+			if err != nil {
+				return "", "", err
+			}
+			token = minted
+			refresh = now.Add(options.Lifetime - options.Lifetime/5)
+		}
+		return options.Username, token, nil
+	}, nil
+}
+
+// jwtSigner signs tokens with one of the supported algorithms
+type jwtSigner struct {
+	algorithm string
+	sign      func(data []byte) ([]byte, error)
+}
+
+func newJWTSigner(key interface{}) (*jwtSigner, error) {
+	switch key := key.(type) {
+	case []byte:
+		return &jwtSigner{algorithm: "HS256", sign: func(data []byte) ([]byte, error) {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(data)
+			return mac.Sum(nil), nil
+		}}, nil
+	case *rsa.PrivateKey:
+		return &jwtSigner{algorithm: "RS256", sign: func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}}, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey
+		}
+		return &jwtSigner{algorithm: "ES256", sign: func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+			if err != nil {
+				return nil, err
+			}
+			// the signature is r and s as fixed size big endian numbers
+			signature := make([]byte, 64)
+			fill(signature[:32], r)
+			fill(signature[32:], s)
+			return signature, nil
+		}}, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+func fill(buffer []byte, n *big.Int) {
+	b := n.Bytes()
+	copy(buffer[len(buffer)-len(b):], b)
+}
+
+// mint creates a token that is valid from now for the lifetime in the options
+func (s *jwtSigner) mint(options JWTOptions, now time.Time) (string, error) {
+	claims := map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(options.Lifetime).Unix(),
+	}
+	if options.Issuer != "" {
+		claims["iss"] = options.Issuer
+	}
+	if options.Subject != "" {
+		claims["sub"] = options.Subject
+	}
+	if options.Audience != "" {
+		claims["aud"] = options.Audience
+	}
+	for name, value := range options.Claims {
+		claims[name] = value
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": s.algorithm, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("mqtt: failed to encode jwt claims: %w", err)
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	signature, err := s.sign([]byte(unsigned))
+	if err != nil {
+		return "", fmt.Errorf("mqtt: failed to sign jwt: %w", err)
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// readPrivateKey reads an RSA or EC private key in PKCS #1, SEC 1 or PKCS #8 form from a PEM file
+func readPrivateKey(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: failed to read jwt key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("mqtt: the jwt key file %v does not contain a PEM block", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: failed to parse jwt key file: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,210 @@
+package mqtt_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// TestCredentialsProvider checks that the provider is asked for fresh credentials on every connect
+func TestCredentialsProvider(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	var lock sync.Mutex
+	accepted := []string{}
+	broker.SetAuthenticator(func(clientID, username string, password []byte) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		accepted = append(accepted, username+":"+string(password))
+		return username == "user"
+	})
+
+	calls := 0
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:  []string{broker.URL},
+		Username: "ignored",
+		CredentialsProvider: func(ctx context.Context) (string, string, error) {
+			calls++
+			return "user", fmt.Sprintf("token-%v", calls), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Connect(ctx()); err != nil {
+			t.Fatalf("connect should not have failed: %v", err)
+		}
+		client.DisconnectImmediately()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(accepted) != 2 || accepted[0] != "user:token-1" || accepted[1] != "user:token-2" {
+		t.Fatalf("every connect should have used new credentials but used %v", accepted)
+	}
+}
+
+// TestCredentialsProviderError checks that connecting fails if there are no credentials
+func TestCredentialsProviderError(t *testing.T) {
+	failed := errors.New("vault is sealed")
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{broker},
+		CredentialsProvider: func(ctx context.Context) (string, string, error) {
+			return "", "", failed
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if !errors.Is(err, failed) {
+		t.Fatalf("connect should have failed with the provider error but failed with %v", err)
+	}
+}
+
+// decodeJWT checks the format of a token and returns its header, claims and signature
+func decodeJWT(t *testing.T, token string) (map[string]interface{}, map[string]interface{}, []byte, []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token should have three parts but is %v", token)
+	}
+	decoded := make([][]byte, 3)
+	for i, part := range parts {
+		var err error
+		decoded[i], err = base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			t.Fatalf("token part %v should have been base64: %v", i, err)
+		}
+	}
+	header, claims := map[string]interface{}{}, map[string]interface{}{}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		t.Fatalf("header should have been json: %v", err)
+	}
+	if err := json.Unmarshal(decoded[1], &claims); err != nil {
+		t.Fatalf("claims should have been json: %v", err)
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), decoded[2]
+}
+
+// TestJWTCredentials checks the claims and the HS256 signature of minted tokens and that they are refreshed
+func TestJWTCredentials(t *testing.T) {
+	secret := []byte("secret")
+	provider, err := mqtt.JWTCredentials(mqtt.JWTOptions{
+		Username: "device",
+		Key:      secret,
+		Lifetime: time.Second,
+		Audience: "project",
+		Claims:   map[string]interface{}{"scope": "publish"},
+	})
+	if err != nil {
+		t.Fatalf("creating the provider should not have failed: %v", err)
+	}
+
+	username, token, err := provider(ctx())
+	if err != nil {
+		t.Fatalf("minting a token should not have failed: %v", err)
+	}
+	if username != "device" {
+		t.Fatalf("username should have been device but is %v", username)
+	}
+	header, claims, signed, signature := decodeJWT(t, token)
+	if header["alg"] != "HS256" {
+		t.Fatalf("alg should have been HS256 but is %v", header["alg"])
+	}
+	if claims["aud"] != "project" || claims["scope"] != "publish" || claims["exp"].(float64)-claims["iat"].(float64) != 1 {
+		t.Fatalf("claims should have been set but are %v", claims)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		t.Fatalf("signature should have been valid")
+	}
+
+	if _, cached, _ := provider(ctx()); cached != token {
+		t.Fatalf("the token should have been reused while it is fresh")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, refreshed, _ := provider(ctx()); refreshed == token {
+		t.Fatalf("the token should have been refreshed")
+	}
+}
+
+// TestJWTCredentialsRSA checks RS256 tokens signed with a key from a PEM file
+func TestJWTCredentialsRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating a key should not have failed: %v", err)
+	}
+	file, err := ioutil.TempFile("", "mqtt-jwt-key")
+	if err != nil {
+		t.Fatalf("creating a temp file should not have failed: %v", err)
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	file.Close()
+
+	provider, err := mqtt.JWTCredentials(mqtt.JWTOptions{KeyFile: file.Name()})
+	if err != nil {
+		t.Fatalf("creating the provider should not have failed: %v", err)
+	}
+	_, token, err := provider(ctx())
+	if err != nil {
+		t.Fatalf("minting a token should not have failed: %v", err)
+	}
+	header, _, signed, signature := decodeJWT(t, token)
+	digest := sha256.Sum256(signed)
+	if header["alg"] != "RS256" || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+		t.Fatalf("token should have had a valid RS256 signature")
+	}
+}
+
+// TestJWTCredentialsECDSA checks ES256 tokens
+func TestJWTCredentialsECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating a key should not have failed: %v", err)
+	}
+	provider, err := mqtt.JWTCredentials(mqtt.JWTOptions{Key: key})
+	if err != nil {
+		t.Fatalf("creating the provider should not have failed: %v", err)
+	}
+	_, token, err := provider(ctx())
+	if err != nil {
+		t.Fatalf("minting a token should not have failed: %v", err)
+	}
+	header, _, signed, signature := decodeJWT(t, token)
+	digest := sha256.Sum256(signed)
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if header["alg"] != "ES256" || len(signature) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Fatalf("token should have had a valid ES256 signature")
+	}
+
+	_, err = mqtt.JWTCredentials(mqtt.JWTOptions{Key: "not a key"})
+	if !errors.Is(err, mqtt.ErrUnsupportedKey) {
+		t.Fatalf("creating the provider should have failed with ErrUnsupportedKey but failed with %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketOptions configures the connections to ws and wss servers
+type WebSocketOptions struct {
+	Header       http.Header // Extra headers sent with the upgrade request, like cookies or an authorization header
+	Path         string      // Overrides the path of the server urls, for example /mqtt
+	Subprotocols []string    // The subprotocols to request, defaults to mqtt
+}
+
+var (
+	// ErrUnsupportedProxy means that the proxy in the client options is not an http, https or socks5 url
+	ErrUnsupportedProxy = errors.New("mqtt: the proxy must be an http, https or socks5 url")
+)
+
+// parseServer parses a broker url, servers without a scheme use tcp. The mqtt and mqtts schemes default to the
+// ports 1883 and 8883.
+func parseServer(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "tcp://" + server
+	}
+	uri, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: invalid server %v: %w", server, err)
+	}
+	if uri.Port() == "" {
+		switch uri.Scheme {
+		case "mqtt":
+			uri.Host = net.JoinHostPort(uri.Hostname(), "1883")
+		case "mqtts":
+			uri.Host = net.JoinHostPort(uri.Hostname(), "8883")
+		}
+	}
+	return uri, nil
+}
+
+// parseProxy parses the proxy url of the client options
+func parseProxy(proxyURL string) (*url.URL, error) {
+	uri, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: invalid proxy %v: %w", proxyURL, err)
+	}
+	switch uri.Scheme {
+	case "http", "https", "socks5":
+		return uri, nil
+	}
+	return nil, ErrUnsupportedProxy
+}
+
+// supportedScheme is true if the default transport can dial servers with the scheme
+func supportedScheme(scheme string) bool {
+	switch scheme {
+	case "tcp", "mqtt", "unix", "ssl", "tls", "tcps", "mqtts", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// schemeTransport is the default transport, it dials the tcp, mqtt, unix, ssl, tls, tcps, mqtts, ws and wss
+// schemes. All of them but unix go through the proxy if one is set, or else through the one in the ALL_PROXY or
+// all_proxy environment variable unless NO_PROXY or no_proxy exclude the server.
+type schemeTransport struct {
+	tls       *tls.Config
+	websocket *WebSocketOptions
+	proxy     *url.URL
+}
+
+func (t schemeTransport) Dial(ctx context.Context, server *url.URL) (net.Conn, error) {
+	deadline, _ := ctx.Deadline()
+	dialer := &net.Dialer{Deadline: deadline}
+	switch server.Scheme {
+	case "tcp", "mqtt":
+		return t.dialTCP(dialer, server.Host)
+	case "unix":
+		// unix:///tmp/mqtt.sock has the socket in the path, unix://mqtt.sock a relative one in the host
+		return dialer.Dial("unix", server.Host+server.Path)
+	case "ssl", "tls", "tcps", "mqtts":
+		conn, err := t.dialTCP(dialer, server.Host)
+		if err != nil {
+			return nil, err
+		}
+		return t.handshake(conn, server, deadline)
+	case "ws", "wss":
+		return t.dialWebSocket(dialer, server, deadline)
+	}
+	return nil, fmt.Errorf("mqtt: unknown scheme %v", server.Scheme)
+}
+
+// dialTCP opens a tcp connection to the address through the proxy
+func (t schemeTransport) dialTCP(dialer *net.Dialer, address string) (net.Conn, error) {
+	proxyURL := t.proxy
+	if proxyURL == nil {
+		proxyURL = environmentProxy(address)
+	}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", address)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPProxy(dialer, proxyURL, address)
+	default:
+		forward, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return forward.Dial("tcp", address)
+	}
+}
+
+// environmentProxy returns the proxy in the ALL_PROXY or all_proxy environment variable, nil if there is none, it
+// is invalid or the host of the address is excluded by NO_PROXY or no_proxy. The variables are read on every dial.
+func environmentProxy(address string) *url.URL {
+	proxyURL, err := parseProxy(getenv("ALL_PROXY", "all_proxy"))
+	if err != nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if excludedFromProxy(host, getenv("NO_PROXY", "no_proxy")) {
+		return nil
+	}
+	return proxyURL
+}
+
+// getenv returns the first of the environment variables that is not empty
+func getenv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// excludedFromProxy reports if the host is in a comma separated NO_PROXY list. * excludes every host, ips and
+// cidr ranges exclude the ips in them and domains, with or without a leading . or *., the domain and its
+// subdomains. Ports in the list are ignored.
+func excludedFromProxy(host, list string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entryHost, _, err := net.SplitHostPort(entry); err == nil {
+			entry = entryHost
+		}
+		entry = strings.Trim(entry, "[]")
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handshake starts a tls session on the connection, the server name defaults to the host of the server
+func (t schemeTransport) handshake(conn net.Conn, server *url.URL, deadline time.Time) (net.Conn, error) {
+	config := t.tls
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = server.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	conn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t schemeTransport) dialWebSocket(dialer *net.Dialer, server *url.URL, deadline time.Time) (net.Conn, error) {
+	options := t.websocket
+	if options == nil {
+		options = &WebSocketOptions{}
+	}
+	location := *server
+	if options.Path != "" {
+		location.Path = options.Path
+	}
+	origin := "http://" + server.Host
+	address := server.Host
+	if server.Port() == "" {
+		address = net.JoinHostPort(server.Hostname(), "80")
+	}
+	if server.Scheme == "wss" {
+		origin = "https://" + server.Host
+		if server.Port() == "" {
+			address = net.JoinHostPort(server.Hostname(), "443")
+		}
+	}
+	config, err := websocket.NewConfig(location.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = options.Subprotocols
+	if len(config.Protocol) == 0 {
+		config.Protocol = []string{"mqtt"}
+	}
+	for name, values := range options.Header {
+		config.Header[name] = values
+	}
+
+	conn, err := t.dialTCP(dialer, address)
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme == "wss" {
+		conn, err = t.handshake(conn, server, deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn.SetDeadline(deadline)
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialHTTPProxy opens a tunnel to the address with an http CONNECT request
+func dialHTTPProxy(dialer *net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := dialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	// the deadline covers the tls handshake with an https proxy as well as the CONNECT request
+	if !dialer.Deadline.IsZero() {
+		conn.SetDeadline(dialer.Deadline)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: proxy refused to connect to %v: %v", address, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection of which some data was already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,303 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+	"golang.org/x/net/websocket"
+)
+
+// webSocketBroker serves a broker over websockets and checks the upgrade requests
+func webSocketBroker(t *testing.T, broker *mqtttest.Broker) *httptest.Server {
+	return httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			if request.URL.Path != "/mqtt" {
+				t.Errorf("path should have been /mqtt but is %v", request.URL.Path)
+			}
+			if request.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("authorization header should have been sent")
+			}
+			if len(config.Protocol) != 1 || config.Protocol[0] != "mqttv3.1" {
+				t.Errorf("subprotocol should have been mqttv3.1 but is %v", config.Protocol)
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			broker.ServeConn(ws)
+		},
+	})
+}
+
+var webSocketOptions = &mqtt.WebSocketOptions{
+	Header:       http.Header{"Authorization": []string{"Bearer token"}},
+	Path:         "/mqtt",
+	Subprotocols: []string{"mqttv3.1"},
+}
+
+// TestWebSocketOptions checks that the websocket options are used in the upgrade request
+func TestWebSocketOptions(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	server := webSocketBroker(t, broker)
+	defer server.Close()
+
+	connectClient(t, mqtt.ClientOptions{
+		Servers:   []string{"ws://" + server.Listener.Addr().String() + "/ignored"},
+		WebSocket: webSocketOptions,
+	}).DisconnectImmediately()
+}
+
+// connectProxy is an http proxy that tunnels CONNECT requests with the right credentials
+func connectProxy(t *testing.T) (net.Listener, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen should not have failed: %v", err)
+	}
+	tunnels := int32(0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil || request.Method != http.MethodConnect {
+				conn.Close()
+				continue
+			}
+			username, password, _ := (&http.Request{Header: http.Header{"Authorization": request.Header["Proxy-Authorization"]}}).BasicAuth()
+			if username != "user" || password != "pass" {
+				fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				conn.Close()
+				continue
+			}
+			atomic.AddInt32(&tunnels, 1)
+			tunnel(conn, request.Host, "HTTP/1.1 200 Connection established\r\n\r\n")
+		}
+	}()
+	return listener, &tunnels
+}
+
+// tunnel answers the client and copies data between it and the target in both directions
+func tunnel(conn net.Conn, target string, answer string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	io.WriteString(conn, answer)
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+}
+
+// TestHTTPProxy checks that tcp and websocket servers are dialed through an http proxy
+func TestHTTPProxy(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	server := webSocketBroker(t, broker)
+	defer server.Close()
+	proxy, tunnels := connectProxy(t)
+	defer proxy.Close()
+
+	connectClient(t, mqtt.ClientOptions{
+		Servers: []string{broker.URL},
+		Proxy:   "http://user:pass@" + proxy.Addr().String(),
+	}).DisconnectImmediately()
+	connectClient(t, mqtt.ClientOptions{
+		Servers:   []string{"ws://" + server.Listener.Addr().String()},
+		WebSocket: webSocketOptions,
+		Proxy:     "http://user:pass@" + proxy.Addr().String(),
+	}).DisconnectImmediately()
+	if count := atomic.LoadInt32(tunnels); count != 2 {
+		t.Fatalf("both connections should have been tunneled but %v were", count)
+	}
+
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{broker.URL},
+		Proxy:   "http://user:wrong@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("connect should have failed with the proxy status but failed with %v", err)
+	}
+}
+
+// TestSOCKS5Proxy checks that servers are dialed through a socks5 proxy
+func TestSOCKS5Proxy(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen should not have failed: %v", err)
+	}
+	defer listener.Close()
+	tunneled := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// greeting without authentication, then a connect request with an ipv4 address
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{5, 0})
+		request := make([]byte, 10)
+		io.ReadFull(conn, request)
+		target := fmt.Sprintf("%v:%v", net.IP(request[4:8]), binary.BigEndian.Uint16(request[8:]))
+		tunneled <- target
+		tunnel(conn, target, string([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}))
+	}()
+
+	connectClient(t, mqtt.ClientOptions{
+		Servers: []string{broker.URL},
+		Proxy:   "socks5://" + listener.Addr().String(),
+	}).DisconnectImmediately()
+	if target := <-tunneled; "tcp://"+target != broker.URL {
+		t.Fatalf("proxy should have connected to the broker but connected to %v", target)
+	}
+}
+
+// setenv sets an environment variable until the returned function restores it
+func setenv(key, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// TestEnvironmentProxy checks that servers are dialed through the proxy in the environment unless they are
+// excluded from it
+func TestEnvironmentProxy(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	proxy, tunnels := connectProxy(t)
+	defer proxy.Close()
+	defer setenv("ALL_PROXY", "http://user:pass@"+proxy.Addr().String())()
+	defer setenv("all_proxy", "")()
+	defer setenv("NO_PROXY", "")()
+	defer setenv("no_proxy", "")()
+
+	connectClient(t, mqtt.ClientOptions{Servers: []string{broker.URL}}).DisconnectImmediately()
+	if count := atomic.LoadInt32(tunnels); count != 1 {
+		t.Fatalf("the connection should have been tunneled but %v were", count)
+	}
+	for _, key := range []string{"NO_PROXY", "no_proxy"} {
+		for _, excluded := range []string{"127.0.0.1", "10.0.0.0/8,127.0.0.0/8", "*"} {
+			restore := setenv(key, excluded)
+			connectClient(t, mqtt.ClientOptions{Servers: []string{broker.URL}}).DisconnectImmediately()
+			restore()
+			if count := atomic.LoadInt32(tunnels); count != 1 {
+				t.Fatalf("%v=%v should have excluded the broker from the proxy", key, excluded)
+			}
+		}
+	}
+}
+
+// TestHTTPSProxyTimeout checks that the tls handshake with an https proxy is limited by the connect timeout
+func TestHTTPSProxyTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen should not have failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		// accept the connection but never answer the handshake
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:        []string{broker},
+		Proxy:          "https://" + listener.Addr().String(),
+		ConnectTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	// the context of connect expires after a second, so only the connect timeout fails it sooner
+	start := time.Now()
+	if err := client.Connect(ctx()); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("connect should have failed after the connect timeout but took %v and failed with %v", time.Since(start), err)
+	}
+}
+
+// TestUnsupportedProxy checks that only http, https and socks5 proxies are accepted
+func TestUnsupportedProxy(t *testing.T) {
+	_, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{broker},
+		Proxy:   "ftp://proxy.internal",
+	})
+	if !errors.Is(err, mqtt.ErrUnsupportedProxy) {
+		t.Fatalf("creating client should have failed with ErrUnsupportedProxy but failed with %v", err)
+	}
+}
+
+// TestUnixSocket checks that unix urls with an absolute path dial the socket, also when they come from a url
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-unix")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mqtt.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer listener.Close()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.ServeConn(conn)
+		}
+	}()
+
+	connectClient(t, mqtt.ClientOptions{Servers: []string{"unix://" + path}}).DisconnectImmediately()
+	options, err := mqtt.ParseClientOptions("unix://" + path)
+	if err != nil {
+		t.Fatalf("parsing the url should not have failed: %v", err)
+	}
+	connectClient(t, options).DisconnectImmediately()
+}
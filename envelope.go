@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// properties are the per message settings that MQTT 5 sends as publish properties
+type properties struct {
+	contentType     string
+	userProperties  map[string]string
+	responseTopic   string
+	correlationData []byte
+	dedupKey        string
+}
+
+func (p properties) empty() bool {
+	return p.contentType == "" && len(p.userProperties) == 0 && p.responseTopic == "" && p.correlationData == nil && p.dedupKey == ""
+}
+
+// dedupKeyProperty is the user property that carries the dedup key with mqtt 5
+const dedupKeyProperty = "dedup_key"
+
+// packet returns the properties as mqtt 5 publish properties. The user properties are sorted by key so the
+// packets do not depend on the order of the map.
+func (p properties) packet() packets.Properties {
+	result := packets.Properties{ContentType: p.contentType, ResponseTopic: p.responseTopic, CorrelationData: p.correlationData}
+	keys := make([]string, 0, len(p.userProperties))
+	for key := range p.userProperties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.UserProperties = append(result.UserProperties, packets.UserProperty{Key: key, Value: p.userProperties[key]})
+	}
+	if p.dedupKey != "" {
+		result.UserProperties = append(result.UserProperties, packets.UserProperty{Key: dedupKeyProperty, Value: p.dedupKey})
+	}
+	return result
+}
+
+// receivedProperties returns the properties of a received mqtt 5 publish. Of user properties with the same key
+// the last one is kept.
+func receivedProperties(received *packets.Properties) properties {
+	p := properties{contentType: received.ContentType, responseTopic: received.ResponseTopic, correlationData: received.CorrelationData}
+	for _, property := range received.UserProperties {
+		if property.Key == dedupKeyProperty {
+			p.dedupKey = property.Value
+			continue
+		}
+		if p.userProperties == nil {
+			p.userProperties = map[string]string{}
+		}
+		p.userProperties[property.Key] = property.Value
+	}
+	return p
+}
+
+// envelopeVersion is the value of the mqtt_envelope key that marks a payload as an envelope
+const envelopeVersion = 1
+
+// envelope carries the properties along with the payload when the Envelope option is set. MQTT 3.1.1 has no
+// publish properties, so they are wrapped in a json object with the payload:
+//
+//	{"mqtt_envelope":1,"properties":{"tenant":"acme"},"content_type":"application/json","payload":{"a":1}}
+//
+// The mqtt_envelope key is required and reserved, payloads without it are never unwrapped. A json payload is
+// embedded as is in payload, any other payload as base64 in payload_base64. The other keys are optional.
+type envelope struct {
+	Version         int               `json:"mqtt_envelope"`
+	Properties      map[string]string `json:"properties"`
+	ContentType     string            `json:"content_type,omitempty"`
+	ResponseTopic   string            `json:"response_topic,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	DedupKey        string            `json:"dedup_key,omitempty"`
+	Payload         json.RawMessage   `json:"payload,omitempty"`
+	PayloadBase64   []byte            `json:"payload_base64,omitempty"`
+}
+
+// wrap puts the properties and the payload in an envelope
+func wrap(p properties, payload []byte) []byte {
+	e := envelope{
+		Version:         envelopeVersion,
+		Properties:      p.userProperties,
+		ContentType:     p.contentType,
+		ResponseTopic:   p.responseTopic,
+		CorrelationData: p.correlationData,
+		DedupKey:        p.dedupKey,
+	}
+	if e.Properties == nil {
+		e.Properties = map[string]string{}
+	}
+	compact := &bytes.Buffer{}
+	if json.Compact(compact, payload) == nil && bytes.Equal(compact.Bytes(), payload) {
+		e.Payload = payload
+	} else {
+		e.PayloadBase64 = payload
+	}
+	// json.Marshal would escape <, > and & in the embedded payload, which has to arrive unchanged
+	data := &bytes.Buffer{}
+	encoder := json.NewEncoder(data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(e); err != nil {
+		return payload
+	}
+	return bytes.TrimSuffix(data.Bytes(), []byte("\n"))
+}
+
+// unwrap returns the properties and the payload of an envelope, ok is false if the payload is not an envelope
+// because it is not a json object with the mqtt_envelope marker
+func unwrap(data []byte) (p properties, payload []byte, ok bool) {
+	if len(data) == 0 || data[0] != '{' {
+		return properties{}, nil, false
+	}
+	var e envelope
+	if json.Unmarshal(data, &e) != nil || e.Version != envelopeVersion {
+		return properties{}, nil, false
+	}
+	p = properties{
+		contentType:     e.ContentType,
+		userProperties:  e.Properties,
+		responseTopic:   e.ResponseTopic,
+		correlationData: e.CorrelationData,
+		dedupKey:        e.DedupKey,
+	}
+	if e.Payload != nil {
+		return p, e.Payload, true
+	}
+	return p, e.PayloadBase64, true
+}
+
+// dedupWindow is the number of recently received dedup keys that are remembered
+const dedupWindow = 1024
+
+// dedup remembers the dedup keys of the recently received messages
+type dedup struct {
+	lock  sync.Mutex
+	keys  map[string]bool
+	order []string
+	next  int
+}
+
+func newDedup() *dedup {
+	return &dedup{keys: map[string]bool{}, order: make([]string, 0, dedupWindow)}
+}
+
+// seen returns true if the key was received before and remembers it otherwise, forgetting the oldest key
+func (d *dedup) seen(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.keys[key] {
+		return true
+	}
+	if len(d.order) < dedupWindow {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.keys, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % dedupWindow
+	}
+	d.keys[key] = true
+	return false
+}
@@ -0,0 +1,212 @@
+package mqtt_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// publishedPayload parses the payload of a QoS 1 or 2 publish packet
+func publishedPayload(packet fakePacket) []byte {
+	topicLength := int(packet.body[0])<<8 | int(packet.body[1])
+	return packet.body[4+topicLength:]
+}
+
+// TestPublishOptionsEnvelope checks that messages with properties are sent in a json envelope
+func TestPublishOptionsEnvelope(t *testing.T) {
+	fake := newFakeBroker(t)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{Servers: []string{fake.server}, Envelope: true})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+
+	err = client.PublishString(ctx(), "TestPublishOptionsEnvelope", "plain", mqtt.AtLeastOnce, mqtt.WithRetain(), mqtt.WithExpiry(time.Minute))
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if payload := string(publishedPayload(fake.expect(t, 3))); payload != "plain" {
+		t.Fatalf("a message without properties should have been sent as is but was %v", payload)
+	}
+
+	err = client.PublishJSON(ctx(), "TestPublishOptionsEnvelope", map[string]int{"a": 1}, mqtt.AtLeastOnce,
+		mqtt.WithContentType("application/json"), mqtt.WithUserProperty("tenant", "acme"), mqtt.WithDedupKey("1"))
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	expected := `{"mqtt_envelope":1,"properties":{"tenant":"acme"},"content_type":"application/json","dedup_key":"1","payload":{"a":1}}`
+	if payload := string(publishedPayload(fake.expect(t, 3))); payload != expected {
+		t.Fatalf("the envelope should have been %v but was %v", expected, payload)
+	}
+
+	err = client.Publish(ctx(), "TestPublishOptionsEnvelope", []byte("hi"), mqtt.AtLeastOnce, mqtt.WithResponseTopic("responses"))
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	expected = `{"mqtt_envelope":1,"properties":{},"response_topic":"responses","payload_base64":"aGk="}`
+	if payload := string(publishedPayload(fake.expect(t, 3))); payload != expected {
+		t.Fatalf("the envelope should have been %v but was %v", expected, payload)
+	}
+}
+
+// TestPublishOptions checks that the properties reach the handler and that messages with a dedup key that was
+// received before are not handled again
+func TestPublishOptions(t *testing.T) {
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Envelope: true})
+	defer client.DisconnectImmediately()
+
+	topic := testUUID + "/TestPublishOptions"
+	messages := make(chan mqtt.Message, 10)
+	client.Handle(topic, func(message mqtt.Message) {
+		messages <- message
+	})
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	options := []mqtt.PublishOption{
+		mqtt.WithContentType("text/plain"),
+		mqtt.WithUserProperty("tenant", "acme"),
+		mqtt.WithUserProperty("region", "eu"),
+		mqtt.WithResponseTopic(topic + "/responses"),
+		mqtt.WithCorrelationData([]byte{1, 2}),
+		mqtt.WithDedupKey("request-1"),
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce, options...); err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+	}
+	if err := client.PublishJSON(ctx(), topic, []string{"next"}, mqtt.AtLeastOnce, mqtt.WithDedupKey("request-2")); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+
+	message := receive(t, messages)
+	if message.PayloadString() != "hello" || message.ContentType() != "text/plain" || message.ResponseTopic() != topic+"/responses" ||
+		!reflect.DeepEqual(message.CorrelationData(), []byte{1, 2}) || message.DedupKey() != "request-1" ||
+		!reflect.DeepEqual(message.UserProperties(), map[string]string{"tenant": "acme", "region": "eu"}) {
+		t.Fatalf("the message should have had the properties but is %+v", message)
+	}
+	message = receive(t, messages)
+	var payload []string
+	if err := message.PayloadJSON(&payload); err != nil || message.DedupKey() != "request-2" {
+		t.Fatalf("the duplicate should have been ignored but got %v %v", message.PayloadString(), message.DedupKey())
+	}
+}
+
+// TestPublishOptionsV5 checks that mqtt 5 sends the options as properties and leaves the payload as it is
+func TestPublishOptionsV5(t *testing.T) {
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, ProtocolVersion: mqtt.ProtocolV5})
+	defer client.DisconnectImmediately()
+	plain := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}})
+	defer plain.DisconnectImmediately()
+
+	topic := testUUID + "/TestPublishOptionsV5"
+	messages := make(chan mqtt.Message, 10)
+	client.Handle(topic, func(message mqtt.Message) {
+		messages <- message
+	})
+	plainMessages := make(chan mqtt.Message, 10)
+	plain.Handle(topic, func(message mqtt.Message) {
+		plainMessages <- message
+	})
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if err := plain.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce,
+		mqtt.WithContentType("text/plain"),
+		mqtt.WithUserProperty("tenant", "acme"),
+		mqtt.WithResponseTopic(topic+"/responses"),
+		mqtt.WithCorrelationData([]byte{1, 2}),
+		mqtt.WithDedupKey("request-1"),
+		mqtt.WithExpiry(time.Hour))
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+
+	message := receive(t, messages)
+	if message.PayloadString() != "hello" || message.ContentType() != "text/plain" || message.ResponseTopic() != topic+"/responses" ||
+		!reflect.DeepEqual(message.CorrelationData(), []byte{1, 2}) || message.DedupKey() != "request-1" ||
+		!reflect.DeepEqual(message.UserProperties(), map[string]string{"tenant": "acme"}) {
+		t.Fatalf("the message should have had the properties but is %+v", message)
+	}
+	if expiry := message.Expiry(); expiry <= 59*time.Minute || expiry > time.Hour {
+		t.Fatalf("the message should have expired in an hour but expires in %v", expiry)
+	}
+	if message := receive(t, plainMessages); message.PayloadString() != "hello" {
+		t.Fatalf("a client without mqtt 5 should have received the payload as is but received %v", message.PayloadString())
+	}
+}
+
+// TestPublishOptionsWithoutEnvelope checks that properties are refused with mqtt 3.1.1 unless the envelope is
+// enabled, while the options that do not change the message still work
+func TestPublishOptionsWithoutEnvelope(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{fake.server}})
+	defer client.DisconnectImmediately()
+
+	err := client.PublishString(ctx(), "TestPublishOptionsWithoutEnvelope", "hello", mqtt.AtLeastOnce, mqtt.WithContentType("text/plain"))
+	if !errors.Is(err, mqtt.ErrPropertiesUnsupported) {
+		t.Fatalf("publish should have failed with ErrPropertiesUnsupported: %v", err)
+	}
+	err = client.PublishString(ctx(), "TestPublishOptionsWithoutEnvelope", "hello", mqtt.AtLeastOnce, mqtt.WithRetain(), mqtt.WithExpiry(time.Minute))
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if payload := string(publishedPayload(fake.expect(t, 3))); payload != "hello" {
+		t.Fatalf("the payload should have been sent as is but was %v", payload)
+	}
+}
+
+// TestPlainJSONPayload checks that json payloads without the envelope marker reach the handlers unchanged, also
+// when the envelope is enabled
+func TestPlainJSONPayload(t *testing.T) {
+	for _, envelope := range []bool{false, true} {
+		client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Envelope: envelope})
+		topic := testUUID + "/TestPlainJSONPayload"
+		messages, _ := client.Listen(topic)
+		if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+			t.Fatalf("subscribe should not have failed: %v", err)
+		}
+		payload := `{"properties":{"color":"red"}}`
+		if err := client.PublishString(ctx(), topic, payload, mqtt.AtLeastOnce); err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+		message := receive(t, messages)
+		if message.PayloadString() != payload || message.UserProperties() != nil {
+			t.Fatalf("the payload should have been delivered unchanged but was %v with %v", message.PayloadString(), message.UserProperties())
+		}
+		client.DisconnectImmediately()
+	}
+}
+
+// TestEnvelopeRoundtrip checks that a json payload comes out of the envelope exactly as it went in, also with
+// characters that html escaping would change
+func TestEnvelopeRoundtrip(t *testing.T) {
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Envelope: true})
+	defer client.DisconnectImmediately()
+	topic := testUUID + "/TestEnvelopeRoundtrip"
+	messages, _ := client.Listen(topic)
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	payload := `{"a":"<b>&"}`
+	if err := client.PublishString(ctx(), topic, payload, mqtt.AtLeastOnce, mqtt.WithUserProperty("tenant", "acme")); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	message := receive(t, messages)
+	if message.PayloadString() != payload || message.UserProperties()["tenant"] != "acme" {
+		t.Fatalf("the payload should have been %v with the user property but was %v with %v", payload, message.PayloadString(), message.UserProperties())
+	}
+}
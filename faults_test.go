@@ -0,0 +1,161 @@
+package mqtt_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// faultyOptions makes a client dial the broker through a new faulty transport, reconnect quickly and record its
+// events
+func faultyOptions(broker *mqtttest.Broker, options mqtt.ClientOptions) (mqtt.ClientOptions, *mqtttest.FaultyTransport, mqtttest.Events) {
+	transport := mqtttest.NewFaultyTransport(mqtt.PipeTransport(broker.ServeConn))
+	events := mqtttest.NewEvents()
+	options.Servers = []string{"pipe://broker"}
+	options.Transport = transport
+	options.AutoReconnect = true
+	options.ReconnectPolicy = mqtt.ReconnectPolicy{MinDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	options.OnEvent = events.Record
+	return options, transport, events
+}
+
+// TestFaultyReset checks that a scheduled reset drops the connection and that the client resubscribes
+func TestFaultyReset(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	options, transport, events := faultyOptions(broker, mqtt.ClientOptions{})
+	client := connectClient(t, options)
+	events.Expect(t, mqtt.EventConnected)
+	defer client.DisconnectImmediately()
+
+	messages, _ := client.Listen("reset")
+	if err := client.Subscribe(ctx(), "reset", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	stop := transport.Run(mqtttest.Step{After: 10 * time.Millisecond, Fault: (*mqtttest.FaultyTransport).Reset})
+	defer stop()
+	events.Wait(t, mqtt.EventConnectionLost)
+	events.Wait(t, mqtt.EventConnected)
+
+	if err := client.PublishString(ctx(), "reset", "again", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	select {
+	case message := <-messages:
+		if message.PayloadString() != "again" {
+			t.Fatalf("message payload should have been again but is %v", message.PayloadString())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("subscription should have been restored")
+	}
+}
+
+// TestFaultyPartition checks that a half-open connection is detected by the keepalive and that reconnecting
+// works once the partition heals
+func TestFaultyPartition(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	options, transport, events := faultyOptions(broker, mqtt.ClientOptions{
+		KeepAlive:   time.Second,
+		PingTimeout: 200 * time.Millisecond,
+	})
+	client := connectClient(t, options)
+	events.Expect(t, mqtt.EventConnected)
+	defer client.DisconnectImmediately()
+
+	transport.Partition()
+	event := events.Wait(t, mqtt.EventConnectionLost)
+	if !errors.Is(event.Err, mqtt.ErrPingTimeout) {
+		t.Fatalf("connection should have been lost because of the ping timeout but was %v", event.Err)
+	}
+	events.Wait(t, mqtt.EventReconnecting)
+	transport.Heal()
+	events.Wait(t, mqtt.EventConnected)
+}
+
+// TestFaultyRedelivery checks that a message lost on the way to a persistent session is redelivered after
+// reconnecting
+func TestFaultyRedelivery(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	options, transport, events := faultyOptions(broker, mqtt.ClientOptions{PersistentSession: true})
+	subscriber := connectClient(t, options)
+	events.Expect(t, mqtt.EventConnected)
+	defer subscriber.DisconnectImmediately()
+	messages, _ := subscriber.Listen("redelivery")
+	if err := subscriber.Subscribe(ctx(), "redelivery", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	publisher := connectClient(t, mqtt.ClientOptions{Servers: []string{broker.URL}})
+	defer publisher.DisconnectImmediately()
+
+	transport.SetFaults(mqtttest.Faults{DropRate: 1})
+	if err := publisher.PublishString(ctx(), "redelivery", "lost", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	select {
+	case <-messages:
+		t.Fatalf("message should have been dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	transport.SetFaults(mqtttest.Faults{})
+	transport.Reset()
+	events.Wait(t, mqtt.EventConnected)
+	select {
+	case message := <-messages:
+		if message.PayloadString() != "lost" || !message.IsDuplicate() {
+			t.Fatalf("message should have been redelivered as a duplicate but was %v, %v", message.PayloadString(), message.IsDuplicate())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message should have been redelivered")
+	}
+}
+
+// TestFaultyLatency checks that packets are delayed in both directions
+func TestFaultyLatency(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	options, transport, _ := faultyOptions(broker, mqtt.ClientOptions{})
+	client := connectClient(t, options)
+	defer client.DisconnectImmediately()
+
+	transport.SetFaults(mqtttest.Faults{Latency: 50 * time.Millisecond, Bandwidth: 1 << 20})
+	start := time.Now()
+	if err := client.Subscribe(ctx(), "latency", mqtt.AtMostOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("round trip should have taken at least 100ms but took %v", elapsed)
+	}
+}
+
+// TestFaultyV5 checks that mqtt 5 connections pass the faulty transport with their properties
+func TestFaultyV5(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	options, transport, _ := faultyOptions(broker, mqtt.ClientOptions{ProtocolVersion: mqtt.ProtocolV5})
+	client := connectClient(t, options)
+	defer client.DisconnectImmediately()
+
+	transport.SetFaults(mqtttest.Faults{Latency: 10 * time.Millisecond})
+	messages, _ := client.Listen("v5")
+	if err := client.Subscribe(ctx(), "v5", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if err := client.PublishString(ctx(), "v5", "hello", mqtt.AtLeastOnce, mqtt.WithContentType("text/plain")); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	select {
+	case message := <-messages:
+		if message.PayloadString() != "hello" || message.ContentType() != "text/plain" {
+			t.Fatalf("the message should have had its payload and content type but is %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message should have been received")
+	}
+}
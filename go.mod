@@ -3,7 +3,7 @@ module github.com/lucacasonato/mqtt
 go 1.13
 
 require (
-	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/google/uuid v1.1.2
-	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582 // indirect
+	golang.org/x/net v0.0.0-20191014212845-da9a3fd4c582
+	gopkg.in/yaml.v2 v2.4.0
 )
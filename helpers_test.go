@@ -0,0 +1,48 @@
+package mqtt_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// ctx limits an operation of a test to a second
+func ctx() context.Context {
+	c, cancel := context.WithTimeout(context.Background(), time.Second)
+	time.AfterFunc(time.Second, cancel)
+	return c
+}
+
+// newClient creates a client and fails the test if the options are invalid
+func newClient(t *testing.T, options mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+	client, err := mqtt.NewClient(options)
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	return client
+}
+
+// connectClient creates a client and connects it
+func connectClient(t *testing.T, options mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+	client := newClient(t, options)
+	if err := client.Connect(ctx()); err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	return client
+}
+
+// receive waits for a message on the channel
+func receive(t *testing.T, messages chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message should have been handled")
+		return mqtt.Message{}
+	}
+}
@@ -0,0 +1,233 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+)
+
+// State describes the connection state of a client
+type State int
+
+const (
+	// StateDisconnected means the client is not connected and is not trying to connect
+	StateDisconnected State = iota
+	// StateConnecting means the client is connecting for the first time after calling Connect
+	StateConnecting
+	// StateConnected means the client is connected to a broker
+	StateConnected
+	// StateReconnecting means the connection was lost and the client is automatically trying to reconnect
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// EventType describes what happened to the connection of a client
+type EventType int
+
+const (
+	// EventConnected means the client connected or reconnected to a broker
+	EventConnected EventType = iota
+	// EventConnectionLost means the connection to the broker was lost unexpectedly
+	EventConnectionLost
+	// EventReconnecting means the client is starting a new attempt to reconnect
+	EventReconnecting
+	// EventDisconnected means the client is disconnected and will not reconnect by itself
+	EventDisconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventConnectionLost:
+		return "connection lost"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// Event is a change in the connection of a client
+type Event struct {
+	Type    EventType // What happened
+	Err     error     // Why the connection was lost, only set for EventConnectionLost
+	Attempt int       // The reconnect attempt starting at 1, only set for EventReconnecting
+}
+
+// An EventHandler gets called with every connection event of a client
+type EventHandler func(Event)
+
+// lifecycle keeps track of the connection state and delivers events to the handler in order
+type lifecycle struct {
+	lock    sync.Mutex
+	state   State
+	changed chan struct{}
+	events  chan Event
+}
+
+func newLifecycle(handler EventHandler) *lifecycle {
+	l := &lifecycle{state: StateDisconnected, changed: make(chan struct{})}
+	if handler != nil {
+		l.events = make(chan Event, 16)
+		go func() {
+			for event := range l.events {
+				handler(event)
+			}
+		}()
+	}
+	return l
+}
+
+// current returns the state and a channel that is closed once the state changes
+func (l *lifecycle) current() (State, chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.state, l.changed
+}
+
+// set changes the state and returns the previous one
+func (l *lifecycle) set(state State) State {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	previous := l.state
+	l.transition(state)
+	return previous
+}
+
+// compareAndSet only changes the state if it is one of the expected states
+func (l *lifecycle) compareAndSet(state State, expected ...State) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, e := range expected {
+		if l.state == e {
+			l.transition(state)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lifecycle) transition(state State) {
+	if l.state == state {
+		return
+	}
+	l.state = state
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *lifecycle) emit(event Event) {
+	if l.events != nil {
+		l.events <- event
+	}
+}
+
+// State returns the current connection state of the client
+func (c *Client) State() State {
+	state, _ := c.lifecycle.current()
+	return state
+}
+
+// WaitConnected blocks until the client is connected or the context expires
+func (c *Client) WaitConnected(ctx context.Context) error {
+	for {
+		state, changed := c.lifecycle.current()
+		if state == StateConnected {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// awaitConnected waits until the session was resumed on a new connection, so Connect only returns once the client
+// is connected and the outbox and the offline queue were sent. It fails if the client was disconnected meanwhile.
+func (c *Client) awaitConnected(ctx context.Context) error {
+	for {
+		state, changed := c.lifecycle.current()
+		switch state {
+		case StateConnected:
+			return nil
+		case StateDisconnected:
+			return ErrDisconnected
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// awaitReconnect holds operations back while the client is reconnecting so they are sent on the new connection
+func (c *Client) awaitReconnect(ctx context.Context) error {
+	for {
+		state, changed := c.lifecycle.current()
+		if state != StateReconnecting {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (c *Client) onConnect() {
+	if c.State() == StateReconnecting {
+		// operations are held back until the subscriptions are restored
+		c.resubscribe()
+	}
+	if c.outbox != nil {
+		c.replay()
+	}
+	if c.queue != nil {
+		c.flush()
+	}
+	// if the connection dropped meanwhile onConnectionLost takes care of it, otherwise it sees the new state
+	connected := false
+	c.core.whileConnected(func() {
+		connected = c.lifecycle.compareAndSet(StateConnected, StateConnecting, StateReconnecting)
+	})
+	if connected {
+		c.lifecycle.emit(Event{Type: EventConnected})
+	} else if c.State() == StateDisconnected {
+		// the client was disconnected while the connection was being established
+		c.core.disconnect()
+	}
+}
+
+func (c *Client) onConnectionLost(err error) {
+	if c.queue != nil {
+		c.queue.offline()
+	}
+	c.lifecycle.emit(Event{Type: EventConnectionLost, Err: err})
+	// the connection can also drop while the session is resumed and the client is still connecting
+	if c.Options.AutoReconnect {
+		if c.lifecycle.compareAndSet(StateReconnecting, StateConnected, StateConnecting) {
+			go c.reconnect()
+		}
+		return
+	}
+	if c.lifecycle.compareAndSet(StateDisconnected, StateConnected, StateConnecting) {
+		c.lifecycle.emit(Event{Type: EventDisconnected})
+	}
+}
@@ -0,0 +1,293 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// fakePacket is a packet received by the fake broker
+type fakePacket struct {
+	kind byte
+	body []byte
+}
+
+// fakeBroker accepts every connection and acknowledges the packets it receives without routing any messages
+type fakeBroker struct {
+	server       string
+	listener     net.Listener
+	conns        chan net.Conn
+	packets      chan fakePacket
+	ackPublishes bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	return listenFakeBroker(t, "127.0.0.1:0", true)
+}
+
+func listenFakeBroker(t *testing.T, address string, ackPublishes bool) *fakeBroker {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	broker := &fakeBroker{
+		server:   "tcp://" + listener.Addr().String(),
+		listener: listener,
+		conns:    make(chan net.Conn, 10),
+		packets:  make(chan fakePacket, 100),
+
+		ackPublishes: ackPublishes,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			broker.conns <- conn
+			go acknowledge(conn, broker.packets, broker.ackPublishes)
+		}
+	}()
+	return broker
+}
+
+// close stops accepting new connections
+func (b *fakeBroker) close() {
+	b.listener.Close()
+}
+
+// expect waits for a packet of a certain kind and skips all others
+func (b *fakeBroker) expect(t *testing.T, kind byte) fakePacket {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case packet := <-b.packets:
+			if packet.kind == kind {
+				return packet
+			}
+		case <-timeout:
+			t.Fatalf("fake broker did not receive a packet of kind %v", kind)
+		}
+	}
+}
+
+// acknowledge answers connect, subscribe, unsubscribe, publish and ping packets until the connection is closed.
+// Every packet is also sent on the packets channel if it is not nil and has room. Clients that do not ask for a
+// clean session are told that their session is present.
+func acknowledge(conn net.Conn, packets chan fakePacket, ackPublishes bool) {
+	defer conn.Close()
+	header := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		kind := header[0] >> 4
+		qos := (header[0] >> 1) & 3
+		length, multiplier := 0, 1
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			length += int(header[0]&127) * multiplier
+			multiplier *= 128
+			if header[0]&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		select {
+		case packets <- fakePacket{kind: kind, body: body}:
+		default:
+		}
+
+		var response []byte
+		switch kind {
+		case 1: // connect
+			nameLength := int(body[0])<<8 | int(body[1])
+			sessionPresent := byte(0)
+			if body[3+nameLength]&0x02 == 0 {
+				sessionPresent = 1
+			}
+			response = []byte{0x20, 0x02, sessionPresent, 0x00}
+			if body[2+nameLength] == 5 {
+				// mqtt 5 adds the length of the properties
+				response = []byte{0x20, 0x03, sessionPresent, 0x00, 0x00}
+			}
+		case 3: // publish
+			if !ackPublishes {
+				break
+			}
+			topicLength := int(body[0])<<8 | int(body[1])
+			id := body[2+topicLength : 4+topicLength]
+			if qos == 1 {
+				response = []byte{0x40, 0x02, id[0], id[1]}
+			} else if qos == 2 {
+				response = []byte{0x50, 0x02, id[0], id[1]}
+			}
+		case 6: // pubrel
+			response = []byte{0x70, 0x02, body[0], body[1]}
+		case 8: // subscribe
+			granted := []byte{}
+			for i := 2; i < len(body); {
+				topicLength := int(body[i])<<8 | int(body[i+1])
+				i += 2 + topicLength
+				granted = append(granted, body[i])
+				i++
+			}
+			response = append([]byte{0x90, byte(2 + len(granted)), body[0], body[1]}, granted...)
+		case 10: // unsubscribe
+			response = []byte{0xb0, 0x02, body[0], body[1]}
+		case 12: // pingreq
+			response = []byte{0xd0, 0x00}
+		}
+		if response != nil {
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// subscribedTopics parses the topic filters of a subscribe packet
+func subscribedTopics(packet fakePacket) map[string]byte {
+	topics := map[string]byte{}
+	for i := 2; i < len(packet.body); {
+		topicLength := int(packet.body[i])<<8 | int(packet.body[i+1])
+		topic := string(packet.body[i+2 : i+2+topicLength])
+		i += 2 + topicLength
+		topics[topic] = packet.body[i]
+		i++
+	}
+	return topics
+}
+
+// TestEvents checks that the lifecycle of a connection that gets lost and restored is reported
+func TestEvents(t *testing.T) {
+	fake := newFakeBroker(t)
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		AutoReconnect: true,
+		OnEvent:       events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	if client.State() != mqtt.StateDisconnected {
+		t.Fatalf("state should be disconnected but is %v", client.State())
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	events.Expect(t, mqtt.EventConnected)
+	if client.State() != mqtt.StateConnected {
+		t.Fatalf("state should be connected but is %v", client.State())
+	}
+
+	(<-fake.conns).Close()
+	event := events.Expect(t, mqtt.EventConnectionLost)
+	if event.Err == nil {
+		t.Fatal("connection lost event should have an error")
+	}
+	event = events.Expect(t, mqtt.EventReconnecting)
+	if event.Attempt != 1 {
+		t.Fatalf("reconnect attempt should be 1 but is %v", event.Attempt)
+	}
+	events.Expect(t, mqtt.EventConnected)
+	err = client.WaitConnected(ctx())
+	if err != nil {
+		t.Fatalf("wait connected should not have failed: %v", err)
+	}
+
+	client.DisconnectImmediately()
+	events.Expect(t, mqtt.EventDisconnected)
+	if client.State() != mqtt.StateDisconnected {
+		t.Fatalf("state should be disconnected but is %v", client.State())
+	}
+}
+
+// TestConnectState checks that Connect returns once the client is connected, also when it first has to send the
+// offline queue
+func TestConnectState(t *testing.T) {
+	fake := newFakeBroker(t)
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:      []string{fake.server},
+		OfflineQueue: &mqtt.OfflineQueue{},
+		OnEvent:      events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := client.PublishString(ctx(), "TestConnectState", "hello", mqtt.AtLeastOnce); err != nil {
+			t.Fatalf("publish should have been queued: %v", err)
+		}
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	if client.State() != mqtt.StateConnected {
+		t.Fatalf("state should be connected right after connect but is %v", client.State())
+	}
+	events.Expect(t, mqtt.EventConnected)
+}
+
+// TestEventsWithoutAutoReconnect checks that a lost connection disconnects the client if it does not reconnect
+func TestEventsWithoutAutoReconnect(t *testing.T) {
+	fake := newFakeBroker(t)
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		OnEvent: events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	events.Expect(t, mqtt.EventConnected)
+
+	(<-fake.conns).Close()
+	events.Expect(t, mqtt.EventConnectionLost)
+	events.Expect(t, mqtt.EventDisconnected)
+	if client.State() != mqtt.StateDisconnected {
+		t.Fatalf("state should be disconnected but is %v", client.State())
+	}
+}
+
+// TestWaitConnectedTimeout checks that waiting for a connection errors if the context times out
+func TestWaitConnectedTimeout(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx(), 10*time.Millisecond)
+	defer cancel()
+	err = client.WaitConnected(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait connected should have failed with context.DeadlineExceeded: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log messages of a client. The fields are alternating keys and values, like
+// "topic", "sensors/1", "qos", 1.
+type Logger interface {
+	Debug(message string, fields ...interface{})
+	Info(message string, fields ...interface{})
+	Warn(message string, fields ...interface{})
+	Error(message string, fields ...interface{})
+}
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	// LevelDebug is for the packets sent to and received from the broker
+	LevelDebug LogLevel = iota
+	// LevelInfo is for connects, disconnects and subscription changes
+	LevelInfo
+	// LevelWarn is for lost connections, failed attempts and dropped messages
+	LevelWarn
+	// LevelError is for handler panics, store failures and giving up to reconnect
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// StdLogger logs to a logger of the standard library log package, leaving out the messages below the level. The
+// fields are appended to the message as key=value. A nil logger logs to the standard logger of the log package.
+func StdLogger(logger *log.Logger, level LogLevel) Logger {
+	return &stdLogger{logger: logger, level: level}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+func (l *stdLogger) Debug(message string, fields ...interface{}) {
+	l.log(LevelDebug, message, fields)
+}
+
+func (l *stdLogger) Info(message string, fields ...interface{}) {
+	l.log(LevelInfo, message, fields)
+}
+
+func (l *stdLogger) Warn(message string, fields ...interface{}) {
+	l.log(LevelWarn, message, fields)
+}
+
+func (l *stdLogger) Error(message string, fields ...interface{}) {
+	l.log(LevelError, message, fields)
+}
+
+func (l *stdLogger) log(level LogLevel, message string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "%v mqtt: %v", level, message)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fmt.Fprintf(line, " !BADKEY=%v", quote(fields[i]))
+			break
+		}
+		fmt.Fprintf(line, " %v=%v", fields[i], quote(fields[i+1]))
+	}
+	if l.logger == nil {
+		log.Output(3, line.String())
+	} else {
+		l.logger.Output(3, line.String())
+	}
+}
+
+// quote quotes values that would be ambiguous in a line of key=value pairs
+func quote(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " =\"\n") {
+		return fmt.Sprintf("%q", text)
+	}
+	return text
+}
+
+// noLogger is used when the client options do not have a logger
+type noLogger struct{}
+
+func (noLogger) Debug(message string, fields ...interface{}) {}
+func (noLogger) Info(message string, fields ...interface{})  {}
+func (noLogger) Warn(message string, fields ...interface{})  {}
+func (noLogger) Error(message string, fields ...interface{}) {}
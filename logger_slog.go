@@ -0,0 +1,41 @@
+//go:build go1.21
+// +build go1.21
+
+package mqtt
+
+import (
+	"log/slog"
+)
+
+// SlogLogger logs to a log/slog logger, the fields become attributes of the records. A nil logger logs to
+// slog.Default.
+func SlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l *slogLogger) get() *slog.Logger {
+	if l.logger == nil {
+		return slog.Default()
+	}
+	return l.logger
+}
+
+func (l *slogLogger) Debug(message string, fields ...interface{}) {
+	l.get().Debug(message, fields...)
+}
+
+func (l *slogLogger) Info(message string, fields ...interface{}) {
+	l.get().Info(message, fields...)
+}
+
+func (l *slogLogger) Warn(message string, fields ...interface{}) {
+	l.get().Warn(message, fields...)
+}
+
+func (l *slogLogger) Error(message string, fields ...interface{}) {
+	l.get().Error(message, fields...)
+}
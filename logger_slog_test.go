@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package mqtt_test
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// TestSlogLogger checks that the fields become attributes of the records
+func TestSlogLogger(t *testing.T) {
+	buffer := &logBuffer{}
+	handler := slog.NewTextHandler(buffer, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	})
+	logger := mqtt.SlogLogger(slog.New(handler))
+	logger.Debug("left out")
+	logger.Warn("dropped message", "topic", "a/b", "qos", 1)
+
+	expected := "level=WARN msg=\"dropped message\" topic=a/b qos=1\n"
+	if output := buffer.String(); output != expected {
+		t.Fatalf("log should have been %q but is %q", expected, output)
+	}
+}
@@ -0,0 +1,125 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// logBuffer collects log output that is written and read from different goroutines
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+// waitForLog waits until the buffer contains a line with all the parts
+func waitForLog(t *testing.T, buffer *logBuffer, parts ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, line := range strings.Split(buffer.String(), "\n") {
+			found := true
+			for _, part := range parts {
+				found = found && strings.Contains(line, part)
+			}
+			if found {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("log should have contained a line with %q but is:\n%v", parts, buffer.String())
+}
+
+// TestStdLogger checks the level filter and the formatting of the fields
+func TestStdLogger(t *testing.T) {
+	buffer := &logBuffer{}
+	logger := mqtt.StdLogger(log.New(buffer, "", 0), mqtt.LevelInfo)
+	logger.Debug("left out")
+	logger.Info("subscribed", "topic", "a/b", "qos", 1)
+	logger.Warn("dropped message", "reason", "the queue is full", "empty", "")
+	logger.Error("odd", "key")
+
+	expected := strings.Join([]string{
+		"INFO mqtt: subscribed topic=a/b qos=1",
+		`WARN mqtt: dropped message reason="the queue is full" empty=""`,
+		"ERROR mqtt: odd !BADKEY=key",
+		"",
+	}, "\n")
+	if output := buffer.String(); output != expected {
+		t.Fatalf("log should have been:\n%v\nbut is:\n%v", expected, output)
+	}
+}
+
+// TestLogger checks that connects, subscription changes, dropped messages and handler panics are logged
+func TestLogger(t *testing.T) {
+	buffer := &logBuffer{}
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		OfflineQueue: &mqtt.OfflineQueue{MaxMessages: 1, Overflow: mqtt.OverflowDropNewest},
+		Logger:       mqtt.StdLogger(log.New(buffer, "", 0), mqtt.LevelDebug),
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	client.PublishString(ctx(), "TestLogger/queued", "hello", mqtt.AtLeastOnce)
+	client.PublishString(ctx(), "TestLogger/dropped", "hello", mqtt.AtLeastOnce)
+	waitForLog(t, buffer, "WARN mqtt: dropped message", "topic=TestLogger/dropped", "reason=")
+
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	waitForLog(t, buffer, "INFO mqtt: connected", "server="+broker)
+	waitForLog(t, buffer, "DEBUG mqtt: sent packet", "type=PUBLISH")
+
+	handled := make(chan mqtt.Message, 1)
+	client.Handle(testUUID+"/TestLogger", func(message mqtt.Message) {
+		panic("handler failed")
+	})
+	client.Handle(testUUID+"/TestLogger", func(message mqtt.Message) {
+		handled <- message
+	})
+	err = client.Subscribe(ctx(), testUUID+"/TestLogger", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	waitForLog(t, buffer, "INFO mqtt: subscribed", "topic="+testUUID+"/TestLogger", "qos=1")
+
+	err = client.PublishString(ctx(), testUUID+"/TestLogger", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other handler should still have been called")
+	}
+	waitForLog(t, buffer, "ERROR mqtt: message handler panicked", "panic=\"handler failed\"", "stack=")
+
+	err = client.Unsubscribe(ctx(), testUUID+"/TestLogger")
+	if err != nil {
+		t.Fatalf("unsubscribe should not have failed: %v", err)
+	}
+	waitForLog(t, buffer, "INFO mqtt: unsubscribed", "topic="+testUUID+"/TestLogger")
+}
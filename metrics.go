@@ -0,0 +1,319 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives the measurements of a client, see NewPrometheusMetrics for an implementation. The methods are
+// called from the goroutines of the client, some of them while it holds locks, so they need to be safe for
+// concurrent use and return quickly without calling back into the client.
+type Metrics interface {
+	// MessagePublished is called once a publish completed, with the time from the call to the acknowledgement of
+	// the broker, or to writing the message for QoS 0. Messages from the offline queue and the outbox are measured
+	// from when they were published. The error is nil if the publish succeeded.
+	MessagePublished(qos QOS, bytes int, latency time.Duration, err error)
+	// MessageReceived is called with every message received from the broker
+	MessageReceived(qos QOS, bytes int)
+	// BytesSent is called with the size of the data written to a connection
+	BytesSent(bytes int)
+	// BytesReceived is called with the size of the data read from a connection
+	BytesReceived(bytes int)
+	// Reconnected is called after every automatic reconnect attempt, the error is nil if it succeeded
+	Reconnected(err error)
+	// HandlerDuration is called after a handler of a route returned or panicked
+	HandlerDuration(route string, duration time.Duration)
+	// QueueDepth is called when the number of messages in a queue changes. The queues are "inflight" for the
+	// operations waiting for the broker, "offline" for the offline queue and "outbox" for the outbox.
+	QueueDepth(queue string, depth int)
+}
+
+// noMetrics is used when the client options do not have metrics
+type noMetrics struct{}
+
+func (noMetrics) MessagePublished(qos QOS, bytes int, latency time.Duration, err error) {}
+func (noMetrics) MessageReceived(qos QOS, bytes int)                                    {}
+func (noMetrics) BytesSent(bytes int)                                                   {}
+func (noMetrics) BytesReceived(bytes int)                                               {}
+func (noMetrics) Reconnected(err error)                                                 {}
+func (noMetrics) HandlerDuration(route string, duration time.Duration)                  {}
+func (noMetrics) QueueDepth(queue string, depth int)                                    {}
+
+// measuredConn reports the bytes written to and read from a connection
+type measuredConn struct {
+	net.Conn
+	metrics Metrics
+}
+
+func (c *measuredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.BytesReceived(n)
+	}
+	return n, err
+}
+
+func (c *measuredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.BytesSent(n)
+	}
+	return n, err
+}
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the histogram buckets of the prometheus metrics
+var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics collects the metrics of one or more clients and serves them in the prometheus text format.
+// It is an http.Handler, so it can be mounted on a path like /metrics. The series of the clients are labeled with
+// their client id, measurements passed to the methods directly have no client label.
+type PrometheusMetrics struct {
+	lock      sync.Mutex
+	buckets   []float64
+	published map[series]float64 // by qos
+	failed    map[series]float64 // by qos
+	received  map[series]float64 // by qos
+	sent      map[series]float64
+	read      map[series]float64
+	reconnect map[series]float64 // by result
+	latency   map[series]*histogram
+	handlers  map[series]*histogram
+	depths    map[series]float64
+}
+
+// series identifies the values of a metric by the client and the value of the label of the metric
+type series struct {
+	client string
+	label  string
+}
+
+// NewPrometheusMetrics creates prometheus metrics with the DefaultLatencyBuckets
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		buckets:   DefaultLatencyBuckets,
+		published: map[series]float64{},
+		failed:    map[series]float64{},
+		received:  map[series]float64{},
+		sent:      map[series]float64{},
+		read:      map[series]float64{},
+		reconnect: map[series]float64{},
+		latency:   map[series]*histogram{},
+		handlers:  map[series]*histogram{},
+		depths:    map[series]float64{},
+	}
+}
+
+type histogram struct {
+	counts []float64 // per bucket, not cumulative
+	sum    float64
+	count  float64
+}
+
+func (m *PrometheusMetrics) observe(histograms map[series]*histogram, key series, duration time.Duration) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(m.buckets))}
+		histograms[key] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// MessagePublished counts the publish and records its latency if it succeeded
+func (m *PrometheusMetrics) MessagePublished(qos QOS, bytes int, latency time.Duration, err error) {
+	prometheusClient{m, ""}.MessagePublished(qos, bytes, latency, err)
+}
+
+// MessageReceived counts the message
+func (m *PrometheusMetrics) MessageReceived(qos QOS, bytes int) {
+	prometheusClient{m, ""}.MessageReceived(qos, bytes)
+}
+
+// BytesSent adds to the bytes sent
+func (m *PrometheusMetrics) BytesSent(bytes int) {
+	prometheusClient{m, ""}.BytesSent(bytes)
+}
+
+// BytesReceived adds to the bytes received
+func (m *PrometheusMetrics) BytesReceived(bytes int) {
+	prometheusClient{m, ""}.BytesReceived(bytes)
+}
+
+// Reconnected counts the reconnect attempt by its result
+func (m *PrometheusMetrics) Reconnected(err error) {
+	prometheusClient{m, ""}.Reconnected(err)
+}
+
+// HandlerDuration records the duration of a handler by its route
+func (m *PrometheusMetrics) HandlerDuration(route string, duration time.Duration) {
+	prometheusClient{m, ""}.HandlerDuration(route, duration)
+}
+
+// QueueDepth sets the depth of the queue
+func (m *PrometheusMetrics) QueueDepth(queue string, depth int) {
+	prometheusClient{m, ""}.QueueDepth(queue, depth)
+}
+
+// prometheusClient records the measurements of one client in shared prometheus metrics, labeled with its client id
+type prometheusClient struct {
+	metrics *PrometheusMetrics
+	client  string
+}
+
+func (c prometheusClient) MessagePublished(qos QOS, bytes int, latency time.Duration, err error) {
+	key := series{client: c.client, label: strconv.Itoa(int(qos))}
+	c.metrics.lock.Lock()
+	defer c.metrics.lock.Unlock()
+	if err != nil {
+		c.metrics.failed[key]++
+		return
+	}
+	c.metrics.published[key]++
+	c.metrics.observe(c.metrics.latency, key, latency)
+}
+
+func (c prometheusClient) MessageReceived(qos QOS, bytes int) {
+	c.metrics.lock.Lock()
+	c.metrics.received[series{client: c.client, label: strconv.Itoa(int(qos))}]++
+	c.metrics.lock.Unlock()
+}
+
+func (c prometheusClient) BytesSent(bytes int) {
+	c.metrics.lock.Lock()
+	c.metrics.sent[series{client: c.client}] += float64(bytes)
+	c.metrics.lock.Unlock()
+}
+
+func (c prometheusClient) BytesReceived(bytes int) {
+	c.metrics.lock.Lock()
+	c.metrics.read[series{client: c.client}] += float64(bytes)
+	c.metrics.lock.Unlock()
+}
+
+func (c prometheusClient) Reconnected(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.metrics.lock.Lock()
+	c.metrics.reconnect[series{client: c.client, label: result}]++
+	c.metrics.lock.Unlock()
+}
+
+func (c prometheusClient) HandlerDuration(route string, duration time.Duration) {
+	c.metrics.lock.Lock()
+	c.metrics.observe(c.metrics.handlers, series{client: c.client, label: route}, duration)
+	c.metrics.lock.Unlock()
+}
+
+func (c prometheusClient) QueueDepth(queue string, depth int) {
+	c.metrics.lock.Lock()
+	c.metrics.depths[series{client: c.client, label: queue}] = float64(depth)
+	c.metrics.lock.Unlock()
+}
+
+// ServeHTTP writes the metrics in the prometheus text format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(w)
+	m.lock.Lock()
+	m.write(writer)
+	m.lock.Unlock()
+	writer.Flush()
+}
+
+func (m *PrometheusMetrics) write(w *bufio.Writer) {
+	writeFamily(w, "mqtt_messages_published_total", "counter", "Messages the broker acknowledged, or that were written for QoS 0.", "qos", m.published)
+	writeFamily(w, "mqtt_publish_failures_total", "counter", "Publishes that failed.", "qos", m.failed)
+	writeFamily(w, "mqtt_messages_received_total", "counter", "Messages received from the broker.", "qos", m.received)
+	writeFamily(w, "mqtt_sent_bytes_total", "counter", "Bytes written to the broker connections.", "", m.sent)
+	writeFamily(w, "mqtt_received_bytes_total", "counter", "Bytes read from the broker connections.", "", m.read)
+	writeFamily(w, "mqtt_reconnects_total", "counter", "Automatic reconnect attempts by result.", "result", m.reconnect)
+	writeFamily(w, "mqtt_queue_depth", "gauge", "Messages in the inflight window, the offline queue and the outbox.", "queue", m.depths)
+	m.writeHistograms(w, "mqtt_publish_latency_seconds", "Time from publishing a message until the broker acknowledged it.", "qos", m.latency)
+	m.writeHistograms(w, "mqtt_handler_duration_seconds", "Time the handlers of a route took for a message.", "route", m.handlers)
+}
+
+func writeFamily(w *bufio.Writer, name, kind, help, label string, values map[series]float64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	keys := make([]series, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sortSeries(keys)
+	for _, key := range keys {
+		if labels := key.labels(label); labels == "" {
+			fmt.Fprintf(w, "%v %v\n", name, formatValue(values[key]))
+		} else {
+			fmt.Fprintf(w, "%v{%v} %v\n", name, labels, formatValue(values[key]))
+		}
+	}
+}
+
+func (m *PrometheusMetrics) writeHistograms(w *bufio.Writer, name, help, label string, histograms map[series]*histogram) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", name, help, name)
+	keys := make([]series, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sortSeries(keys)
+	for _, key := range keys {
+		h := histograms[key]
+		labels := key.labels(label)
+		cumulative := 0.0
+		for i, bound := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%v_bucket{%v,le=\"%v\"} %v\n", name, labels, formatValue(bound), formatValue(cumulative))
+		}
+		fmt.Fprintf(w, "%v_bucket{%v,le=\"+Inf\"} %v\n", name, labels, formatValue(h.count))
+		fmt.Fprintf(w, "%v_sum{%v} %v\n", name, labels, formatValue(h.sum))
+		fmt.Fprintf(w, "%v_count{%v} %v\n", name, labels, formatValue(h.count))
+	}
+}
+
+// labels formats the labels of a series, the client label is left out for measurements without a client
+func (s series) labels(label string) string {
+	labels := []string{}
+	if s.client != "" {
+		labels = append(labels, fmt.Sprintf("client=\"%v\"", escapeLabel(s.client)))
+	}
+	if label != "" {
+		labels = append(labels, fmt.Sprintf("%v=\"%v\"", label, escapeLabel(s.label)))
+	}
+	return strings.Join(labels, ",")
+}
+
+func sortSeries(keys []series) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].client != keys[j].client {
+			return keys[i].client < keys[j].client
+		}
+		return keys[i].label < keys[j].label
+	})
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,165 @@
+package mqtt_test
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// scrape returns the metrics in the prometheus text format
+func scrape(t *testing.T, metrics *mqtt.PrometheusMetrics) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("content type should have been the prometheus text format but is %q", contentType)
+	}
+	return recorder.Body.String()
+}
+
+// expectMetrics checks that the scraped metrics contain all the lines
+func expectMetrics(t *testing.T, output string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains("\n"+output, "\n"+line+"\n") {
+			t.Fatalf("metrics should have contained %q but are:\n%v", line, output)
+		}
+	}
+}
+
+// TestPrometheusMetrics checks the counters, gauges and histograms in the text format
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := mqtt.NewPrometheusMetrics()
+	metrics.MessagePublished(mqtt.AtLeastOnce, 5, 3*time.Millisecond, nil)
+	metrics.MessagePublished(mqtt.AtLeastOnce, 5, 20*time.Millisecond, nil)
+	metrics.MessagePublished(mqtt.AtMostOnce, 5, time.Millisecond, errors.New("failed"))
+	metrics.MessageReceived(mqtt.ExactlyOnce, 5)
+	metrics.BytesSent(10)
+	metrics.BytesSent(5)
+	metrics.BytesReceived(7)
+	metrics.Reconnected(nil)
+	metrics.Reconnected(errors.New("refused"))
+	metrics.Reconnected(errors.New("refused"))
+	metrics.HandlerDuration(`sensors/"+"/temperature`, 2*time.Second)
+	metrics.QueueDepth("offline", 3)
+	metrics.QueueDepth("offline", 2)
+
+	expectMetrics(t, scrape(t, metrics),
+		"# TYPE mqtt_messages_published_total counter",
+		`mqtt_messages_published_total{qos="1"} 2`,
+		`mqtt_publish_failures_total{qos="0"} 1`,
+		`mqtt_messages_received_total{qos="2"} 1`,
+		"mqtt_sent_bytes_total 15",
+		"mqtt_received_bytes_total 7",
+		`mqtt_reconnects_total{result="failure"} 2`,
+		`mqtt_reconnects_total{result="success"} 1`,
+		"# TYPE mqtt_queue_depth gauge",
+		`mqtt_queue_depth{queue="offline"} 2`,
+		"# TYPE mqtt_publish_latency_seconds histogram",
+		`mqtt_publish_latency_seconds_bucket{qos="1",le="0.001"} 0`,
+		`mqtt_publish_latency_seconds_bucket{qos="1",le="0.005"} 1`,
+		`mqtt_publish_latency_seconds_bucket{qos="1",le="0.025"} 2`,
+		`mqtt_publish_latency_seconds_bucket{qos="1",le="+Inf"} 2`,
+		`mqtt_publish_latency_seconds_sum{qos="1"} 0.023`,
+		`mqtt_publish_latency_seconds_count{qos="1"} 2`,
+		`mqtt_handler_duration_seconds_bucket{route="sensors/\"+\"/temperature",le="1"} 0`,
+		`mqtt_handler_duration_seconds_bucket{route="sensors/\"+\"/temperature",le="2.5"} 1`,
+		`mqtt_handler_duration_seconds_count{route="sensors/\"+\"/temperature"} 1`,
+	)
+}
+
+// TestMetrics checks that a client reports its publishes, received messages, handlers, bytes and queues
+func TestMetrics(t *testing.T) {
+	metrics := mqtt.NewPrometheusMetrics()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		ClientID:     testUUID + "/TestMetrics",
+		OfflineQueue: &mqtt.OfflineQueue{},
+		Metrics:      metrics,
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.PublishString(ctx(), "TestMetrics/queued", "hello", mqtt.AtMostOnce)
+	if err != nil {
+		t.Fatalf("queueing should not have failed: %v", err)
+	}
+	label := `client="` + testUUID + `/TestMetrics"`
+	expectMetrics(t, scrape(t, metrics), `mqtt_queue_depth{`+label+`,queue="offline"} 1`)
+
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+
+	topic := testUUID + "/TestMetrics"
+	handled := make(chan struct{}, 1)
+	client.Handle(topic, func(message mqtt.Message) {
+		handled <- struct{}{}
+	})
+	err = client.Subscribe(ctx(), topic, mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler should have been called")
+	}
+
+	// the handler duration is reported after the handler returned
+	deadline := time.Now().Add(5 * time.Second)
+	output := scrape(t, metrics)
+	for !strings.Contains(output, "mqtt_handler_duration_seconds_count") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		output = scrape(t, metrics)
+	}
+	expectMetrics(t, output,
+		`mqtt_messages_published_total{`+label+`,qos="0"} 1`,
+		`mqtt_messages_published_total{`+label+`,qos="1"} 1`,
+		`mqtt_messages_received_total{`+label+`,qos="1"} 1`,
+		`mqtt_publish_latency_seconds_count{`+label+`,qos="1"} 1`,
+		`mqtt_handler_duration_seconds_count{`+label+`,route="`+topic+`"} 1`,
+		`mqtt_queue_depth{`+label+`,queue="inflight"} 0`,
+		`mqtt_queue_depth{`+label+`,queue="offline"} 0`,
+	)
+	if !strings.Contains(output, "mqtt_sent_bytes_total{"+label+"}") || strings.Contains(output, "_bytes_total{"+label+"} 0\n") {
+		t.Fatalf("metrics should have counted the bytes sent and received:\n%v", output)
+	}
+}
+
+// TestMetricsShared checks that clients sharing the metrics report their queues as separate series
+func TestMetricsShared(t *testing.T) {
+	metrics := mqtt.NewPrometheusMetrics()
+	for i, clientID := range []string{"first", "second"} {
+		client, err := mqtt.NewClient(mqtt.ClientOptions{
+			Servers:      []string{broker},
+			ClientID:     clientID,
+			OfflineQueue: &mqtt.OfflineQueue{},
+			Metrics:      metrics,
+		})
+		if err != nil {
+			t.Fatalf("creating client should not have failed: %v", err)
+		}
+		for j := 0; j <= i; j++ {
+			if err := client.PublishString(ctx(), "TestMetricsShared", "hello", mqtt.AtMostOnce); err != nil {
+				t.Fatalf("queueing should not have failed: %v", err)
+			}
+		}
+	}
+	expectMetrics(t, scrape(t, metrics),
+		`mqtt_queue_depth{client="first",queue="offline"} 1`,
+		`mqtt_queue_depth{client="second",queue="offline"} 2`,
+	)
+}
@@ -3,16 +3,30 @@ package mqtt
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
 
-	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
+	"github.com/lucacasonato/mqtt/packets"
 )
 
 // Client for talking using mqtt
 type Client struct {
-	Options ClientOptions // The options that were used to create this client
-	client  paho.Client
-	router  *router
+	Options        ClientOptions // The options that were used to create this client
+	core           *core
+	router         *router
+	inflight       *tracker
+	lifecycle      *lifecycle
+	subscriptions  *subscriptions
+	queue          *queue
+	outbox         *outbox
+	log            Logger
+	metrics        Metrics
+	tracer         Tracer
+	dedup          *dedup
+	sessionPresent int32
 }
 
 // ClientOptions is the list of options used to create a client
@@ -22,7 +36,53 @@ type ClientOptions struct {
 	Username string   // If not set then authentication will not be used
 	Password string   // Will only be used if the username is set
 
-	AutoReconnect bool // If the client should automatically try to reconnect when the connection is lost
+	CredentialsProvider CredentialsProvider // If set this is called before every connect for the username and password, instead of using the ones above
+
+	ProtocolVersion ProtocolVersion // The version of the mqtt protocol, defaults to 3.1.1 with a fallback to 3.1. Set ProtocolV5 for mqtt 5.
+
+	ServerSelection      ServerSelection // The order in which the servers are tried, defaults to SelectOrdered
+	FailedServerCooldown time.Duration   // How long a server is tried after the others once it failed or lost its connection, defaults to 30 seconds
+
+	AutoReconnect   bool            // If the client should automatically try to reconnect when the connection is lost
+	ReconnectPolicy ReconnectPolicy // Configures the delays and attempts of automatic reconnects and of retrying Connect
+
+	KeepAlive      time.Duration // The interval of keepalive pings, defaults to 30 seconds
+	PingTimeout    time.Duration // How long to wait for a ping response before the connection is considered lost, defaults to 10 seconds
+	ConnectTimeout time.Duration // How long a single connection attempt may take, defaults to 30 seconds
+	MaxPacketSize  int           // The largest packet in bytes that is accepted from the broker, larger ones close the connection. Defaults to 16 MiB, mqtt 5 brokers are told the limit.
+	MaxInflight    uint16        // How many QoS 1 and 2 publishes may wait for their acknowledgement at once, further publishes wait for a free slot. Defaults to 65535, mqtt 5 brokers can lower it with their receive maximum.
+
+	PersistentSession bool          // If set the broker keeps the subscriptions and queued messages of the ClientID while it is disconnected
+	Store             Store         // Persists in-flight QoS 1 and 2 messages, defaults to a memory store. Clients with different client ids can share a store.
+	OnStoreError      ErrorHandler  // If set this gets called when the store fails to persist or load a message
+	SessionExpiry     time.Duration // How long an mqtt 5 broker keeps a persistent session after the connection closed, defaults to forever like mqtt 3.1.1
+
+	TopicAliasMaximum uint16 // How many topic aliases an mqtt 5 broker may use for the messages it sends, publishes use the aliases the broker allows automatically
+
+	OfflineQueue *OfflineQueue // If set messages published while the client is not connected are queued and sent once it is
+	Outbox       *Outbox       // If set published messages are journaled to disk until they are acknowledged, so they survive restarts
+
+	TLS       *TLSOptions       // If set this configures the tls connection to ssl, tls, tcps, mqtts and wss servers
+	WebSocket *WebSocketOptions // If set this configures the upgrade request to ws and wss servers
+	Proxy     string            // An http, https or socks5 proxy url that all servers but unix sockets are dialed through, defaults to the ALL_PROXY or all_proxy environment variable unless NO_PROXY or no_proxy exclude the server
+	Transport Transport         // If set this opens the connections to the servers instead of the built-in schemes
+
+	Will *Will // If set the broker publishes this message when the connection is lost unexpectedly
+
+	OnEvent            EventHandler // If set this gets called in order with every connection event, it should not block
+	OnResubscribeError ErrorHandler // If set this gets called when subscriptions could not be restored after reconnecting
+
+	Logger  Logger  // If set this receives log messages about connections, subscriptions, dropped messages and handler panics, see StdLogger and SlogLogger
+	Metrics Metrics // If set this receives measurements of the messages, connections, handlers and queues, see NewPrometheusMetrics
+	Tracer  Tracer  // If set publishes and handlers are traced. The trace context is sent as user properties with mqtt 5 or the Envelope option, otherwise every handler starts a new trace.
+
+	// Envelope changes the payload format of mqtt 3.1 and 3.1.1: messages with publish options like WithContentType
+	// are wrapped in a json envelope that only this library unwraps, see the README. Only set it if every receiver
+	// uses this option too. Without it, publishing with these options fails with ErrPropertiesUnsupported. Mqtt 5
+	// sends the options as properties and ignores this.
+	Envelope bool
+
+	OnDelivery func(delivery *Delivery) // If set this is called in a new goroutine once a message published with PublishAsync completed
 }
 
 // QOS describes the quality of service of an mqtt publish
@@ -37,88 +97,364 @@ const (
 	ExactlyOnce
 )
 
+// ProtocolVersion is the version of the mqtt protocol spoken with the broker
+type ProtocolVersion byte
+
+const (
+	// ProtocolDefault uses 3.1.1 and falls back to 3.1 if the broker refuses it
+	ProtocolDefault ProtocolVersion = 0
+	// ProtocolV31 is mqtt 3.1
+	ProtocolV31 ProtocolVersion = 3
+	// ProtocolV311 is mqtt 3.1.1
+	ProtocolV311 ProtocolVersion = 4
+	// ProtocolV5 is mqtt 5, which sends the publish options as properties and reports failures as reason codes
+	ProtocolV5 ProtocolVersion = 5
+)
+
 var (
 	// ErrMinimumOneServer means that at least one server should be specified in the client options
 	ErrMinimumOneServer = errors.New("mqtt: at least one server needs to be specified")
+	// ErrDisconnected means that the client is disconnecting or has been disconnected and does not accept new operations
+	ErrDisconnected = errors.New("mqtt: the client is disconnected")
+	// ErrUnsupportedProtocolVersion means that the protocol version in the client options is not supported
+	ErrUnsupportedProtocolVersion = errors.New("mqtt: the protocol version is not supported")
+	// ErrPropertiesUnsupported means that a message was published with properties like a content type, which need
+	// mqtt 5 or the Envelope option
+	ErrPropertiesUnsupported = errors.New("mqtt: publish properties need mqtt 5 or the Envelope option")
 )
 
-func handle(callback MessageHandler) paho.MessageHandler {
-	return func(client paho.Client, message paho.Message) {
-		if callback != nil {
-			callback(Message{message: message})
-		}
-	}
-}
-
 // NewClient creates a new client with the specified options
 func NewClient(options ClientOptions) (*Client, error) {
-	pahoOptions := paho.NewClientOptions()
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	coreOptions := coreOptions{
+		keepAlive:      30 * time.Second,
+		pingTimeout:    10 * time.Second,
+		connectTimeout: 30 * time.Second,
+		maxInflight:    65535,
+	}
 
-	// brokers
-	if options.Servers != nil && len(options.Servers) > 0 {
-		for _, server := range options.Servers {
-			pahoOptions.AddBroker(server)
-		}
-	} else {
-		return nil, ErrMinimumOneServer
+	// brokers, Validate made sure that there is at least one and that all of them parse
+	servers := []*url.URL{}
+	for _, server := range options.Servers {
+		uri, _ := parseServer(server)
+		servers = append(servers, uri)
 	}
+	cooldown := options.FailedServerCooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	coreOptions.servers = newSelector(servers, options.ServerSelection, cooldown)
 
 	// client id
 	if options.ClientID == "" {
 		options.ClientID = uuid.New().String()
 	}
-	pahoOptions.SetClientID(options.ClientID)
+	coreOptions.clientID = options.ClientID
 
 	// auth
-	if options.Username != "" {
-		pahoOptions.SetUsername(options.Username)
-		pahoOptions.SetPassword(options.Password)
+	coreOptions.credentials = options.CredentialsProvider
+	if coreOptions.credentials == nil && options.Username != "" {
+		username, password := options.Username, options.Password
+		coreOptions.credentials = func(ctx context.Context) (string, string, error) {
+			return username, password, nil
+		}
+	}
+
+	coreOptions.protocol = options.ProtocolVersion
+
+	// transport
+	transport := schemeTransport{websocket: options.WebSocket}
+	if options.Proxy != "" {
+		proxy, err := parseProxy(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.proxy = proxy
+	}
+	if options.TLS != nil {
+		config, err := options.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		transport.tls = config
+	}
+	coreOptions.transport = options.Transport
+	if coreOptions.transport == nil {
+		coreOptions.transport = transport
+	}
+
+	// timeouts
+	if options.KeepAlive > 0 {
+		coreOptions.keepAlive = options.KeepAlive
+	}
+	if options.PingTimeout > 0 {
+		coreOptions.pingTimeout = options.PingTimeout
+	}
+	if options.ConnectTimeout > 0 {
+		coreOptions.connectTimeout = options.ConnectTimeout
+	}
+	coreOptions.maxPacketSize = options.MaxPacketSize
+	if options.MaxInflight > 0 {
+		coreOptions.maxInflight = options.MaxInflight
 	}
 
-	// auto reconnect
-	pahoOptions.SetAutoReconnect(options.AutoReconnect)
+	// session
+	coreOptions.cleanSession = !options.PersistentSession
+	coreOptions.sessionExpiry = options.SessionExpiry
+	coreOptions.aliasMaximum = options.TopicAliasMaximum
+	store := options.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	coreOptions.store = newClientStore(store, options.ClientID)
+	coreOptions.onStoreError = options.OnStoreError
+
+	// will
+	if options.Will != nil {
+		coreOptions.will = &packets.Will{Topic: options.Will.Topic, Payload: options.Will.Payload, QOS: byte(options.Will.QOS), Retain: options.Will.Retained}
+	}
 
-	pahoClient := paho.NewClient(pahoOptions)
-	router := newRouter()
-	pahoClient.AddRoute("#", handle(func(message Message) {
-		routes := router.match(&message)
+	// logging
+	logger := options.Logger
+	if logger == nil {
+		logger = noLogger{}
+	}
+	coreOptions.logger = logger
+
+	// metrics
+	metrics := options.Metrics
+	if metrics == nil {
+		metrics = noMetrics{}
+	}
+	if prometheus, ok := metrics.(*PrometheusMetrics); ok {
+		// clients that share the prometheus metrics are told apart by their client id
+		metrics = prometheusClient{metrics: prometheus, client: options.ClientID}
+	}
+	coreOptions.metrics = metrics
+
+	client := &Client{Options: options, router: newRouter(), inflight: newTracker(), lifecycle: newLifecycle(options.OnEvent), subscriptions: newSubscriptions(), log: logger, metrics: metrics, tracer: options.Tracer, dedup: newDedup()}
+
+	// outbox
+	if options.Outbox != nil {
+		outbox, err := openOutbox(*options.Outbox, func(entries int) {
+			metrics.QueueDepth("outbox", entries)
+		})
+		if err != nil {
+			return nil, err
+		}
+		client.outbox = outbox
+	}
+
+	// offline queue
+	if options.OfflineQueue != nil {
+		dropped := func(message queuedMessage) {
+			client.discard(message, "the offline queue is full")
+		}
+		client.queue = newQueue(*options.OfflineQueue, dropped, func(messages int) {
+			metrics.QueueDepth("offline", messages)
+		})
+	}
+
+	// connection lifecycle, reconnecting is done by the client itself so every attempt can be reported
+	coreOptions.onConnect = client.onConnect
+	coreOptions.onConnectionLost = client.onConnectionLost
+	coreOptions.onMessage = func(message Message) {
+		client.inflight.track()
+		defer client.inflight.release()
+		metrics.MessageReceived(message.qos, len(message.payload))
+		// mqtt 5 sends the properties along with the message, 3.1.1 puts them in an envelope if it is enabled
+		if options.Envelope && options.ProtocolVersion != ProtocolV5 {
+			if properties, payload, ok := unwrap(message.payload); ok {
+				message.properties = properties
+				message.payload = payload
+			}
+		}
+		if message.dedupKey != "" && client.dedup.seen(message.dedupKey) {
+			logger.Debug("ignored duplicate message", "topic", message.topic, "dedup_key", message.dedupKey)
+			return
+		}
+		var span Span
+		if client.tracer != nil {
+			span = client.startProcess(&message)
+			defer span.End()
+		}
+		routes := client.router.match(&message)
+		if len(routes) == 0 {
+			logger.Debug("no handler for message", "topic", message.topic)
+		}
 		for _, route := range routes {
 			m := message
 			m.vars = route.vars(&message)
-			route.handler(m)
+			if err := client.handle(route, m); err != nil && span != nil {
+				span.RecordError(err)
+			}
 		}
-	}))
+	}
 
-	return &Client{client: pahoClient, Options: options, router: router}, nil
+	client.core = newCore(coreOptions)
+	return client, nil
 }
 
-// Connect tries to establish a connection with the mqtt servers
+// Connect tries to establish a connection with the mqtt servers. If the reconnect policy retries the initial
+// connect, failed attempts are retried until the context expires or the attempts run out.
 func (c *Client) Connect(ctx context.Context) error {
-	// try to connect to the client
-	token := c.client.Connect()
-	return tokenWithContext(ctx, token)
+	c.lifecycle.compareAndSet(StateConnecting, StateDisconnected)
+	c.inflight.open()
+
+	policy := c.Options.ReconnectPolicy
+	for attempt := 1; ; attempt++ {
+		err := c.connect(ctx)
+		if err == nil || ctx.Err() != nil || err == ErrDisconnected {
+			return err
+		}
+		if !policy.RetryInitialConnect || policy.exhausted(attempt) {
+			c.lifecycle.compareAndSet(StateDisconnected, StateConnecting)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			c.lifecycle.compareAndSet(StateDisconnected, StateConnecting)
+			return ctx.Err()
+		case <-time.After(policy.delay(attempt)):
+		}
+		if c.State() != StateConnecting {
+			return ErrDisconnected
+		}
+	}
+}
+
+func (c *Client) connect(ctx context.Context) error {
+	token := c.core.connect()
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-token.Done():
+		err = token.Error()
+	}
+	if err == nil {
+		c.recordSession(token)
+		err = c.awaitConnected(ctx)
+	}
+	if err != nil && ctx.Err() != nil {
+		// the connection attempt continues in the background
+		go func() {
+			token.Wait()
+			if token.Error() != nil {
+				c.lifecycle.compareAndSet(StateDisconnected, StateConnecting)
+			}
+		}()
+	}
+	return err
+}
+
+// ConnectedServer returns the server of the current connection as it is written in the client options, or an
+// empty string if the client is not connected
+func (c *Client) ConnectedServer() string {
+	server := c.core.server()
+	if server < 0 {
+		return ""
+	}
+	return c.Options.Servers[server]
+}
+
+// SessionPresent is true if the broker still had a session for this client when it last connected. This can only
+// be the case for persistent sessions.
+func (c *Client) SessionPresent() bool {
+	return atomic.LoadInt32(&c.sessionPresent) == 1
+}
+
+func (c *Client) recordSession(token *token) {
+	var present int32
+	if token.sessionPresent {
+		present = 1
+	}
+	atomic.StoreInt32(&c.sessionPresent, present)
+}
+
+// Disconnect gracefully closes the connection with the mqtt servers. New publishes and subscriptions are
+// rejected with ErrDisconnected while the outstanding ones and the running handlers are given until the
+// context expires to finish. The connection is closed in both cases, but the context error is returned if
+// the work could not be drained in time.
+func (c *Client) Disconnect(ctx context.Context) error {
+	previous := c.lifecycle.set(StateDisconnected)
+	c.inflight.close()
+	err := c.inflight.wait(ctx)
+	c.disconnect(previous)
+	return err
 }
 
 // DisconnectImmediately will immediately close the connection with the mqtt servers
 func (c *Client) DisconnectImmediately() {
-	c.client.Disconnect(0)
+	previous := c.lifecycle.set(StateDisconnected)
+	c.inflight.close()
+	c.disconnect(previous)
 }
 
-func tokenWithContext(ctx context.Context, token paho.Token) error {
-	completer := make(chan error)
+func (c *Client) disconnect(previous State) {
+	if previous != StateDisconnected {
+		c.log.Info("disconnecting")
+	}
+	if c.queue != nil {
+		c.queue.offline()
+	}
+	c.core.disconnect()
+	c.subscriptions.clear()
+	if previous != StateDisconnected {
+		c.lifecycle.emit(Event{Type: EventDisconnected})
+	}
+}
 
-	// TODO: This go routine will not be removed up if the ctx is cancelled or a the ctx timeout passes
-	go func() {
-		token.Wait()
-		completer <- token.Error()
-	}()
+// begin acquires a new operation and holds it back while the client is reconnecting
+func (c *Client) begin(ctx context.Context) error {
+	if !c.inflight.acquire() {
+		return ErrDisconnected
+	}
+	if err := c.awaitReconnect(ctx); err != nil {
+		c.inflight.release()
+		return &CanceledError{Err: err}
+	}
+	return nil
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case err := <-completer:
-			return err
-		}
+// releaseWhenDone releases an acquired operation once its token completed
+func (c *Client) releaseWhenDone(token *token) {
+	token.then(c.inflight.release)
+}
+
+// CanceledError means that the context of an operation was done before the operation completed
+type CanceledError struct {
+	Err      error // The error of the context
+	InFlight bool  // If the operation was already sent, so the broker might still process it. Publishes of persistent sessions and the outbox are still delivered.
+}
+
+func (e *CanceledError) Error() string {
+	if e.InFlight {
+		return fmt.Sprintf("mqtt: operation canceled after it was sent: %v", e.Err)
+	}
+	return fmt.Sprintf("mqtt: operation canceled before it was sent: %v", e.Err)
+}
+
+// Unwrap returns the error of the context
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// tokenWithContext waits for an operation that was sent to the broker. If the context is done first the operation
+// stays in flight, nothing waits for it in the background.
+func tokenWithContext(ctx context.Context, token *token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return &CanceledError{Err: ctx.Err(), InFlight: true}
+	case <-token.Done():
+		return token.Error()
 	}
 }
@@ -3,10 +3,15 @@ package mqtt_test
 import (
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+	"github.com/lucacasonato/mqtt/packets"
 )
 
 // TestNewClientNilServer checks if creating a client with a nil server array works
@@ -102,6 +107,93 @@ func TestNewClientWithAuthentication(t *testing.T) {
 	}
 }
 
+// TestNewClientUnsupportedProtocolVersion checks that creating a client with an unknown protocol version fails
+func TestNewClientUnsupportedProtocolVersion(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		ProtocolVersion: 6,
+	})
+	if !errors.Is(err, mqtt.ErrUnsupportedProtocolVersion) {
+		t.Fatalf("err should be ErrUnsupportedProtocolVersion but is %v", err)
+	}
+	if client != nil {
+		t.Fatal("client should be nil")
+	}
+}
+
+// TestConnectProtocolVersion checks that the connect packet uses the protocol version of the options
+func TestConnectProtocolVersion(t *testing.T) {
+	fake := newFakeBroker(t)
+	defer fake.close()
+	for version, name := range map[mqtt.ProtocolVersion]string{mqtt.ProtocolV31: "MQIsdp", mqtt.ProtocolV311: "MQTT", mqtt.ProtocolV5: "MQTT"} {
+		client, err := mqtt.NewClient(mqtt.ClientOptions{
+			Servers: []string{
+				fake.server,
+			},
+			ProtocolVersion: version,
+		})
+		if err != nil {
+			t.Fatalf("creating client failed: %v", err)
+		}
+		err = client.Connect(ctx())
+		if err != nil {
+			t.Fatalf("connect should not have failed: %v", err)
+		}
+		client.DisconnectImmediately()
+
+		connect := fake.expect(t, 1)
+		nameLength := int(connect.body[0])<<8 | int(connect.body[1])
+		if string(connect.body[2:2+nameLength]) != name || connect.body[2+nameLength] != byte(version) {
+			t.Fatalf("connect should have used %v level %v but used %v level %v", name, version, string(connect.body[2:2+nameLength]), connect.body[2+nameLength])
+		}
+	}
+}
+
+// TestConnectRefused checks that every connack return code has its own error that wraps ErrConnectionRefused
+func TestConnectRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer listener.Close()
+	codes := make(chan byte, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			packets.Read(conn)
+			packets.Write(conn, &packets.Connack{ReturnCode: <-codes})
+			conn.Close()
+		}
+	}()
+
+	for code, expected := range map[byte]error{
+		packets.IdentifierRejected:    mqtt.ErrIdentifierRejected,
+		packets.ServerUnavailable:     mqtt.ErrServerUnavailable,
+		packets.BadUsernameOrPassword: mqtt.ErrBadCredentials,
+		packets.NotAuthorized:         mqtt.ErrNotAuthorized,
+	} {
+		client, err := mqtt.NewClient(mqtt.ClientOptions{
+			Servers: []string{
+				"tcp://" + listener.Addr().String(),
+			},
+			ProtocolVersion: mqtt.ProtocolV311,
+		})
+		if err != nil {
+			t.Fatalf("creating client failed: %v", err)
+		}
+		codes <- code
+		err = client.Connect(ctx())
+		if !errors.Is(err, expected) || !errors.Is(err, mqtt.ErrConnectionRefused) {
+			t.Fatalf("connect should have failed with %v but failed with %v", expected, err)
+		}
+	}
+}
+
 // TestConnectSuccess just checks that connecting to a broker works
 func TestConnectSuccess(t *testing.T) {
 	client, err := mqtt.NewClient(mqtt.ClientOptions{
@@ -205,3 +297,218 @@ func TestDisconnectImmediately(t *testing.T) {
 	}
 	client.DisconnectImmediately()
 }
+
+// TestDisconnect gracefully disconnects from the mqtt broker
+func TestDisconnect(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	err = client.Publish(ctx(), testUUID+"/TestDisconnect", []byte("hello"), mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	err = client.Disconnect(ctx())
+	if err != nil {
+		t.Fatalf("disconnect should not have failed: %v", err)
+	}
+	err = client.Publish(ctx(), testUUID+"/TestDisconnect", []byte("hello"), mqtt.AtLeastOnce)
+	if !errors.Is(err, mqtt.ErrDisconnected) {
+		t.Fatalf("publish after disconnect should have failed with ErrDisconnected: %v", err)
+	}
+}
+
+// TestDisconnectWaitsForHandlers checks that disconnect waits for running handlers to finish
+func TestDisconnectWaitsForHandlers(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	client.Handle(testUUID+"/TestDisconnectWaitsForHandlers", func(message mqtt.Message) {
+		close(started)
+		<-time.After(100 * time.Millisecond)
+		close(finished)
+	})
+	err = client.Subscribe(ctx(), testUUID+"/TestDisconnectWaitsForHandlers", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.PublishString(ctx(), testUUID+"/TestDisconnectWaitsForHandlers", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	<-started
+	err = client.Disconnect(ctx())
+	if err != nil {
+		t.Fatalf("disconnect should not have failed: %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("disconnect should have waited for the handler to finish")
+	}
+}
+
+// TestConnectAfterDisconnect checks that a client can connect again after it was disconnected and still receives
+// messages
+func TestConnectAfterDisconnect(t *testing.T) {
+	fake := newFakeBroker(t)
+	defer fake.close()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	messages, _ := client.Listen("TestConnectAfterDisconnect")
+	for i := 0; i < 2; i++ {
+		err = client.Connect(ctx())
+		if err != nil {
+			t.Fatalf("connect should not have failed: %v", err)
+		}
+		conn := <-fake.conns
+		packets.Write(conn, &packets.Publish{Topic: "TestConnectAfterDisconnect", Payload: []byte("hello")})
+		select {
+		case <-messages:
+		case <-time.After(time.Second):
+			t.Fatal("the message should have been received")
+		}
+		err = client.Disconnect(ctx())
+		if err != nil {
+			t.Fatalf("disconnect should not have failed: %v", err)
+		}
+		fake.expect(t, byte(packets.TypeDisconnect))
+	}
+}
+
+// TestKeepAlive checks that the client pings the broker when it did not send anything for the keepalive interval
+func TestKeepAlive(t *testing.T) {
+	fake := newFakeBroker(t)
+	defer fake.close()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		KeepAlive: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	fake.expect(t, byte(packets.TypePingreq))
+	fake.expect(t, byte(packets.TypePingreq))
+	if client.State() != mqtt.StateConnected {
+		t.Fatalf("the client should still be connected but is %v", client.State())
+	}
+}
+
+// TestPingTimeout checks that the connection is lost if the broker does not answer pings
+func TestPingTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		packets.Read(conn)
+		packets.Write(conn, &packets.Connack{})
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			"tcp://" + listener.Addr().String(),
+		},
+		KeepAlive:   50 * time.Millisecond,
+		PingTimeout: 50 * time.Millisecond,
+		OnEvent:     events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	events.Expect(t, mqtt.EventConnected)
+	event := events.Expect(t, mqtt.EventConnectionLost)
+	if !errors.Is(event.Err, mqtt.ErrPingTimeout) {
+		t.Fatalf("the connection should have been lost with ErrPingTimeout: %v", event.Err)
+	}
+}
+
+// TestMaxPacketSize checks that the connection is lost when the broker sends a packet larger than the maximum
+func TestMaxPacketSize(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		packets.Read(conn)
+		packets.Write(conn, &packets.Connack{})
+		// the large publish is sent once the client is connected and pings
+		packets.Read(conn)
+		packets.Write(conn, &packets.Publish{Topic: "TestMaxPacketSize", Payload: make([]byte, 2000)})
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			"tcp://" + listener.Addr().String(),
+		},
+		MaxPacketSize: 1024,
+		KeepAlive:     50 * time.Millisecond,
+		OnEvent:       events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	events.Expect(t, mqtt.EventConnected)
+	event := events.Expect(t, mqtt.EventConnectionLost)
+	if !errors.Is(event.Err, packets.ErrTooLarge) {
+		t.Fatalf("the connection should have been lost with ErrTooLarge: %v", event.Err)
+	}
+}
@@ -0,0 +1,683 @@
+// Package mqtttest provides an in-process mqtt 3.1.1 and 5 broker, a faulty transport and an event recorder for
+// tests
+package mqtttest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// connectTimeout is how long a new connection may take to send its connect packet
+const connectTimeout = 10 * time.Second
+
+// TopicAliasMaximum is the highest topic alias that mqtt 5 clients may use in their publishes
+const TopicAliasMaximum = 10
+
+// Broker is an mqtt 3.1.1 and 5 broker listening on a random localhost port. It supports QoS 0, 1 and 2, retained
+// messages, wildcards, wills, persistent sessions and $share groups. Mqtt 5 clients also get the properties of
+// the messages, topic aliases, subscription options, session expiry and reason codes. Everything is kept in
+// memory.
+type Broker struct {
+	URL string // The url clients connect to, for example tcp://127.0.0.1:41235
+
+	listener net.Listener
+	lock     sync.Mutex
+	sessions map[string]*session
+	retained map[string]*packets.Publish
+	shared   map[string]int // The next member that gets a message of a $share group
+	clients  map[*client]bool
+	closed   bool
+	running  sync.WaitGroup
+
+	authenticate   func(clientID, username string, password []byte) bool
+	authorize      func(clientID, filter string) bool
+	receiveMaximum uint16 // How many QoS 2 publishes an mqtt 5 client may have unreleased, 0 is no limit
+}
+
+// NewBroker starts a broker on a random localhost port. It panics if it can not listen, like httptest.NewServer.
+func NewBroker() *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to listen: %v", err))
+	}
+	b := &Broker{
+		URL:      "tcp://" + listener.Addr().String(),
+		listener: listener,
+		sessions: map[string]*session{},
+		retained: map[string]*packets.Publish{},
+		shared:   map[string]int{},
+		clients:  map[*client]bool{},
+	}
+	b.running.Add(1)
+	go b.accept()
+	return b
+}
+
+// Close stops the broker and closes all connections. Wills are not published.
+func (b *Broker) Close() {
+	b.lock.Lock()
+	b.closed = true
+	for client := range b.clients {
+		client.will = nil
+		client.conn.Close()
+	}
+	b.lock.Unlock()
+	b.listener.Close()
+	b.running.Wait()
+}
+
+// SetAuthenticator makes the broker refuse connections with a bad username or password error unless authenticate
+// returns true. By default every connection is accepted.
+func (b *Broker) SetAuthenticator(authenticate func(clientID, username string, password []byte) bool) {
+	b.lock.Lock()
+	b.authenticate = authenticate
+	b.lock.Unlock()
+}
+
+// SetAuthorizer makes the broker reject subscriptions with a failure return code unless authorize returns true.
+// By default every valid topic filter is accepted. authorize must not call the broker.
+func (b *Broker) SetAuthorizer(authorize func(clientID, filter string) bool) {
+	b.lock.Lock()
+	b.authorize = authorize
+	b.lock.Unlock()
+}
+
+// SetReceiveMaximum tells mqtt 5 clients how many QoS 1 and 2 publishes they may send before they are
+// acknowledged, and disconnects the clients that send more. QoS 1 publishes are acknowledged right away, so only
+// QoS 2 publishes that were not released yet count. By default there is no limit.
+func (b *Broker) SetReceiveMaximum(maximum uint16) {
+	b.lock.Lock()
+	b.receiveMaximum = maximum
+	b.lock.Unlock()
+}
+
+func (b *Broker) accept() {
+	defer b.running.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn speaks mqtt on a connection that was opened elsewhere, like the broker side of an in-memory pipe. It
+// blocks until the connection is closed.
+func (b *Broker) ServeConn(conn net.Conn) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		conn.Close()
+		return
+	}
+	b.running.Add(1)
+	b.lock.Unlock()
+	defer b.running.Done()
+	b.serve(conn)
+}
+
+// session is the state of a client id that outlives connections if it is persistent
+type session struct {
+	clientID      string
+	clean         bool                            // If the session ends with the connection
+	expiry        time.Duration                   // How long an mqtt 5 session is kept after the connection, 0 keeps it forever
+	expires       time.Time                       // When the session of a disconnected mqtt 5 client expires, zero if it does not
+	client        *client                         // Nil while the client is not connected
+	subscriptions map[string]packets.Subscription // The subscriptions with their granted QoS by topic filter
+	inflight      []*packets.Publish              // Outgoing QoS 1 and 2 messages in order, they are resent after reconnecting
+	released      map[uint16]bool                 // Outgoing QoS 2 messages that were received but not completed
+	received      map[uint16]bool                 // Incoming QoS 2 messages that were not released yet
+	nextID        uint16
+}
+
+func newSession(clientID string, clean bool) *session {
+	return &session{
+		clientID:      clientID,
+		clean:         clean,
+		subscriptions: map[string]packets.Subscription{},
+		released:      map[uint16]bool{},
+		received:      map[uint16]bool{},
+	}
+}
+
+// allocate returns a packet id that is not in flight
+func (s *session) allocate() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if s.find(s.nextID) < 0 {
+			return s.nextID
+		}
+	}
+}
+
+func (s *session) find(id uint16) int {
+	for i, publish := range s.inflight {
+		if publish.PacketID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *session) acknowledge(id uint16) {
+	if i := s.find(id); i >= 0 {
+		s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+	}
+	delete(s.released, id)
+}
+
+// client is a connection of a session
+type client struct {
+	conn      net.Conn
+	codec     packets.Codec
+	session   *session
+	will      *packets.Will
+	aliases   map[uint16]string // The topic aliases of the publishes of an mqtt 5 client
+	writeLock sync.Mutex
+}
+
+func (c *client) write(packet packets.Packet) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.codec.Write(c.conn, packet); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *client) v5() bool {
+	return c.codec.Level == packets.ProtocolLevelV5
+}
+
+// delivery is a packet that has to be written to a client after the broker lock is released
+type delivery struct {
+	client *client
+	packet packets.Packet
+	close  bool // If the connection is closed after the packet was written
+}
+
+func deliver(deliveries []delivery) {
+	for _, d := range deliveries {
+		d.client.write(d.packet)
+		if d.close {
+			d.client.conn.Close()
+		}
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	packet, err := packets.Read(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.Connect)
+	if !ok {
+		return
+	}
+	client, keepAlive, deliveries := b.connect(conn, connect)
+	if client == nil {
+		return
+	}
+	defer b.disconnect(client)
+	deliver(deliveries)
+
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := client.codec.Read(conn)
+		if err != nil {
+			return
+		}
+		if _, ok := packet.(*packets.Disconnect); ok {
+			b.lock.Lock()
+			client.will = nil
+			b.lock.Unlock()
+			return
+		}
+		if !b.handle(client, packet) {
+			return
+		}
+	}
+}
+
+// connect starts or resumes the session of a client and returns nil if the connection is refused
+func (b *Broker) connect(conn net.Conn, connect *packets.Connect) (*client, time.Duration, []delivery) {
+	codec := packets.Codec{Level: connect.ProtocolLevel}
+	refuse := func(code, reasonCode byte) (*client, time.Duration, []delivery) {
+		if codec.Level == packets.ProtocolLevelV5 {
+			code = reasonCode
+		}
+		codec.Write(conn, &packets.Connack{ReturnCode: code})
+		return nil, 0, nil
+	}
+	if !(connect.ProtocolName == packets.ProtocolNameV5 && connect.ProtocolLevel == packets.ProtocolLevelV5) &&
+		!(connect.ProtocolName == packets.ProtocolNameV311 && connect.ProtocolLevel == packets.ProtocolLevelV311) &&
+		!(connect.ProtocolName == packets.ProtocolNameV31 && connect.ProtocolLevel == packets.ProtocolLevelV31) {
+		return refuse(packets.UnacceptableProtocolVersion, 0)
+	}
+	connack := &packets.Connack{}
+	if connect.ClientID == "" {
+		if !connect.CleanSession {
+			return refuse(packets.IdentifierRejected, reasonClientIdentifierNotValid)
+		}
+		connect.ClientID = uuid.New().String()
+		connack.Properties.AssignedClientID = connect.ClientID
+	}
+
+	b.lock.Lock()
+	authenticate := b.authenticate
+	b.lock.Unlock()
+	if authenticate != nil {
+		username := ""
+		if connect.Username != nil {
+			username = *connect.Username
+		}
+		if !authenticate(connect.ClientID, username, connect.Password) {
+			return refuse(packets.BadUsernameOrPassword, reasonBadUserNameOrPassword)
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, 0, nil
+	}
+
+	var deliveries []delivery
+	session, present := b.sessions[connect.ClientID]
+	if present && session.client != nil {
+		// a new connection with the same client id takes over the session, mqtt 5 clients are told why
+		old := session.client
+		if old.v5() {
+			deliveries = append(deliveries, delivery{old, &packets.Disconnect{ReasonCode: reasonSessionTakenOver}, true})
+		} else {
+			old.conn.Close()
+		}
+		old.session = nil
+		deliveries = append(deliveries, b.publishWill(old)...)
+		session.client = nil
+	}
+	if present && !session.expires.IsZero() && time.Now().After(session.expires) {
+		present = false
+	}
+	if !present || connect.CleanSession {
+		session = newSession(connect.ClientID, connect.CleanSession)
+		b.sessions[connect.ClientID] = session
+		present = false
+	}
+	session.clean = connect.CleanSession
+	session.expires = time.Time{}
+	if codec.Level == packets.ProtocolLevelV5 {
+		// mqtt 5 sessions end with the connection unless they have an expiry
+		session.clean = connect.Properties.SessionExpiry == nil || *connect.Properties.SessionExpiry == 0
+		session.expiry = 0
+		if !session.clean && *connect.Properties.SessionExpiry != 0xFFFFFFFF {
+			session.expiry = time.Duration(*connect.Properties.SessionExpiry) * time.Second
+		}
+		maximum := uint16(TopicAliasMaximum)
+		connack.Properties.TopicAliasMaximum = &maximum
+		if b.receiveMaximum > 0 {
+			receiveMaximum := b.receiveMaximum
+			connack.Properties.ReceiveMaximum = &receiveMaximum
+		}
+	}
+
+	client := &client{conn: conn, codec: codec, session: session, will: connect.Will, aliases: map[uint16]string{}}
+	session.client = client
+	b.clients[client] = true
+	connack.SessionPresent = present
+	deliveries = append([]delivery{{client: client, packet: connack}}, deliveries...)
+	for _, publish := range session.inflight {
+		if session.released[publish.PacketID] {
+			deliveries = append(deliveries, delivery{client: client, packet: &packets.Pubrel{PacketID: publish.PacketID}})
+		} else {
+			resent := *publish
+			resent.Dup = true
+			deliveries = append(deliveries, delivery{client: client, packet: &resent})
+		}
+	}
+	return client, time.Duration(connect.KeepAlive) * time.Second, deliveries
+}
+
+// disconnect ends a connection and publishes the will if the client did not disconnect gracefully
+func (b *Broker) disconnect(client *client) {
+	b.lock.Lock()
+	delete(b.clients, client)
+	deliveries := b.publishWill(client)
+	if session := client.session; session != nil && session.client == client {
+		session.client = nil
+		if session.clean {
+			delete(b.sessions, session.clientID)
+		} else if session.expiry > 0 {
+			session.expires = time.Now().Add(session.expiry)
+		}
+	}
+	b.lock.Unlock()
+	deliver(deliveries)
+}
+
+// publishWill routes the will of a client, the lock must be held
+func (b *Broker) publishWill(client *client) []delivery {
+	will := client.will
+	client.will = nil
+	if will == nil || b.closed {
+		return nil
+	}
+	return b.route(nil, &packets.Publish{Topic: will.Topic, Payload: will.Payload, QOS: will.QOS, Retain: will.Retain, Properties: will.Properties})
+}
+
+// handle processes a packet of a connected client and returns false if the connection should be closed
+func (b *Broker) handle(client *client, packet packets.Packet) bool {
+	b.lock.Lock()
+	session := client.session
+	if session == nil {
+		// the session was taken over by another connection
+		b.lock.Unlock()
+		return false
+	}
+
+	var deliveries []delivery
+	ok := true
+	switch packet := packet.(type) {
+	case *packets.Publish:
+		deliveries = b.receive(client, packet)
+	case *packets.Puback:
+		session.acknowledge(packet.PacketID)
+	case *packets.Pubrec:
+		session.released[packet.PacketID] = true
+		deliveries = []delivery{{client: client, packet: &packets.Pubrel{PacketID: packet.PacketID}}}
+	case *packets.Pubrel:
+		delete(session.received, packet.PacketID)
+		deliveries = []delivery{{client: client, packet: &packets.Pubcomp{PacketID: packet.PacketID}}}
+	case *packets.Pubcomp:
+		session.acknowledge(packet.PacketID)
+	case *packets.Subscribe:
+		deliveries, ok = b.subscribe(client, packet)
+	case *packets.Unsubscribe:
+		unsuback := &packets.Unsuback{PacketID: packet.PacketID}
+		for _, topic := range packet.Topics {
+			code := byte(0)
+			if _, ok := session.subscriptions[topic]; !ok {
+				code = reasonNoSubscriptionExisted
+			}
+			unsuback.ReasonCodes = append(unsuback.ReasonCodes, code)
+			delete(session.subscriptions, topic)
+		}
+		deliveries = []delivery{{client: client, packet: unsuback}}
+	case *packets.Pingreq:
+		deliveries = []delivery{{client: client, packet: &packets.Pingresp{}}}
+	default:
+		ok = false
+	}
+	b.lock.Unlock()
+	deliver(deliveries)
+	return ok
+}
+
+// receive routes a publish of a client and acknowledges it. QoS 2 messages are routed the first time they arrive.
+// Mqtt 5 clients that use an unknown topic alias or exceed the receive maximum are disconnected.
+func (b *Broker) receive(client *client, publish *packets.Publish) []delivery {
+	if alias := publish.Properties.TopicAlias; alias != nil && client.v5() {
+		if *alias == 0 || *alias > TopicAliasMaximum || (publish.Topic == "" && client.aliases[*alias] == "") {
+			return []delivery{{client: client, packet: &packets.Disconnect{ReasonCode: reasonTopicAliasInvalid}, close: true}}
+		}
+		if publish.Topic == "" {
+			publish.Topic = client.aliases[*alias]
+		} else {
+			client.aliases[*alias] = publish.Topic
+		}
+	}
+	if strings.ContainsAny(publish.Topic, "+#") || publish.Topic == "" {
+		client.conn.Close()
+		return nil
+	}
+	session := client.session
+	switch publish.QOS {
+	case 0:
+		return b.route(session, publish)
+	case 1:
+		return append(b.route(session, publish), delivery{client: client, packet: &packets.Puback{PacketID: publish.PacketID}})
+	}
+	if b.receiveMaximum > 0 && client.v5() && !session.received[publish.PacketID] && len(session.received) >= int(b.receiveMaximum) {
+		return []delivery{{client: client, packet: &packets.Disconnect{ReasonCode: reasonReceiveMaximumExceeded}, close: true}}
+	}
+	var deliveries []delivery
+	if !session.received[publish.PacketID] {
+		session.received[publish.PacketID] = true
+		deliveries = b.route(session, publish)
+	}
+	return append(deliveries, delivery{client: client, packet: &packets.Pubrec{PacketID: publish.PacketID}})
+}
+
+// subscribe adds the subscriptions of a client and sends it the matching retained messages, as far as the retain
+// handling of mqtt 5 allows. Invalid topic filters close the connection.
+func (b *Broker) subscribe(client *client, subscribe *packets.Subscribe) ([]delivery, bool) {
+	session := client.session
+	suback := &packets.Suback{PacketID: subscribe.PacketID}
+	var retained []delivery
+	for _, subscription := range subscribe.Subscriptions {
+		if !validFilter(subscription.Topic) || subscription.QOS > 2 || subscription.RetainHandling > 2 {
+			client.conn.Close()
+			return nil, false
+		}
+		if b.authorize != nil && !b.authorize(session.clientID, subscription.Topic) {
+			code := packets.SubackFailure
+			if client.v5() {
+				code = reasonNotAuthorized
+			}
+			suback.ReturnCodes = append(suback.ReturnCodes, code)
+			continue
+		}
+		_, existed := session.subscriptions[subscription.Topic]
+		session.subscriptions[subscription.Topic] = subscription
+		suback.ReturnCodes = append(suback.ReturnCodes, subscription.QOS)
+
+		if _, _, ok := sharedFilter(subscription.Topic); ok {
+			continue
+		}
+		if subscription.RetainHandling == 2 || (subscription.RetainHandling == 1 && existed) {
+			continue
+		}
+		for _, topic := range b.retainedTopics() {
+			if match(subscription.Topic, topic) {
+				publish := b.retained[topic]
+				retained = append(retained, b.send(session, publish, min(publish.QOS, subscription.QOS), true)...)
+			}
+		}
+	}
+	return append([]delivery{{client: client, packet: suback}}, retained...), true
+}
+
+func (b *Broker) retainedTopics() []string {
+	topics := make([]string, 0, len(b.retained))
+	for topic := range b.retained {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// route delivers a message of a session to every matching subscription and to one member of every matching
+// $share group. The session is nil for wills. Retained messages are stored for future subscribers, an empty
+// payload removes them.
+func (b *Broker) route(from *session, publish *packets.Publish) []delivery {
+	if publish.Retain {
+		if len(publish.Payload) == 0 {
+			delete(b.retained, publish.Topic)
+		} else {
+			retained := *publish
+			retained.Dup = false
+			retained.Properties.TopicAlias = nil
+			b.retained[publish.Topic] = &retained
+		}
+	}
+
+	clientIDs := make([]string, 0, len(b.sessions))
+	for clientID := range b.sessions {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+
+	var deliveries []delivery
+	groups := map[string][]member{}
+	for _, clientID := range clientIDs {
+		s := b.sessions[clientID]
+		granted, subscribed, retain := byte(0), false, false
+		for filter, subscription := range s.subscriptions {
+			if group, shared, ok := sharedFilter(filter); ok {
+				if match(shared, publish.Topic) {
+					key := group + "/" + shared
+					groups[key] = append(groups[key], member{s, subscription.QOS})
+				}
+				continue
+			}
+			if !match(filter, publish.Topic) || (subscription.NoLocal && s == from) {
+				continue
+			}
+			if !subscribed || subscription.QOS > granted {
+				granted, subscribed = subscription.QOS, true
+			}
+			retain = retain || (subscription.RetainAsPublished && publish.Retain)
+		}
+		if subscribed {
+			deliveries = append(deliveries, b.send(s, publish, min(publish.QOS, granted), retain)...)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		members := groups[key]
+		// online members are preferred so messages are not stuck in an offline session
+		online := []member{}
+		for _, m := range members {
+			if m.session.client != nil {
+				online = append(online, m)
+			}
+		}
+		if len(online) > 0 {
+			members = online
+		}
+		m := members[b.shared[key]%len(members)]
+		b.shared[key]++
+		deliveries = append(deliveries, b.send(m.session, publish, min(publish.QOS, m.qos), false)...)
+	}
+	return deliveries
+}
+
+// member is a session that subscribed to a $share group with the granted QoS
+type member struct {
+	session *session
+	qos     byte
+}
+
+// send queues a message for a session. QoS 0 messages for offline sessions are dropped, while QoS 1 and 2
+// messages wait in persistent sessions until the client reconnects.
+func (b *Broker) send(session *session, publish *packets.Publish, qos byte, retain bool) []delivery {
+	message := &packets.Publish{QOS: qos, Retain: retain, Topic: publish.Topic, Payload: publish.Payload, Properties: publish.Properties}
+	// topic aliases and subscription identifiers belong to a single connection
+	message.Properties.TopicAlias = nil
+	message.Properties.SubscriptionIdentifiers = nil
+	if qos > 0 {
+		if session.client == nil && session.clean {
+			return nil
+		}
+		message.PacketID = session.allocate()
+		session.inflight = append(session.inflight, message)
+	}
+	if session.client == nil {
+		return nil
+	}
+	return []delivery{{client: session.client, packet: message}}
+}
+
+// Reason codes of mqtt 5 that the broker sends
+const (
+	reasonNoSubscriptionExisted    = 0x11
+	reasonClientIdentifierNotValid = 0x85
+	reasonBadUserNameOrPassword    = 0x86
+	reasonNotAuthorized            = 0x87
+	reasonSessionTakenOver         = 0x8E
+	reasonReceiveMaximumExceeded   = 0x93
+	reasonTopicAliasInvalid        = 0x94
+)
+
+func min(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sharedFilter splits a $share/group/filter subscription into its group and filter
+func sharedFilter(filter string) (string, string, bool) {
+	if !strings.HasPrefix(filter, "$share/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// validFilter checks that wildcards take up a whole level and that # is the last level
+func validFilter(filter string) bool {
+	if group, shared, ok := sharedFilter(filter); ok {
+		if group == "" || strings.ContainsAny(group, "+#") {
+			return false
+		}
+		filter = shared
+	} else if strings.HasPrefix(filter, "$share/") {
+		return false
+	}
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// match checks if a topic matches a topic filter. Topics starting with $ are not matched by a leading wildcard.
+func match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
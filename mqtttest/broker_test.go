@@ -0,0 +1,283 @@
+package mqtttest_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt/mqtttest"
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// client is a raw connection to the broker so the tests see every packet
+type client struct {
+	t     *testing.T
+	conn  net.Conn
+	codec packets.Codec
+}
+
+func connect(t *testing.T, broker *mqtttest.Broker, options packets.Connect) (*client, *packets.Connack) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(broker.URL, "tcp://"))
+	if err != nil {
+		t.Fatalf("dial should not have failed: %v", err)
+	}
+	if options.ProtocolLevel == packets.ProtocolLevelV5 {
+		options.ProtocolName = packets.ProtocolNameV5
+	} else {
+		options.ProtocolName = packets.ProtocolNameV311
+		options.ProtocolLevel = packets.ProtocolLevelV311
+	}
+	c := &client{t: t, conn: conn, codec: packets.Codec{Level: options.ProtocolLevel}}
+	c.send(&options)
+	connack, ok := c.expect().(*packets.Connack)
+	if !ok {
+		t.Fatalf("broker should have answered with a connack")
+	}
+	return c, connack
+}
+
+func (c *client) send(packet packets.Packet) {
+	c.t.Helper()
+	if err := c.codec.Write(c.conn, packet); err != nil {
+		c.t.Fatalf("write should not have failed: %v", err)
+	}
+}
+
+func (c *client) expect() packets.Packet {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := c.codec.Read(c.conn)
+	if err != nil {
+		c.t.Fatalf("read should not have failed: %v", err)
+	}
+	return packet
+}
+
+func (c *client) expectPublish(topic string) *packets.Publish {
+	c.t.Helper()
+	publish, ok := c.expect().(*packets.Publish)
+	if !ok || publish.Topic != topic {
+		c.t.Fatalf("broker should have sent a publish to %v but sent %#v", topic, publish)
+	}
+	return publish
+}
+
+func (c *client) expectNothing() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if packet, err := c.codec.Read(c.conn); err == nil {
+		c.t.Fatalf("broker should not have sent anything but sent %#v", packet)
+	}
+}
+
+func (c *client) subscribe(qos byte, topics ...string) *packets.Suback {
+	c.t.Helper()
+	subscribe := &packets.Subscribe{PacketID: 1}
+	for _, topic := range topics {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, packets.Subscription{Topic: topic, QOS: qos})
+	}
+	c.send(subscribe)
+	suback, ok := c.expect().(*packets.Suback)
+	if !ok {
+		c.t.Fatalf("broker should have answered with a suback")
+	}
+	return suback
+}
+
+// TestRetained checks that new subscribers get retained messages until they are cleared
+func TestRetained(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	publisher, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	publisher.send(&packets.Publish{Topic: "a/b", Payload: []byte("hello"), Retain: true})
+
+	subscriber, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	subscriber.subscribe(0, "a/+")
+	publish := subscriber.expectPublish("a/b")
+	if !publish.Retain || string(publish.Payload) != "hello" {
+		t.Fatalf("retained message should have been sent with the retain flag but was %#v", publish)
+	}
+
+	publisher.send(&packets.Publish{Topic: "a/b", Retain: true})
+	if publish := subscriber.expectPublish("a/b"); publish.Retain {
+		t.Fatalf("messages for existing subscriptions should not have the retain flag")
+	}
+	other, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	other.subscribe(0, "a/#")
+	other.expectNothing()
+}
+
+// TestWildcards checks that wildcards match whole levels and that overlapping subscriptions get one message
+func TestWildcards(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	c.subscribe(0, "a/+/c", "a/#", "#")
+	c.send(&packets.Publish{Topic: "a/b/c"})
+	c.expectPublish("a/b/c")
+	c.send(&packets.Publish{Topic: "a"})
+	c.expectPublish("a")
+	c.send(&packets.Publish{Topic: "$internal/a"})
+	c.expectNothing()
+}
+
+// TestInvalidFilter checks that the broker closes the connection on an invalid topic filter
+func TestInvalidFilter(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	c.send(&packets.Subscribe{PacketID: 1, Subscriptions: []packets.Subscription{{Topic: "a/#/b"}}})
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := packets.Read(c.conn); err == nil {
+		t.Fatalf("broker should have closed the connection")
+	}
+}
+
+// TestExactlyOnce checks the QoS 2 flow in both directions
+func TestExactlyOnce(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	if suback := c.subscribe(2, "a"); suback.ReturnCodes[0] != 2 {
+		t.Fatalf("granted qos should have been 2 but was %v", suback.ReturnCodes[0])
+	}
+	c.send(&packets.Publish{Topic: "a", QOS: 2, PacketID: 7})
+	received := map[packets.Type]packets.Packet{}
+	for i := 0; i < 2; i++ {
+		packet := c.expect()
+		received[packet.Type()] = packet
+	}
+	if pubrec, ok := received[packets.TypePubrec].(*packets.Pubrec); !ok || pubrec.PacketID != 7 {
+		t.Fatalf("broker should have sent a pubrec for 7 but received %#v", received)
+	}
+	publish, ok := received[packets.TypePublish].(*packets.Publish)
+	if !ok || publish.QOS != 2 {
+		t.Fatalf("broker should have forwarded the message with qos 2 but received %#v", received)
+	}
+
+	c.send(&packets.Publish{Topic: "a", QOS: 2, PacketID: 7, Dup: true})
+	if _, ok := c.expect().(*packets.Pubrec); !ok {
+		t.Fatalf("broker should only have acknowledged the duplicate")
+	}
+	c.send(&packets.Pubrel{PacketID: 7})
+	if pubcomp, ok := c.expect().(*packets.Pubcomp); !ok || pubcomp.PacketID != 7 {
+		t.Fatalf("broker should have completed 7")
+	}
+	c.send(&packets.Pubrec{PacketID: publish.PacketID})
+	if pubrel, ok := c.expect().(*packets.Pubrel); !ok || pubrel.PacketID != publish.PacketID {
+		t.Fatalf("broker should have released %v", publish.PacketID)
+	}
+	c.send(&packets.Pubcomp{PacketID: publish.PacketID})
+	c.expectNothing()
+}
+
+// TestWill checks that the will is only published if the connection is lost unexpectedly
+func TestWill(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	subscriber, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	subscriber.subscribe(1, "will")
+	will := &packets.Will{Topic: "will", Payload: []byte("gone"), QOS: 1}
+
+	graceful, _ := connect(t, broker, packets.Connect{CleanSession: true, Will: will})
+	graceful.send(&packets.Disconnect{})
+	graceful.conn.Close()
+	subscriber.expectNothing()
+
+	lost, _ := connect(t, broker, packets.Connect{CleanSession: true, Will: will})
+	lost.conn.Close()
+	if publish := subscriber.expectPublish("will"); string(publish.Payload) != "gone" {
+		t.Fatalf("will payload should have been gone but was %v", string(publish.Payload))
+	}
+}
+
+// TestShared checks that the members of a $share group take turns
+func TestShared(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	first, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	first.subscribe(0, "$share/group/a/+")
+	second, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	second.subscribe(0, "$share/group/a/+")
+	publisher, _ := connect(t, broker, packets.Connect{CleanSession: true})
+
+	publisher.send(&packets.Publish{Topic: "a/1"})
+	publisher.send(&packets.Publish{Topic: "a/2"})
+	one, two := first.expect().(*packets.Publish), second.expect().(*packets.Publish)
+	if one.Topic == two.Topic {
+		t.Fatalf("both members should have received a different message")
+	}
+	first.expectNothing()
+	second.expectNothing()
+}
+
+// TestPersistentSession checks that subscriptions and messages are kept while the client is away
+func TestPersistentSession(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c, connack := connect(t, broker, packets.Connect{ClientID: "persistent"})
+	if connack.SessionPresent {
+		t.Fatalf("session should not have been present")
+	}
+	c.subscribe(1, "a")
+	c.send(&packets.Disconnect{})
+	c.conn.Close()
+
+	publisher, _ := connect(t, broker, packets.Connect{CleanSession: true})
+	publisher.send(&packets.Publish{Topic: "a", QOS: 1, PacketID: 1, Payload: []byte("while away")})
+	publisher.expect()
+
+	c, connack = connect(t, broker, packets.Connect{ClientID: "persistent"})
+	if !connack.SessionPresent {
+		t.Fatalf("session should have been present")
+	}
+	if publish := c.expectPublish("a"); string(publish.Payload) != "while away" {
+		t.Fatalf("queued message should have been sent but was %v", string(publish.Payload))
+	}
+
+	_, connack = connect(t, broker, packets.Connect{ClientID: "persistent", CleanSession: true})
+	if connack.SessionPresent {
+		t.Fatalf("clean session should have discarded the session")
+	}
+}
+
+// TestV5 checks that mqtt 5 properties are forwarded, that topic aliases are resolved and that an unknown topic
+// alias disconnects the client with a reason code
+func TestV5(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	publisher, connack := connect(t, broker, packets.Connect{CleanSession: true, ProtocolLevel: packets.ProtocolLevelV5})
+	if maximum := connack.Properties.TopicAliasMaximum; maximum == nil || *maximum != mqtttest.TopicAliasMaximum {
+		t.Fatalf("the broker should have allowed topic aliases but allowed %v", maximum)
+	}
+	subscriber, _ := connect(t, broker, packets.Connect{CleanSession: true, ProtocolLevel: packets.ProtocolLevelV5})
+	subscriber.subscribe(0, "a")
+
+	alias := uint16(1)
+	properties := packets.Properties{ContentType: "text/plain", UserProperties: []packets.UserProperty{{Key: "k", Value: "v"}}, TopicAlias: &alias}
+	publisher.send(&packets.Publish{Topic: "a", Payload: []byte("first"), Properties: properties})
+	publish := subscriber.expectPublish("a")
+	if publish.Properties.ContentType != "text/plain" || len(publish.Properties.UserProperties) != 1 || publish.Properties.TopicAlias != nil {
+		t.Fatalf("the properties should have been forwarded without the topic alias but were %#v", publish.Properties)
+	}
+	publisher.send(&packets.Publish{Payload: []byte("second"), Properties: packets.Properties{TopicAlias: &alias}})
+	if publish := subscriber.expectPublish("a"); string(publish.Payload) != "second" {
+		t.Fatalf("the topic alias should have been resolved but the payload was %v", string(publish.Payload))
+	}
+
+	unknown := uint16(2)
+	publisher.send(&packets.Publish{Payload: []byte("third"), Properties: packets.Properties{TopicAlias: &unknown}})
+	if disconnect, ok := publisher.expect().(*packets.Disconnect); !ok || disconnect.ReasonCode != 0x94 {
+		t.Fatalf("the broker should have disconnected with topic alias invalid but sent %#v", disconnect)
+	}
+}
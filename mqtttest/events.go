@@ -0,0 +1,58 @@
+package mqtttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// eventTimeout is how long Expect and Wait wait for an event before they fail the test
+const eventTimeout = 5 * time.Second
+
+// Events records the events of a client so that tests can wait for them. Pass its Record method as the OnEvent
+// option of the client.
+type Events chan mqtt.Event
+
+// NewEvents creates an event recorder that buffers up to 100 events
+func NewEvents() Events {
+	return make(Events, 100)
+}
+
+// Record adds an event, it blocks while the buffer is full
+func (e Events) Record(event mqtt.Event) {
+	e <- event
+}
+
+// Expect returns the next event and fails the test if it has another type or does not arrive within 5 seconds
+func (e Events) Expect(t testing.TB, eventType mqtt.EventType) mqtt.Event {
+	t.Helper()
+	select {
+	case event := <-e:
+		if event.Type != eventType {
+			t.Fatalf("event should be %v but is %v", eventType, event.Type)
+		}
+		return event
+	case <-time.After(eventTimeout):
+		t.Fatalf("did not receive the event %v", eventType)
+	}
+	return mqtt.Event{}
+}
+
+// Wait skips events until one of the type arrives and fails the test if none does within 5 seconds, for example
+// while reconnects may take more than one attempt
+func (e Events) Wait(t testing.TB, eventType mqtt.EventType) mqtt.Event {
+	t.Helper()
+	timeout := time.After(eventTimeout)
+	for {
+		select {
+		case event := <-e:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("did not receive the event %v", eventType)
+			return mqtt.Event{}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package mqtttest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// ErrPartitioned is returned when dialing through a partitioned FaultyTransport
+var ErrPartitioned = errors.New("mqtttest: the network is partitioned")
+
+// Faults are applied to every packet in both directions of a FaultyTransport
+type Faults struct {
+	Latency   time.Duration // How long every packet is delayed, packets stay in order
+	Bandwidth int           // The maximum bytes per second in every direction, 0 means no limit
+	DropRate  float64       // The fraction of packets that are silently dropped, from 0 to 1
+}
+
+// FaultyTransport wraps a transport and injects faults into the connections it opens, so that reconnects,
+// resubscribes and redeliveries can be tested on one machine. Faults can be changed at any time, existing
+// connections pick them up with their next packet.
+type FaultyTransport struct {
+	transport   mqtt.Transport
+	lock        sync.Mutex
+	faults      Faults
+	partitioned bool
+	random      *rand.Rand
+	conns       map[*faultyConn]bool
+}
+
+// NewFaultyTransport wraps a transport, like mqtt.PipeTransport, without any faults. Packet drops use a fixed
+// seed so that runs are repeatable.
+func NewFaultyTransport(transport mqtt.Transport) *FaultyTransport {
+	return &FaultyTransport{
+		transport: transport,
+		random:    rand.New(rand.NewSource(1)),
+		conns:     map[*faultyConn]bool{},
+	}
+}
+
+// Dial opens a connection through the wrapped transport unless the network is partitioned
+func (t *FaultyTransport) Dial(ctx context.Context, server *url.URL) (net.Conn, error) {
+	t.lock.Lock()
+	partitioned := t.partitioned
+	t.lock.Unlock()
+	if partitioned {
+		return nil, ErrPartitioned
+	}
+	inner, err := t.transport.Dial(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := net.Pipe()
+	conn := &faultyConn{transport: t, inner: inner, remote: remote, closed: make(chan struct{})}
+	t.lock.Lock()
+	t.conns[conn] = true
+	t.lock.Unlock()
+	go conn.pump(remote, inner)
+	go conn.pump(inner, remote)
+	return local, nil
+}
+
+// SetFaults replaces the faults applied to packets
+func (t *FaultyTransport) SetFaults(faults Faults) {
+	t.lock.Lock()
+	t.faults = faults
+	t.lock.Unlock()
+}
+
+// Reset closes all open connections, both sides see the connection drop
+func (t *FaultyTransport) Reset() {
+	t.lock.Lock()
+	conns := t.conns
+	t.conns = map[*faultyConn]bool{}
+	t.lock.Unlock()
+	for conn := range conns {
+		conn.close()
+	}
+}
+
+// Partition silently drops all packets of open connections, which become half-open, and fails new dials until
+// Heal is called
+func (t *FaultyTransport) Partition() {
+	t.lock.Lock()
+	t.partitioned = true
+	t.lock.Unlock()
+}
+
+// Heal ends a partition
+func (t *FaultyTransport) Heal() {
+	t.lock.Lock()
+	t.partitioned = false
+	t.lock.Unlock()
+}
+
+// Step is a fault in a schedule, it is applied After the previous step
+type Step struct {
+	After time.Duration
+	Fault func(t *FaultyTransport)
+}
+
+// Run applies the steps in the background one after another. Calling the returned function stops the schedule
+// before the next step.
+func (t *FaultyTransport) Run(steps ...Step) (stop func()) {
+	stopped := make(chan struct{})
+	var once sync.Once
+	go func() {
+		for _, step := range steps {
+			timer := time.NewTimer(step.After)
+			select {
+			case <-timer.C:
+				step.Fault(t)
+			case <-stopped:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(stopped) })
+	}
+}
+
+func (t *FaultyTransport) current() Faults {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.faults
+}
+
+// drop decides if the next packet gets lost
+func (t *FaultyTransport) drop() (Faults, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.partitioned {
+		return t.faults, true
+	}
+	return t.faults, t.faults.DropRate > 0 && t.random.Float64() < t.faults.DropRate
+}
+
+// faultyConn copies packets between the pipe handed to the client and the wrapped connection
+type faultyConn struct {
+	transport *FaultyTransport
+	inner     net.Conn
+	remote    net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *faultyConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.inner.Close()
+		c.remote.Close()
+		c.transport.lock.Lock()
+		delete(c.transport.conns, c)
+		c.transport.lock.Unlock()
+	})
+}
+
+// delayed is a packet that is delivered once it is due
+type delayed struct {
+	data []byte
+	due  time.Time
+}
+
+// pump reads packets from one side and writes the ones that are not dropped to the other side after the
+// latency. Reading continues while packets wait, so latency does not limit the throughput.
+func (c *faultyConn) pump(from, to net.Conn) {
+	queue := make(chan delayed, 1024)
+	go func() {
+		defer c.close()
+		for packet := range queue {
+			time.Sleep(time.Until(packet.due))
+			if _, err := to.Write(packet.data); err != nil {
+				return
+			}
+			faults := c.transport.current()
+			if faults.Bandwidth > 0 {
+				time.Sleep(time.Duration(len(packet.data)) * time.Second / time.Duration(faults.Bandwidth))
+			}
+		}
+	}()
+	defer close(queue)
+	for {
+		data, err := readFrame(from)
+		if err != nil {
+			c.close()
+			return
+		}
+		faults, dropped := c.transport.drop()
+		if dropped {
+			continue
+		}
+		select {
+		case queue <- delayed{data: data, due: time.Now().Add(faults.Latency)}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// readFrame reads the bytes of the next packet without decoding it, so the pump works with every protocol level
+func readFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	digit := make([]byte, 1)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, packets.ErrMalformed
+		}
+		if _, err := io.ReadFull(r, digit); err != nil {
+			return nil, err
+		}
+		frame = append(frame, digit[0])
+		length += int(digit[0]&127) * multiplier
+		multiplier *= 128
+		if digit[0]&128 == 0 {
+			break
+		}
+	}
+	header := len(frame)
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(r, frame[header:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,478 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when the outbox journal is flushed to disk
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the journal to disk after every write, so no acknowledged publish is ever lost
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodically flushes the journal at most once every sync interval, messages written since the last flush can be lost on power loss
+	SyncPeriodically
+	// SyncNever leaves flushing the journal to the operating system
+	SyncNever
+)
+
+// Outbox configures a journal on disk that keeps every published message until the broker acknowledged it.
+// Messages that were not acknowledged are published again after reconnecting or after the process restarted
+// and connected, so they are delivered at least once.
+type Outbox struct {
+	Path         string        // The journal file, it is created if it does not exist
+	Sync         SyncPolicy    // When the journal is flushed to disk, defaults to SyncAlways
+	SyncInterval time.Duration // The interval for SyncPeriodically, defaults to 1 second
+	MaxBytes     int64         // The maximum size of the journal, 0 means no limit
+}
+
+var (
+	// ErrOutboxFull means that a message did not fit in the outbox journal
+	ErrOutboxFull = errors.New("mqtt: the outbox is full")
+)
+
+const (
+	recordAdd    byte = 1
+	recordRemove byte = 2
+
+	// recordOverhead is the size of the kind, id, length and checksum of a journal record
+	recordOverhead = 1 + 8 + 4 + 4
+
+	// flags of a journaled message, an expiry time follows the header if flagExpires is set and then the length
+	// and json of the mqtt 5 properties if flagProperties is set
+	flagRetained   byte = 1
+	flagExpires    byte = 2
+	flagProperties byte = 4
+
+	// compactMinBytes is the journal size below which it is never compacted
+	compactMinBytes = 64 * 1024
+)
+
+type outboxEntry struct {
+	message queuedMessage
+	size    int64
+}
+
+// outbox journals messages to an append-only file. Entries are removed by appending a remove record and the
+// file is compacted once most of it consists of removed entries.
+type outbox struct {
+	options   Outbox
+	lock      sync.Mutex
+	file      *os.File
+	size      int64
+	liveBytes int64
+	nextID    uint64
+	entries   map[uint64]outboxEntry
+	retry     []uint64
+	syncing   bool
+	measure   func(entries int) // called with the number of entries when it changes
+}
+
+func openOutbox(options Outbox, measure func(entries int)) (*outbox, error) {
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = 1 * time.Second
+	}
+	file, err := os.OpenFile(options.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: failed to open outbox: %w", err)
+	}
+	o := &outbox{options: options, file: file, nextID: 1, entries: map[uint64]outboxEntry{}, measure: measure}
+	if err := o.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("mqtt: failed to load outbox: %w", err)
+	}
+	if err := o.compact(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("mqtt: failed to compact outbox: %w", err)
+	}
+
+	// everything left from a previous process is published again after connecting
+	for id := range o.entries {
+		o.retry = append(o.retry, id)
+	}
+	sort.Slice(o.retry, func(i, j int) bool { return o.retry[i] < o.retry[j] })
+	o.measure(len(o.entries))
+	return o, nil
+}
+
+// load reads all records from the journal. A partially written or corrupt record ends the journal.
+func (o *outbox) load() error {
+	reader := bufio.NewReader(o.file)
+	for {
+		kind, id, body, err := readRecord(reader)
+		if err != nil {
+			break
+		}
+		switch kind {
+		case recordAdd:
+			message, err := decodeMessage(body)
+			if err != nil {
+				return nil
+			}
+			message.entry = id
+			o.entries[id] = outboxEntry{message: message, size: int64(recordOverhead + len(body))}
+		case recordRemove:
+			delete(o.entries, id)
+		}
+		if id >= o.nextID {
+			o.nextID = id + 1
+		}
+	}
+	return nil
+}
+
+func readRecord(reader io.Reader) (byte, uint64, []byte, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[9:13]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, 0, nil, err
+	}
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(reader, checksum); err != nil {
+		return 0, 0, nil, err
+	}
+	hash := crc32.NewIEEE()
+	hash.Write(header)
+	hash.Write(body)
+	if hash.Sum32() != binary.BigEndian.Uint32(checksum) {
+		return 0, 0, nil, errors.New("checksum mismatch")
+	}
+	return header[0], binary.BigEndian.Uint64(header[1:9]), body, nil
+}
+
+func encodeRecord(kind byte, id uint64, body []byte) []byte {
+	record := make([]byte, 13, recordOverhead+len(body))
+	record[0] = kind
+	binary.BigEndian.PutUint64(record[1:9], id)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(body)))
+	record = append(record, body...)
+	return append(record, make([]byte, 4)...)
+}
+
+func sealRecord(record []byte) []byte {
+	binary.BigEndian.PutUint32(record[len(record)-4:], crc32.ChecksumIEEE(record[:len(record)-4]))
+	return record
+}
+
+// journaledProperties are the mqtt 5 properties of a journaled message
+type journaledProperties struct {
+	ContentType     string            `json:"content_type,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	ResponseTopic   string            `json:"response_topic,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	DedupKey        string            `json:"dedup_key,omitempty"`
+}
+
+func encodeMessage(message queuedMessage) []byte {
+	body := make([]byte, 4, 12+len(message.topic)+len(message.payload))
+	body[0] = byte(message.qos)
+	if message.retained {
+		body[1] |= flagRetained
+	}
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(message.topic)))
+	if !message.expires.IsZero() {
+		body[1] |= flagExpires
+		body = body[:12]
+		binary.BigEndian.PutUint64(body[4:12], uint64(message.expires.UnixNano()))
+	}
+	if !message.properties.empty() {
+		p := message.properties
+		data, _ := json.Marshal(journaledProperties{
+			ContentType:     p.contentType,
+			UserProperties:  p.userProperties,
+			ResponseTopic:   p.responseTopic,
+			CorrelationData: p.correlationData,
+			DedupKey:        p.dedupKey,
+		})
+		body[1] |= flagProperties
+		body = append(body, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(data)))
+		body = append(body, data...)
+	}
+	body = append(body, message.topic...)
+	return append(body, message.payload...)
+}
+
+func decodeMessage(body []byte) (queuedMessage, error) {
+	if len(body) < 4 {
+		return queuedMessage{}, errors.New("message too short")
+	}
+	message := queuedMessage{qos: QOS(body[0]), retained: body[1]&flagRetained != 0, queued: time.Now()}
+	topicLength := int(binary.BigEndian.Uint16(body[2:4]))
+	rest := body[4:]
+	if body[1]&flagExpires != 0 {
+		if len(rest) < 8 {
+			return queuedMessage{}, errors.New("expiry too short")
+		}
+		message.expires = time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8])))
+		rest = rest[8:]
+	}
+	if body[1]&flagProperties != 0 {
+		if len(rest) < 4 || len(rest)-4 < int(binary.BigEndian.Uint32(rest[:4])) {
+			return queuedMessage{}, errors.New("properties too short")
+		}
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		var p journaledProperties
+		if err := json.Unmarshal(rest[4:4+length], &p); err != nil {
+			return queuedMessage{}, err
+		}
+		message.properties = properties{
+			contentType:     p.ContentType,
+			userProperties:  p.UserProperties,
+			responseTopic:   p.ResponseTopic,
+			correlationData: p.CorrelationData,
+			dedupKey:        p.DedupKey,
+		}
+		rest = rest[4+length:]
+	}
+	if len(rest) < topicLength {
+		return queuedMessage{}, errors.New("topic too long")
+	}
+	message.topic = string(rest[:topicLength])
+	message.payload = rest[topicLength:]
+	return message, nil
+}
+
+// add journals a message and returns its entry id
+func (o *outbox) add(message queuedMessage) (uint64, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := o.nextID
+	record := sealRecord(encodeRecord(recordAdd, id, encodeMessage(message)))
+	size := int64(len(record))
+	if o.options.MaxBytes > 0 && o.size+size > o.options.MaxBytes {
+		if err := o.compact(); err != nil {
+			return 0, err
+		}
+		if o.size+size > o.options.MaxBytes {
+			return 0, ErrOutboxFull
+		}
+	}
+	if err := o.append(record); err != nil {
+		return 0, err
+	}
+	o.nextID++
+	message.entry = id
+	o.entries[id] = outboxEntry{message: message, size: size}
+	o.liveBytes += size
+	o.measure(len(o.entries))
+	return id, nil
+}
+
+// remove deletes an entry once it was acknowledged or can never be delivered
+func (o *outbox) remove(id uint64) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	entry, ok := o.entries[id]
+	if !ok {
+		return nil
+	}
+	if err := o.append(sealRecord(encodeRecord(recordRemove, id, nil))); err != nil {
+		return err
+	}
+	delete(o.entries, id)
+	o.liveBytes -= entry.size
+	o.measure(len(o.entries))
+	if o.size >= compactMinBytes && o.size > 2*o.liveBytes {
+		return o.compact()
+	}
+	return nil
+}
+
+// failed marks an entry to be published again after reconnecting
+func (o *outbox) failed(id uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, ok := o.entries[id]; ok {
+		o.retry = append(o.retry, id)
+	}
+}
+
+// takeRetry returns the messages that need to be published again in the order they were added
+func (o *outbox) takeRetry() []queuedMessage {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	sort.Slice(o.retry, func(i, j int) bool { return o.retry[i] < o.retry[j] })
+	messages := make([]queuedMessage, 0, len(o.retry))
+	for _, id := range o.retry {
+		if entry, ok := o.entries[id]; ok {
+			messages = append(messages, entry.message)
+		}
+	}
+	o.retry = nil
+	return messages
+}
+
+func (o *outbox) append(record []byte) error {
+	if _, err := o.file.Seek(o.size, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := o.file.Write(record); err != nil {
+		return err
+	}
+	o.size += int64(len(record))
+	return o.sync()
+}
+
+func (o *outbox) sync() error {
+	switch o.options.Sync {
+	case SyncAlways:
+		return o.file.Sync()
+	case SyncPeriodically:
+		if !o.syncing {
+			o.syncing = true
+			time.AfterFunc(o.options.SyncInterval, func() {
+				o.lock.Lock()
+				o.syncing = false
+				o.file.Sync()
+				o.lock.Unlock()
+			})
+		}
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the live entries. The new journal is written next to the old one
+// and renamed over it, so a crash leaves either of them intact.
+func (o *outbox) compact() error {
+	ids := make([]uint64, 0, len(o.entries))
+	for id := range o.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	path := o.options.Path + ".compact"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	var size int64
+	for _, id := range ids {
+		record := sealRecord(encodeRecord(recordAdd, id, encodeMessage(o.entries[id].message)))
+		if _, err := writer.Write(record); err != nil {
+			file.Close()
+			return err
+		}
+		size += int64(len(record))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(path, o.options.Path); err != nil {
+		file.Close()
+		return err
+	}
+	o.file.Close()
+	o.file = file
+	o.size = size
+	o.liveBytes = size
+	return nil
+}
+
+// settle measures a publish and releases its operation once its token completed. If it failed because there was no
+// connection its outbox entry is kept and published again after reconnecting when retry is set, otherwise the entry
+// is removed because the message was acknowledged or can never be delivered.
+func (c *Client) settle(token *token, message queuedMessage, retry bool) {
+	token.then(func() {
+		c.metrics.MessagePublished(message.qos, len(message.payload), time.Since(message.queued), token.Error())
+	})
+	entry := message.entry
+	if c.outbox == nil || entry == 0 {
+		c.releaseWhenDone(token)
+		return
+	}
+	update := func() {
+		if !retryable(token.Error()) {
+			c.reportOutbox(c.outbox.remove(entry))
+		} else if retry {
+			c.outbox.failed(entry)
+			// a reconnect that finished in the meantime did not replay it
+			if c.core.connected() {
+				go c.replay()
+			}
+		}
+		c.inflight.release()
+	}
+	select {
+	case <-token.Done():
+		// failed right away, so it is marked before a connect replays the outbox
+		update()
+	default:
+		// tokens can complete while the core is locked, so the outbox is updated in the background
+		token.then(func() {
+			go update()
+		})
+	}
+}
+
+// retryable is true for the errors of publishes that failed because there was no connection
+func retryable(err error) bool {
+	return errors.Is(err, ErrConnectionLost) || errors.Is(err, ErrNotConnected)
+}
+
+// journaled returns a token that completes without an error if the publish failed because there was no
+// connection, because the outbox publishes it again after reconnecting
+func journaled(t *token) *token {
+	result := newToken()
+	t.then(func() {
+		err := t.Error()
+		if retryable(err) {
+			err = nil
+		}
+		result.complete(err)
+	})
+	return result
+}
+
+// replay publishes the messages of the outbox that still need to be delivered
+func (c *Client) replay() {
+	messages := c.outbox.takeRetry()
+	tokens := make([]*token, len(messages))
+	for i, message := range messages {
+		if message.expired() {
+			c.discard(message, "it expired in the outbox")
+			continue
+		}
+		c.inflight.track()
+		tokens[i] = c.core.publish(context.Background(), message.topic, byte(message.qos), message.retained, message.payload, message.publishProperties())
+		c.settle(tokens[i], message, true)
+	}
+	for _, token := range tokens {
+		if token != nil {
+			c.waitWhileConnected(token)
+		}
+	}
+}
+
+// drop removes a message that will never be sent from the outbox
+func (c *Client) drop(message queuedMessage) {
+	if c.outbox != nil && message.entry != 0 {
+		c.reportOutbox(c.outbox.remove(message.entry))
+	}
+}
+
+func (c *Client) reportOutbox(err error) {
+	if err != nil && c.Options.OnStoreError != nil {
+		c.Options.OnStoreError(fmt.Errorf("mqtt: outbox failed: %w", err))
+	}
+}
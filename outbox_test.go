@@ -0,0 +1,226 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+func tempOutbox(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mqtt-outbox")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	return filepath.Join(dir, "outbox"), func() { os.RemoveAll(dir) }
+}
+
+// TestOutbox checks that an unacknowledged publish is resent by a new client using the same outbox and that it
+// is removed from the outbox once it was acknowledged
+func TestOutbox(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	unacknowledged := listenFakeBroker(t, "127.0.0.1:0", false)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{unacknowledged.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(ctx(), 100*time.Millisecond)
+	defer cancel()
+	err = client.PublishString(timeout, "TestOutbox/1", "hello", mqtt.AtLeastOnce)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish should have failed with context.DeadlineExceeded: %v", err)
+	}
+	client.DisconnectImmediately()
+
+	// a partially written record of a crash is ignored
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("opening outbox failed: %v", err)
+	}
+	file.Write([]byte{1, 0, 0})
+	file.Close()
+
+	fake := newFakeBroker(t)
+	client = newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	expectPublishes(t, fake, "TestOutbox/1")
+	err = client.Disconnect(ctx())
+	if err != nil {
+		t.Fatalf("disconnect should not have failed: %v", err)
+	}
+
+	client = newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	err = client.PublishString(ctx(), "TestOutbox/2", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	expectPublishes(t, fake, "TestOutbox/2")
+}
+
+// TestOutboxDisconnected checks that a publish while disconnected succeeds once it is journaled and that it is
+// sent exactly once after connecting
+func TestOutboxDisconnected(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err := client.PublishString(ctx(), "TestOutboxDisconnected", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should have been journaled: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOutboxDisconnected")
+	select {
+	case packet := <-fake.packets:
+		if packet.kind == 3 {
+			t.Fatalf("the journaled publish should have been sent once but got another publish on %v", publishedTopic(packet))
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestOutboxExpiry checks that the expiry of a message is journaled and that it is not resent after it expired
+func TestOutboxExpiry(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	unacknowledged := listenFakeBroker(t, "127.0.0.1:0", false)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{unacknowledged.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	expiries := map[string]time.Duration{"TestOutboxExpiry/expired": 100 * time.Millisecond, "TestOutboxExpiry/fresh": time.Minute}
+	for _, topic := range []string{"TestOutboxExpiry/expired", "TestOutboxExpiry/fresh"} {
+		timeout, cancel := context.WithTimeout(ctx(), 20*time.Millisecond)
+		err = client.PublishString(timeout, topic, "hello", mqtt.AtLeastOnce, mqtt.Retain, mqtt.WithExpiry(expiries[topic]))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("publish should have failed with context.DeadlineExceeded: %v", err)
+		}
+	}
+	client.DisconnectImmediately()
+	<-time.After(150 * time.Millisecond)
+
+	fake := newFakeBroker(t)
+	client = newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path}})
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOutboxExpiry/fresh")
+}
+
+// TestOutboxFull checks that publishes that do not fit in the outbox are rejected and that the others are journaled
+// and sent in order after connecting
+func TestOutboxFull(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path, MaxBytes: 100}})
+	for _, topic := range []string{"TestOutboxFull/1", "TestOutboxFull/2"} {
+		err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should have been journaled: %v", err)
+		}
+	}
+	err := client.PublishString(ctx(), "TestOutboxFull/3", "hello", mqtt.AtLeastOnce)
+	if err != mqtt.ErrOutboxFull {
+		t.Fatalf("publish should have failed with ErrOutboxFull: %v", err)
+	}
+
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOutboxFull/1", "TestOutboxFull/2")
+}
+
+// TestOutboxCompaction checks that the journal does not keep growing with acknowledged messages
+func TestOutboxCompaction(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Outbox: &mqtt.Outbox{Path: path, Sync: mqtt.SyncNever}})
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	payload := strings.Repeat("x", 1000)
+	for i := 0; i < 200; i++ {
+		err = client.PublishString(ctx(), "TestOutboxCompaction", payload, mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+	}
+	err = client.Disconnect(ctx())
+	if err != nil {
+		t.Fatalf("disconnect should not have failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat of the outbox failed: %v", err)
+	}
+	if info.Size() > 100*1000 {
+		t.Fatalf("the outbox should have been compacted but is %v bytes", info.Size())
+	}
+}
+
+// TestOutboxPropertiesV5 checks that the properties of a journaled mqtt 5 publish are restored from the outbox
+func TestOutboxPropertiesV5(t *testing.T) {
+	path, cleanup := tempOutbox(t)
+	defer cleanup()
+
+	topic := testUUID + "/TestOutboxPropertiesV5"
+	receiver := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, ProtocolVersion: mqtt.ProtocolV5})
+	defer receiver.DisconnectImmediately()
+	messages, _ := receiver.Listen(topic)
+	if err := receiver.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	options := mqtt.ClientOptions{Servers: []string{broker}, ProtocolVersion: mqtt.ProtocolV5, Outbox: &mqtt.Outbox{Path: path}}
+	client, err := mqtt.NewClient(options)
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce, mqtt.WithContentType("text/plain"), mqtt.WithUserProperty("tenant", "acme"))
+	if err != nil {
+		t.Fatalf("publish should have been journaled: %v", err)
+	}
+	client.DisconnectImmediately()
+
+	client = connectClient(t, options)
+	defer client.DisconnectImmediately()
+	message := receive(t, messages)
+	if message.PayloadString() != "hello" || message.ContentType() != "text/plain" || message.UserProperties()["tenant"] != "acme" {
+		t.Fatalf("the journaled message should have had its properties but is %+v", message)
+	}
+}
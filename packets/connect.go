@@ -0,0 +1,182 @@
+package packets
+
+// Connack return codes of 3.1 and 3.1.1, mqtt 5 uses reason codes instead
+const (
+	Accepted                    byte = 0x00
+	UnacceptableProtocolVersion byte = 0x01
+	IdentifierRejected          byte = 0x02
+	ServerUnavailable           byte = 0x03
+	BadUsernameOrPassword       byte = 0x04
+	NotAuthorized               byte = 0x05
+)
+
+// Protocol names and levels of the supported versions
+const (
+	ProtocolNameV31   = "MQIsdp"
+	ProtocolLevelV31  = 3
+	ProtocolNameV311  = "MQTT"
+	ProtocolLevelV311 = 4
+	ProtocolNameV5    = "MQTT"
+	ProtocolLevelV5   = 5
+)
+
+// Will is the message a broker publishes when a client disconnects unexpectedly
+type Will struct {
+	Topic      string
+	Payload    []byte
+	QOS        byte
+	Retain     bool
+	Properties Properties // Only sent with mqtt 5
+}
+
+// Connect is sent by a client to start a session
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16 // In seconds
+	ClientID      string
+	Will          *Will   // Nil if there is no will
+	Username      *string // Nil if there is no username
+	Password      []byte  // Nil if there is no password
+	Properties    Properties
+}
+
+// Type of the packet
+func (p *Connect) Type() Type { return TypeConnect }
+
+func (p *Connect) encode(e *encoder) byte {
+	// the format follows the protocol level of the connect itself
+	e.v5 = p.ProtocolLevel == ProtocolLevelV5
+	e.string(p.ProtocolName)
+	e.WriteByte(p.ProtocolLevel)
+	var flags byte
+	if p.CleanSession {
+		flags |= 0x02
+	}
+	if p.Will != nil {
+		flags |= 0x04 | p.Will.QOS<<3
+		if p.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if p.Password != nil {
+		flags |= 0x40
+	}
+	if p.Username != nil {
+		flags |= 0x80
+	}
+	e.WriteByte(flags)
+	e.uint16(p.KeepAlive)
+	e.properties(&p.Properties)
+	e.string(p.ClientID)
+	if p.Will != nil {
+		e.properties(&p.Will.Properties)
+		e.string(p.Will.Topic)
+		e.bytes(p.Will.Payload)
+	}
+	if p.Username != nil {
+		e.string(*p.Username)
+	}
+	if p.Password != nil {
+		e.bytes(p.Password)
+	}
+	return 0
+}
+
+func decodeConnect(d *decoder) *Connect {
+	p := &Connect{ProtocolName: d.string(), ProtocolLevel: d.byte()}
+	d.v5 = p.ProtocolLevel == ProtocolLevelV5
+	flags := d.byte()
+	p.CleanSession = flags&0x02 != 0
+	p.KeepAlive = d.uint16()
+	p.Properties = d.properties()
+	p.ClientID = d.string()
+	if flags&0x04 != 0 {
+		p.Will = &Will{QOS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		p.Will.Properties = d.properties()
+		p.Will.Topic = d.string()
+		p.Will.Payload = d.bytes()
+	}
+	if flags&0x80 != 0 {
+		username := d.string()
+		p.Username = &username
+	}
+	if flags&0x40 != 0 {
+		p.Password = d.bytes()
+	}
+	return p
+}
+
+// Connack is the response of a broker to a connect
+type Connack struct {
+	SessionPresent bool
+	ReturnCode     byte // The reason code with mqtt 5
+	Properties     Properties
+}
+
+// Type of the packet
+func (p *Connack) Type() Type { return TypeConnack }
+
+func (p *Connack) encode(e *encoder) byte {
+	if p.SessionPresent {
+		e.WriteByte(0x01)
+	} else {
+		e.WriteByte(0x00)
+	}
+	e.WriteByte(p.ReturnCode)
+	e.properties(&p.Properties)
+	return 0
+}
+
+func decodeConnack(d *decoder) *Connack {
+	p := &Connack{SessionPresent: d.byte()&0x01 == 1, ReturnCode: d.byte()}
+	p.Properties = d.properties()
+	return p
+}
+
+// Pingreq is sent by a client to keep the connection alive
+type Pingreq struct{}
+
+// Type of the packet
+func (p *Pingreq) Type() Type { return TypePingreq }
+
+func (p *Pingreq) encode(e *encoder) byte { return 0 }
+
+// Pingresp is the response of a broker to a ping
+type Pingresp struct{}
+
+// Type of the packet
+func (p *Pingresp) Type() Type { return TypePingresp }
+
+func (p *Pingresp) encode(e *encoder) byte { return 0 }
+
+// Disconnect is sent by a client before it closes the connection. With mqtt 5 brokers send it too, before they
+// close a connection with a reason.
+type Disconnect struct {
+	ReasonCode byte // Only sent with mqtt 5
+	Properties Properties
+}
+
+// Type of the packet
+func (p *Disconnect) Type() Type { return TypeDisconnect }
+
+func (p *Disconnect) encode(e *encoder) byte {
+	// a normal disconnect without properties has no body
+	if e.v5 && (p.ReasonCode != 0 || !p.Properties.empty()) {
+		e.WriteByte(p.ReasonCode)
+		e.properties(&p.Properties)
+	}
+	return 0
+}
+
+func decodeDisconnect(d *decoder) *Disconnect {
+	p := &Disconnect{}
+	if d.v5 && d.remaining() {
+		p.ReasonCode = d.byte()
+		if d.remaining() {
+			p.Properties = d.properties()
+		}
+	}
+	return p
+}
@@ -0,0 +1,357 @@
+// Package packets encodes and decodes the control packets of the mqtt 3.1, 3.1.1 and 5 protocols
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Type is the kind of a control packet
+type Type byte
+
+// The control packet types in the order of their value
+const (
+	TypeConnect Type = iota + 1
+	TypeConnack
+	TypePublish
+	TypePuback
+	TypePubrec
+	TypePubrel
+	TypePubcomp
+	TypeSubscribe
+	TypeSuback
+	TypeUnsubscribe
+	TypeUnsuback
+	TypePingreq
+	TypePingresp
+	TypeDisconnect
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeConnect:
+		return "CONNECT"
+	case TypeConnack:
+		return "CONNACK"
+	case TypePublish:
+		return "PUBLISH"
+	case TypePuback:
+		return "PUBACK"
+	case TypePubrec:
+		return "PUBREC"
+	case TypePubrel:
+		return "PUBREL"
+	case TypePubcomp:
+		return "PUBCOMP"
+	case TypeSubscribe:
+		return "SUBSCRIBE"
+	case TypeSuback:
+		return "SUBACK"
+	case TypeUnsubscribe:
+		return "UNSUBSCRIBE"
+	case TypeUnsuback:
+		return "UNSUBACK"
+	case TypePingreq:
+		return "PINGREQ"
+	case TypePingresp:
+		return "PINGRESP"
+	case TypeDisconnect:
+		return "DISCONNECT"
+	}
+	return "UNKNOWN"
+}
+
+// MaxLength is the largest remaining length a packet can have
+const MaxLength = 268435455
+
+// DefaultMaxSize is the largest packet Read accepts if the Codec has no MaxSize
+const DefaultMaxSize = 16 << 20
+
+var (
+	// ErrMalformed means that a packet could not be decoded because it violates the protocol
+	ErrMalformed = errors.New("packets: malformed packet")
+	// ErrTooLarge means that a packet is larger than MaxLength and can not be encoded, or that a packet that is
+	// read is larger than the maximum size of the Codec
+	ErrTooLarge = errors.New("packets: packet too large")
+)
+
+// Packet is an mqtt control packet
+type Packet interface {
+	Type() Type
+	encode(e *encoder) byte // writes the variable header and payload and returns the fixed header flags
+}
+
+// Codec encodes and decodes the packets of a protocol level. Mqtt 5 adds reason codes and properties to most
+// packets, while 3.1 and 3.1.1 share the same format. Connect packets are always coded by their own protocol
+// level, so a broker can read the connect with the zero Codec and switch to the level of the client.
+type Codec struct {
+	Level   byte // ProtocolLevelV5 for mqtt 5, any other level uses the format of 3.1.1
+	MaxSize int  // The largest packet Read accepts in bytes including the fixed header, DefaultMaxSize if it is 0
+}
+
+func (c Codec) v5() bool {
+	return c.Level == ProtocolLevelV5
+}
+
+// Encode returns the packet as it is sent over the network in the mqtt 3.1.1 format
+func Encode(packet Packet) ([]byte, error) {
+	return Codec{}.Encode(packet)
+}
+
+// Write encodes the packet in the mqtt 3.1.1 format and writes it to the writer
+func Write(w io.Writer, packet Packet) error {
+	return Codec{}.Write(w, packet)
+}
+
+// Read reads and decodes the next packet in the mqtt 3.1.1 format from the reader, packets larger than
+// DefaultMaxSize are rejected
+func Read(r io.Reader) (Packet, error) {
+	return Codec{}.Read(r)
+}
+
+// Decode decodes the variable header and payload of a packet of the given type in the mqtt 3.1.1 format
+func Decode(kind Type, flags byte, body []byte) (Packet, error) {
+	return Codec{}.Decode(kind, flags, body)
+}
+
+// Encode returns the packet as it is sent over the network
+func (c Codec) Encode(packet Packet) ([]byte, error) {
+	body := encoder{v5: c.v5()}
+	flags := packet.encode(&body)
+	if body.err != nil {
+		return nil, body.err
+	}
+	if body.Len() > MaxLength {
+		return nil, ErrTooLarge
+	}
+
+	var encoded encoder
+	encoded.Grow(5 + body.Len())
+	encoded.WriteByte(byte(packet.Type())<<4 | flags)
+	encoded.varint(uint32(body.Len()))
+	encoded.Write(body.Bytes())
+	return encoded.Bytes(), nil
+}
+
+// Write encodes the packet and writes it to the writer
+func (c Codec) Write(w io.Writer, packet Packet) error {
+	encoded, err := c.Encode(packet)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+// Read reads and decodes the next packet from the reader. Packets larger than the maximum size fail with
+// ErrTooLarge before their body is read, the reader is then in the middle of the packet.
+func (c Codec) Read(r io.Reader) (Packet, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	kind, flags := Type(header[0]>>4), header[0]&0x0f
+
+	length, multiplier, size := 0, 1, 1
+	digit := make([]byte, 1)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformed
+		}
+		if _, err := io.ReadFull(r, digit); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		size++
+		length += int(digit[0]&127) * multiplier
+		multiplier *= 128
+		if digit[0]&128 == 0 {
+			break
+		}
+	}
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if size+length > maxSize {
+		return nil, fmt.Errorf("%w: %v bytes are more than %v", ErrTooLarge, size+length, maxSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return c.Decode(kind, flags, body)
+}
+
+// Decode decodes the variable header and payload of a packet of the given type
+func (c Codec) Decode(kind Type, flags byte, body []byte) (Packet, error) {
+	d := &decoder{body: body, v5: c.v5()}
+	var packet Packet
+	switch kind {
+	case TypeConnect:
+		packet = decodeConnect(d)
+	case TypeConnack:
+		packet = decodeConnack(d)
+	case TypePublish:
+		packet = decodePublish(d, flags)
+	case TypePuback:
+		p := &Puback{}
+		p.PacketID, p.ReasonCode, p.Properties = decodeAck(d)
+		packet = p
+	case TypePubrec:
+		p := &Pubrec{}
+		p.PacketID, p.ReasonCode, p.Properties = decodeAck(d)
+		packet = p
+	case TypePubrel:
+		p := &Pubrel{}
+		p.PacketID, p.ReasonCode, p.Properties = decodeAck(d)
+		packet = p
+	case TypePubcomp:
+		p := &Pubcomp{}
+		p.PacketID, p.ReasonCode, p.Properties = decodeAck(d)
+		packet = p
+	case TypeSubscribe:
+		packet = decodeSubscribe(d)
+	case TypeSuback:
+		packet = decodeSuback(d)
+	case TypeUnsubscribe:
+		packet = decodeUnsubscribe(d)
+	case TypeUnsuback:
+		packet = decodeUnsuback(d)
+	case TypePingreq:
+		packet = &Pingreq{}
+	case TypePingresp:
+		packet = &Pingresp{}
+	case TypeDisconnect:
+		packet = decodeDisconnect(d)
+	default:
+		return nil, fmt.Errorf("%w: unknown packet type %v", ErrMalformed, byte(kind))
+	}
+	if d.err == ErrMalformed {
+		return nil, fmt.Errorf("%w: %v is too short", ErrMalformed, kind)
+	} else if d.err != nil {
+		return nil, d.err
+	}
+	if d.pos != len(d.body) {
+		return nil, fmt.Errorf("%w: %v has trailing bytes", ErrMalformed, kind)
+	}
+	return packet, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decoder reads the fields of a packet body and remembers if it ran out of bytes
+type decoder struct {
+	body []byte
+	pos  int
+	err  error
+	v5   bool // If the body has the mqtt 5 format
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || d.pos+n > len(d.body) {
+		d.err = ErrMalformed
+		return make([]byte, n)
+	}
+	field := d.body[d.pos : d.pos+n]
+	d.pos += n
+	return field
+}
+
+func (d *decoder) byte() byte {
+	return d.next(1)[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	return binary.BigEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) uint32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+// varint reads a variable byte integer of at most four bytes
+func (d *decoder) varint() uint32 {
+	var value uint32
+	for i := uint(0); i < 4; i++ {
+		digit := d.byte()
+		value |= uint32(digit&127) << (7 * i)
+		if digit&128 == 0 {
+			return value
+		}
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: variable byte integer longer than four bytes", ErrMalformed)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	field := d.next(int(d.uint16()))
+	return append([]byte{}, field...)
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+func (d *decoder) rest() []byte {
+	return append([]byte{}, d.next(len(d.body)-d.pos)...)
+}
+
+func (d *decoder) remaining() bool {
+	return d.err == nil && d.pos < len(d.body)
+}
+
+// encoder writes the fields of a packet body and remembers if one of them was too long
+type encoder struct {
+	bytes.Buffer
+	err error
+	v5  bool // If the body has the mqtt 5 format
+}
+
+func (e *encoder) uint16(value uint16) {
+	e.WriteByte(byte(value >> 8))
+	e.WriteByte(byte(value))
+}
+
+func (e *encoder) uint32(value uint32) {
+	e.uint16(uint16(value >> 16))
+	e.uint16(uint16(value))
+}
+
+// varint writes a variable byte integer, the value must not be larger than MaxLength
+func (e *encoder) varint(value uint32) {
+	for {
+		digit := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			digit |= 128
+		}
+		e.WriteByte(digit)
+		if value == 0 {
+			return
+		}
+	}
+}
+
+func (e *encoder) bytes(value []byte) {
+	if len(value) > 65535 {
+		e.err = fmt.Errorf("%w: field of %v bytes", ErrTooLarge, len(value))
+		return
+	}
+	e.uint16(uint16(len(value)))
+	e.Write(value)
+}
+
+func (e *encoder) string(value string) {
+	e.bytes([]byte(value))
+}
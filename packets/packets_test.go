@@ -0,0 +1,249 @@
+package packets_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+func roundTrip(t *testing.T, packet packets.Packet) {
+	roundTripCodec(t, packets.Codec{}, packet)
+}
+
+func roundTripCodec(t *testing.T, codec packets.Codec, packet packets.Packet) {
+	var buffer bytes.Buffer
+	err := codec.Write(&buffer, packet)
+	if err != nil {
+		t.Fatalf("writing %v should not have failed: %v", packet.Type(), err)
+	}
+	decoded, err := codec.Read(&buffer)
+	if err != nil {
+		t.Fatalf("reading %v should not have failed: %v", packet.Type(), err)
+	}
+	if !reflect.DeepEqual(decoded, packet) {
+		t.Fatalf("%v should have been %#v but was %#v", packet.Type(), packet, decoded)
+	}
+	if buffer.Len() != 0 {
+		t.Fatalf("reading %v should have consumed all bytes but left %v", packet.Type(), buffer.Len())
+	}
+}
+
+// TestRoundTrip checks that every packet type is decoded to what was encoded
+func TestRoundTrip(t *testing.T) {
+	username := "user"
+	for _, packet := range []packets.Packet{
+		&packets.Connect{ProtocolName: packets.ProtocolNameV311, ProtocolLevel: packets.ProtocolLevelV311, CleanSession: true, KeepAlive: 30, ClientID: "client"},
+		&packets.Connect{
+			ProtocolName:  packets.ProtocolNameV31,
+			ProtocolLevel: packets.ProtocolLevelV31,
+			KeepAlive:     60,
+			ClientID:      "client",
+			Will:          &packets.Will{Topic: "will", Payload: []byte("gone"), QOS: 2, Retain: true},
+			Username:      &username,
+			Password:      []byte("secret"),
+		},
+		&packets.Connack{SessionPresent: true, ReturnCode: packets.Accepted},
+		&packets.Connack{ReturnCode: packets.NotAuthorized},
+		&packets.Publish{Topic: "a/b", Payload: []byte("hello")},
+		&packets.Publish{Dup: true, QOS: 2, Retain: true, Topic: "a/b", PacketID: 7, Payload: []byte{}},
+		&packets.Puback{PacketID: 1},
+		&packets.Pubrec{PacketID: 2},
+		&packets.Pubrel{PacketID: 3},
+		&packets.Pubcomp{PacketID: 65535},
+		&packets.Subscribe{PacketID: 4, Subscriptions: []packets.Subscription{{Topic: "a/#", QOS: 1}, {Topic: "b/+", QOS: 2}}},
+		&packets.Suback{PacketID: 4, ReturnCodes: []byte{1, packets.SubackFailure}},
+		&packets.Unsubscribe{PacketID: 5, Topics: []string{"a/#", "b/+"}},
+		&packets.Unsuback{PacketID: 5},
+		&packets.Pingreq{},
+		&packets.Pingresp{},
+		&packets.Disconnect{},
+	} {
+		roundTrip(t, packet)
+	}
+}
+
+// TestRoundTripV5 checks that the reason codes, properties and subscription options of mqtt 5 are decoded to what
+// was encoded
+func TestRoundTripV5(t *testing.T) {
+	expiry, alias, maximum, format := uint32(60), uint16(3), uint16(10), byte(1)
+	user := []packets.UserProperty{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}}
+	codec := packets.Codec{Level: packets.ProtocolLevelV5}
+	for _, packet := range []packets.Packet{
+		&packets.Connect{
+			ProtocolName:  packets.ProtocolNameV5,
+			ProtocolLevel: packets.ProtocolLevelV5,
+			KeepAlive:     30,
+			ClientID:      "client",
+			Will:          &packets.Will{Topic: "will", Payload: []byte("gone"), QOS: 1, Properties: packets.Properties{ContentType: "text/plain", WillDelay: &expiry}},
+			Properties:    packets.Properties{SessionExpiry: &expiry, TopicAliasMaximum: &maximum, UserProperties: user},
+		},
+		&packets.Connack{SessionPresent: true, Properties: packets.Properties{AssignedClientID: "assigned", ReceiveMaximum: &maximum}},
+		&packets.Connack{ReturnCode: 0x87, Properties: packets.Properties{ReasonString: "not authorized"}},
+		&packets.Publish{
+			QOS:      1,
+			Topic:    "a/b",
+			PacketID: 7,
+			Properties: packets.Properties{
+				PayloadFormat:           &format,
+				MessageExpiry:           &expiry,
+				ContentType:             "application/json",
+				ResponseTopic:           "reply",
+				CorrelationData:         []byte{1, 2},
+				SubscriptionIdentifiers: []uint32{1, 268435455},
+				TopicAlias:              &alias,
+				UserProperties:          user,
+			},
+			Payload: []byte("{}"),
+		},
+		&packets.Puback{PacketID: 1},
+		&packets.Puback{PacketID: 1, ReasonCode: 0x10},
+		&packets.Pubrec{PacketID: 2, ReasonCode: 0x80, Properties: packets.Properties{ReasonString: "failed"}},
+		&packets.Pubrel{PacketID: 3, ReasonCode: 0x92},
+		&packets.Pubcomp{PacketID: 4},
+		&packets.Subscribe{
+			PacketID:   5,
+			Properties: packets.Properties{SubscriptionIdentifiers: []uint32{1}},
+			Subscriptions: []packets.Subscription{
+				{Topic: "a/#", QOS: 1, NoLocal: true},
+				{Topic: "b/+", QOS: 2, RetainAsPublished: true, RetainHandling: 2},
+			},
+		},
+		&packets.Suback{PacketID: 5, ReturnCodes: []byte{1, 0x87}, Properties: packets.Properties{ReasonString: "denied"}},
+		&packets.Unsubscribe{PacketID: 6, Topics: []string{"a/#"}, Properties: packets.Properties{UserProperties: user}},
+		&packets.Unsuback{PacketID: 6, ReasonCodes: []byte{0x00, 0x11}},
+		&packets.Disconnect{},
+		&packets.Disconnect{ReasonCode: 0x8e, Properties: packets.Properties{ReasonString: "session taken over"}},
+	} {
+		roundTripCodec(t, codec, packet)
+	}
+}
+
+// TestEncodeV5 checks the exact bytes of mqtt 5 packets, acknowledgements leave out a success reason code
+func TestEncodeV5(t *testing.T) {
+	codec := packets.Codec{Level: packets.ProtocolLevelV5}
+	alias := uint16(1)
+	for _, c := range []struct {
+		packet   packets.Packet
+		expected []byte
+	}{
+		{&packets.Puback{PacketID: 10}, []byte{0x40, 0x02, 0x00, 0x0a}},
+		{&packets.Puback{PacketID: 10, ReasonCode: 0x10}, []byte{0x40, 0x04, 0x00, 0x0a, 0x10, 0x00}},
+		{&packets.Disconnect{}, []byte{0xe0, 0x00}},
+		{&packets.Publish{Topic: "a", Properties: packets.Properties{TopicAlias: &alias}, Payload: []byte("hi")}, []byte{0x30, 0x09, 0x00, 0x01, 'a', 0x03, 0x23, 0x00, 0x01, 'h', 'i'}},
+	} {
+		encoded, err := codec.Encode(c.packet)
+		if err != nil {
+			t.Fatalf("encoding should not have failed: %v", err)
+		}
+		if !bytes.Equal(encoded, c.expected) {
+			t.Fatalf("%v should have been encoded as %v but was %v", c.packet.Type(), c.expected, encoded)
+		}
+	}
+}
+
+// TestLargePublish checks that remaining lengths that need multiple bytes are encoded correctly
+func TestLargePublish(t *testing.T) {
+	for _, size := range []int{127, 128, 16383, 16384, 2097152} {
+		roundTrip(t, &packets.Publish{QOS: 1, Topic: "large", PacketID: 1, Payload: make([]byte, size)})
+	}
+}
+
+// TestEncode checks the exact bytes of a publish
+func TestEncode(t *testing.T) {
+	encoded, err := packets.Encode(&packets.Publish{QOS: 1, Retain: true, Topic: "a", PacketID: 10, Payload: []byte("hi")})
+	if err != nil {
+		t.Fatalf("encoding should not have failed: %v", err)
+	}
+	expected := []byte{0x33, 0x07, 0x00, 0x01, 'a', 0x00, 0x0a, 'h', 'i'}
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("publish should have been encoded as %v but was %v", expected, encoded)
+	}
+}
+
+// TestTooLongTopic checks that fields longer than a length prefix allows are rejected
+func TestTooLongTopic(t *testing.T) {
+	_, err := packets.Encode(&packets.Publish{Topic: string(make([]byte, 65536))})
+	if !errors.Is(err, packets.ErrTooLarge) {
+		t.Fatalf("encoding should have failed with ErrTooLarge: %v", err)
+	}
+}
+
+// TestMaxSize checks that packets larger than the maximum size are rejected before their body is allocated
+func TestMaxSize(t *testing.T) {
+	// a publish announcing the largest remaining length without sending a body
+	_, err := packets.Read(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0x7f}))
+	if !errors.Is(err, packets.ErrTooLarge) {
+		t.Fatalf("reading should have failed with ErrTooLarge: %v", err)
+	}
+
+	encoded, err := packets.Encode(&packets.Publish{Topic: "a", Payload: make([]byte, 100)})
+	if err != nil {
+		t.Fatalf("encoding should not have failed: %v", err)
+	}
+	if _, err := (packets.Codec{MaxSize: len(encoded)}).Read(bytes.NewReader(encoded)); err != nil {
+		t.Fatalf("a packet of the maximum size should have been read: %v", err)
+	}
+	_, err = packets.Codec{MaxSize: len(encoded) - 1}.Read(bytes.NewReader(encoded))
+	if !errors.Is(err, packets.ErrTooLarge) {
+		t.Fatalf("reading should have failed with ErrTooLarge: %v", err)
+	}
+}
+
+// TestMalformed checks that invalid packets are rejected
+func TestMalformed(t *testing.T) {
+	for name, encoded := range map[string][]byte{
+		"unknown type":      {0x00, 0x00},
+		"short puback":      {0x40, 0x01, 0x00},
+		"trailing bytes":    {0x40, 0x03, 0x00, 0x01, 0x02},
+		"qos 3":             {0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},
+		"long length":       {0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"short topic":       {0x30, 0x03, 0x00, 0x05, 'a'},
+		"short connect":     {0x10, 0x02, 0x00, 0x04},
+		"short connack":     {0x20, 0x01, 0x00},
+		"short subscribe":   {0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'},
+		"empty pubrel":      {0x62, 0x00},
+		"empty unsuback":    {0xb0, 0x00},
+		"empty suback":      {0x90, 0x00},
+		"empty pubcomp":     {0x70, 0x00},
+		"empty pubrec":      {0x50, 0x00},
+		"short unsubscribe": {0xa2, 0x03, 0x00, 0x01, 0x00},
+	} {
+		_, err := packets.Read(bytes.NewReader(encoded))
+		if !errors.Is(err, packets.ErrMalformed) {
+			t.Fatalf("reading a packet with %v should have failed with ErrMalformed: %v", name, err)
+		}
+	}
+}
+
+// TestMalformedV5 checks that invalid mqtt 5 properties are rejected
+func TestMalformedV5(t *testing.T) {
+	codec := packets.Codec{Level: packets.ProtocolLevelV5}
+	for name, encoded := range map[string][]byte{
+		"unknown property":           {0x40, 0x06, 0x00, 0x01, 0x00, 0x02, 0x7f, 0x00},
+		"long properties":            {0x40, 0x05, 0x00, 0x01, 0x00, 0x05, 0x1f},
+		"short property":             {0x40, 0x06, 0x00, 0x01, 0x00, 0x02, 0x21, 0x00},
+		"long varint":                {0x40, 0x08, 0x00, 0x01, 0x00, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"publish without properties": {0x30, 0x03, 0x00, 0x01, 'a'},
+	} {
+		_, err := codec.Read(bytes.NewReader(encoded))
+		if !errors.Is(err, packets.ErrMalformed) {
+			t.Fatalf("reading a packet with %v should have failed with ErrMalformed: %v", name, err)
+		}
+	}
+}
+
+// TestTruncated checks that a packet that ends early is reported as an unexpected EOF
+func TestTruncated(t *testing.T) {
+	_, err := packets.Read(bytes.NewReader([]byte{0x30, 0x05, 0x00}))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("reading should have failed with io.ErrUnexpectedEOF: %v", err)
+	}
+	_, err = packets.Read(bytes.NewReader([]byte{}))
+	if err != io.EOF {
+		t.Fatalf("reading should have failed with io.EOF: %v", err)
+	}
+}
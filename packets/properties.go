@@ -0,0 +1,265 @@
+package packets
+
+import "fmt"
+
+// Identifiers of the mqtt 5 properties
+const (
+	propertyPayloadFormat                   = 0x01
+	propertyMessageExpiry                   = 0x02
+	propertyContentType                     = 0x03
+	propertyResponseTopic                   = 0x08
+	propertyCorrelationData                 = 0x09
+	propertySubscriptionIdentifier          = 0x0B
+	propertySessionExpiry                   = 0x11
+	propertyAssignedClientID                = 0x12
+	propertyServerKeepAlive                 = 0x13
+	propertyAuthenticationMethod            = 0x15
+	propertyAuthenticationData              = 0x16
+	propertyRequestProblemInformation       = 0x17
+	propertyWillDelay                       = 0x18
+	propertyRequestResponseInformation      = 0x19
+	propertyResponseInformation             = 0x1A
+	propertyServerReference                 = 0x1C
+	propertyReasonString                    = 0x1F
+	propertyReceiveMaximum                  = 0x21
+	propertyTopicAliasMaximum               = 0x22
+	propertyTopicAlias                      = 0x23
+	propertyMaximumQOS                      = 0x24
+	propertyRetainAvailable                 = 0x25
+	propertyUserProperty                    = 0x26
+	propertyMaximumPacketSize               = 0x27
+	propertyWildcardSubscriptionAvailable   = 0x28
+	propertySubscriptionIdentifierAvailable = 0x29
+	propertySharedSubscriptionAvailable     = 0x2A
+)
+
+// UserProperty is an application defined key value pair, a key can occur more than once
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties are the optional fields of mqtt 5 packets. Every packet type allows only some of them, nil and
+// empty fields are not sent. Packets of 3.1 and 3.1.1 have no properties.
+type Properties struct {
+	PayloadFormat                   *byte    // Publish and will: 1 if the payload is utf-8
+	MessageExpiry                   *uint32  // Publish and will: seconds until the message expires
+	ContentType                     string   // Publish and will
+	ResponseTopic                   string   // Publish and will
+	CorrelationData                 []byte   // Publish and will
+	SubscriptionIdentifiers         []uint32 // Publish and subscribe
+	SessionExpiry                   *uint32  // Connect, connack and disconnect: seconds the session is kept after disconnecting
+	AssignedClientID                string   // Connack
+	ServerKeepAlive                 *uint16  // Connack: the keepalive the client has to use
+	AuthenticationMethod            string   // Connect and connack
+	AuthenticationData              []byte   // Connect and connack
+	RequestProblemInformation       *byte    // Connect
+	WillDelay                       *uint32  // Will: seconds the will is delayed after the connection is lost
+	RequestResponseInformation      *byte    // Connect
+	ResponseInformation             string   // Connack
+	ServerReference                 string   // Connack and disconnect: another server to use
+	ReasonString                    string   // Connack, acknowledgements and disconnect
+	ReceiveMaximum                  *uint16  // Connect and connack: how many QoS 1 and 2 publishes may be in flight
+	TopicAliasMaximum               *uint16  // Connect and connack: the highest topic alias the sender accepts
+	TopicAlias                      *uint16  // Publish
+	MaximumQOS                      *byte    // Connack
+	RetainAvailable                 *byte    // Connack
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32 // Connect and connack: the largest packet the sender accepts
+	WildcardSubscriptionAvailable   *byte   // Connack
+	SubscriptionIdentifierAvailable *byte   // Connack
+	SharedSubscriptionAvailable     *byte   // Connack
+}
+
+// properties writes the properties with their length in front, only for mqtt 5
+func (e *encoder) properties(p *Properties) {
+	if !e.v5 {
+		return
+	}
+	body := encoder{v5: true}
+	body.propertyByte(propertyPayloadFormat, p.PayloadFormat)
+	if p.MessageExpiry != nil {
+		body.WriteByte(propertyMessageExpiry)
+		body.uint32(*p.MessageExpiry)
+	}
+	body.propertyString(propertyContentType, p.ContentType)
+	body.propertyString(propertyResponseTopic, p.ResponseTopic)
+	body.propertyBytes(propertyCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		body.WriteByte(propertySubscriptionIdentifier)
+		body.varint(id)
+	}
+	if p.SessionExpiry != nil {
+		body.WriteByte(propertySessionExpiry)
+		body.uint32(*p.SessionExpiry)
+	}
+	body.propertyString(propertyAssignedClientID, p.AssignedClientID)
+	body.propertyUint16(propertyServerKeepAlive, p.ServerKeepAlive)
+	body.propertyString(propertyAuthenticationMethod, p.AuthenticationMethod)
+	body.propertyBytes(propertyAuthenticationData, p.AuthenticationData)
+	body.propertyByte(propertyRequestProblemInformation, p.RequestProblemInformation)
+	if p.WillDelay != nil {
+		body.WriteByte(propertyWillDelay)
+		body.uint32(*p.WillDelay)
+	}
+	body.propertyByte(propertyRequestResponseInformation, p.RequestResponseInformation)
+	body.propertyString(propertyResponseInformation, p.ResponseInformation)
+	body.propertyString(propertyServerReference, p.ServerReference)
+	body.propertyString(propertyReasonString, p.ReasonString)
+	body.propertyUint16(propertyReceiveMaximum, p.ReceiveMaximum)
+	body.propertyUint16(propertyTopicAliasMaximum, p.TopicAliasMaximum)
+	body.propertyUint16(propertyTopicAlias, p.TopicAlias)
+	body.propertyByte(propertyMaximumQOS, p.MaximumQOS)
+	body.propertyByte(propertyRetainAvailable, p.RetainAvailable)
+	for _, property := range p.UserProperties {
+		body.WriteByte(propertyUserProperty)
+		body.string(property.Key)
+		body.string(property.Value)
+	}
+	if p.MaximumPacketSize != nil {
+		body.WriteByte(propertyMaximumPacketSize)
+		body.uint32(*p.MaximumPacketSize)
+	}
+	body.propertyByte(propertyWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	body.propertyByte(propertySubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	body.propertyByte(propertySharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+
+	if body.err != nil && e.err == nil {
+		e.err = body.err
+	}
+	e.varint(uint32(body.Len()))
+	e.Write(body.Bytes())
+}
+
+func (e *encoder) propertyByte(id byte, value *byte) {
+	if value != nil {
+		e.WriteByte(id)
+		e.WriteByte(*value)
+	}
+}
+
+func (e *encoder) propertyUint16(id byte, value *uint16) {
+	if value != nil {
+		e.WriteByte(id)
+		e.uint16(*value)
+	}
+}
+
+func (e *encoder) propertyString(id byte, value string) {
+	if value != "" {
+		e.WriteByte(id)
+		e.string(value)
+	}
+}
+
+func (e *encoder) propertyBytes(id byte, value []byte) {
+	if value != nil {
+		e.WriteByte(id)
+		e.bytes(value)
+	}
+}
+
+// empty is true if none of the properties is set, so they take up a single byte
+func (p *Properties) empty() bool {
+	e := encoder{v5: true}
+	e.properties(p)
+	return e.Len() == 1
+}
+
+// properties reads the properties with their length in front, only for mqtt 5
+func (d *decoder) properties() Properties {
+	var p Properties
+	if !d.v5 {
+		return p
+	}
+	length := d.varint()
+	if d.err != nil {
+		return p
+	}
+	if int(length) > len(d.body)-d.pos {
+		d.err = ErrMalformed
+		return p
+	}
+	body := &decoder{body: d.next(int(length)), v5: true}
+	for body.remaining() {
+		switch id := body.varint(); id {
+		case propertyPayloadFormat:
+			p.PayloadFormat = body.propertyByte()
+		case propertyMessageExpiry:
+			p.MessageExpiry = body.propertyUint32()
+		case propertyContentType:
+			p.ContentType = body.string()
+		case propertyResponseTopic:
+			p.ResponseTopic = body.string()
+		case propertyCorrelationData:
+			p.CorrelationData = body.bytes()
+		case propertySubscriptionIdentifier:
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, body.varint())
+		case propertySessionExpiry:
+			p.SessionExpiry = body.propertyUint32()
+		case propertyAssignedClientID:
+			p.AssignedClientID = body.string()
+		case propertyServerKeepAlive:
+			p.ServerKeepAlive = body.propertyUint16()
+		case propertyAuthenticationMethod:
+			p.AuthenticationMethod = body.string()
+		case propertyAuthenticationData:
+			p.AuthenticationData = body.bytes()
+		case propertyRequestProblemInformation:
+			p.RequestProblemInformation = body.propertyByte()
+		case propertyWillDelay:
+			p.WillDelay = body.propertyUint32()
+		case propertyRequestResponseInformation:
+			p.RequestResponseInformation = body.propertyByte()
+		case propertyResponseInformation:
+			p.ResponseInformation = body.string()
+		case propertyServerReference:
+			p.ServerReference = body.string()
+		case propertyReasonString:
+			p.ReasonString = body.string()
+		case propertyReceiveMaximum:
+			p.ReceiveMaximum = body.propertyUint16()
+		case propertyTopicAliasMaximum:
+			p.TopicAliasMaximum = body.propertyUint16()
+		case propertyTopicAlias:
+			p.TopicAlias = body.propertyUint16()
+		case propertyMaximumQOS:
+			p.MaximumQOS = body.propertyByte()
+		case propertyRetainAvailable:
+			p.RetainAvailable = body.propertyByte()
+		case propertyUserProperty:
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: body.string(), Value: body.string()})
+		case propertyMaximumPacketSize:
+			p.MaximumPacketSize = body.propertyUint32()
+		case propertyWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable = body.propertyByte()
+		case propertySubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable = body.propertyByte()
+		case propertySharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable = body.propertyByte()
+		default:
+			if body.err == nil {
+				body.err = fmt.Errorf("%w: unknown property %#x", ErrMalformed, id)
+			}
+		}
+	}
+	if body.err != nil {
+		d.err = body.err
+	}
+	return p
+}
+
+func (d *decoder) propertyByte() *byte {
+	value := d.byte()
+	return &value
+}
+
+func (d *decoder) propertyUint16() *uint16 {
+	value := d.uint16()
+	return &value
+}
+
+func (d *decoder) propertyUint32() *uint32 {
+	value := d.uint32()
+	return &value
+}
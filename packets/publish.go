@@ -0,0 +1,130 @@
+package packets
+
+import "fmt"
+
+// Publish carries an application message in either direction
+type Publish struct {
+	Dup        bool
+	QOS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16 // Only set for QoS 1 and 2
+	Properties Properties
+	Payload    []byte
+}
+
+// Type of the packet
+func (p *Publish) Type() Type { return TypePublish }
+
+func (p *Publish) encode(e *encoder) byte {
+	e.string(p.Topic)
+	if p.QOS > 0 {
+		e.uint16(p.PacketID)
+	}
+	e.properties(&p.Properties)
+	e.Write(p.Payload)
+
+	flags := p.QOS << 1
+	if p.Dup {
+		flags |= 0x08
+	}
+	if p.Retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+func decodePublish(d *decoder, flags byte) Packet {
+	p := &Publish{Dup: flags&0x08 != 0, QOS: flags >> 1 & 0x03, Retain: flags&0x01 != 0}
+	if p.QOS == 3 {
+		d.err = fmt.Errorf("%w: QoS 3", ErrMalformed)
+	}
+	p.Topic = d.string()
+	if p.QOS > 0 {
+		p.PacketID = d.uint16()
+	}
+	p.Properties = d.properties()
+	p.Payload = d.rest()
+	return p
+}
+
+// encodeAck writes the packet id of an acknowledgement. Mqtt 5 adds the reason code and the properties, which are
+// left out if the reason code is success and there are no properties.
+func encodeAck(e *encoder, id uint16, code byte, properties *Properties) {
+	e.uint16(id)
+	if e.v5 && (code != 0 || !properties.empty()) {
+		e.WriteByte(code)
+		e.properties(properties)
+	}
+}
+
+func decodeAck(d *decoder) (id uint16, code byte, properties Properties) {
+	id = d.uint16()
+	if d.v5 && d.remaining() {
+		code = d.byte()
+		if d.remaining() {
+			properties = d.properties()
+		}
+	}
+	return id, code, properties
+}
+
+// Puback acknowledges a QoS 1 publish
+type Puback struct {
+	PacketID   uint16
+	ReasonCode byte // Only sent with mqtt 5
+	Properties Properties
+}
+
+// Type of the packet
+func (p *Puback) Type() Type { return TypePuback }
+
+func (p *Puback) encode(e *encoder) byte {
+	encodeAck(e, p.PacketID, p.ReasonCode, &p.Properties)
+	return 0
+}
+
+// Pubrec is the first acknowledgement of a QoS 2 publish
+type Pubrec struct {
+	PacketID   uint16
+	ReasonCode byte // Only sent with mqtt 5
+	Properties Properties
+}
+
+// Type of the packet
+func (p *Pubrec) Type() Type { return TypePubrec }
+
+func (p *Pubrec) encode(e *encoder) byte {
+	encodeAck(e, p.PacketID, p.ReasonCode, &p.Properties)
+	return 0
+}
+
+// Pubrel releases a QoS 2 publish after it was received
+type Pubrel struct {
+	PacketID   uint16
+	ReasonCode byte // Only sent with mqtt 5
+	Properties Properties
+}
+
+// Type of the packet
+func (p *Pubrel) Type() Type { return TypePubrel }
+
+func (p *Pubrel) encode(e *encoder) byte {
+	encodeAck(e, p.PacketID, p.ReasonCode, &p.Properties)
+	return 0x02
+}
+
+// Pubcomp completes a QoS 2 publish
+type Pubcomp struct {
+	PacketID   uint16
+	ReasonCode byte // Only sent with mqtt 5
+	Properties Properties
+}
+
+// Type of the packet
+func (p *Pubcomp) Type() Type { return TypePubcomp }
+
+func (p *Pubcomp) encode(e *encoder) byte {
+	encodeAck(e, p.PacketID, p.ReasonCode, &p.Properties)
+	return 0
+}
@@ -0,0 +1,143 @@
+package packets
+
+// SubackFailure is the return code of a subscription the broker rejected, with mqtt 5 every reason code from
+// SubackFailure on is a failure
+const SubackFailure byte = 0x80
+
+// Subscription is a topic filter with the maximum QoS of the messages that should be sent for it. The other
+// options are only sent with mqtt 5.
+type Subscription struct {
+	Topic             string
+	QOS               byte
+	NoLocal           bool // Messages published by the client itself are not sent to it
+	RetainAsPublished bool // The retain flag of forwarded messages is kept instead of cleared
+	RetainHandling    byte // 0 sends retained messages on every subscribe, 1 only on new subscriptions and 2 never
+}
+
+// Subscribe asks the broker to send the messages of one or more topic filters
+type Subscribe struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+// Type of the packet
+func (p *Subscribe) Type() Type { return TypeSubscribe }
+
+func (p *Subscribe) encode(e *encoder) byte {
+	e.uint16(p.PacketID)
+	e.properties(&p.Properties)
+	for _, subscription := range p.Subscriptions {
+		e.string(subscription.Topic)
+		options := subscription.QOS
+		if e.v5 {
+			if subscription.NoLocal {
+				options |= 0x04
+			}
+			if subscription.RetainAsPublished {
+				options |= 0x08
+			}
+			options |= subscription.RetainHandling << 4
+		}
+		e.WriteByte(options)
+	}
+	return 0x02
+}
+
+func decodeSubscribe(d *decoder) Packet {
+	p := &Subscribe{PacketID: d.uint16()}
+	p.Properties = d.properties()
+	for d.remaining() {
+		subscription := Subscription{Topic: d.string()}
+		options := d.byte()
+		subscription.QOS = options
+		if d.v5 {
+			subscription.QOS = options & 0x03
+			subscription.NoLocal = options&0x04 != 0
+			subscription.RetainAsPublished = options&0x08 != 0
+			subscription.RetainHandling = options >> 4 & 0x03
+		}
+		p.Subscriptions = append(p.Subscriptions, subscription)
+	}
+	return p
+}
+
+// Suback is the response to a subscribe with the granted QoS or a failure for every subscription
+type Suback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReturnCodes []byte // The reason codes with mqtt 5
+}
+
+// Type of the packet
+func (p *Suback) Type() Type { return TypeSuback }
+
+func (p *Suback) encode(e *encoder) byte {
+	e.uint16(p.PacketID)
+	e.properties(&p.Properties)
+	e.Write(p.ReturnCodes)
+	return 0
+}
+
+func decodeSuback(d *decoder) Packet {
+	p := &Suback{PacketID: d.uint16()}
+	p.Properties = d.properties()
+	p.ReturnCodes = d.rest()
+	return p
+}
+
+// Unsubscribe asks the broker to stop sending the messages of one or more topic filters
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties Properties
+	Topics     []string
+}
+
+// Type of the packet
+func (p *Unsubscribe) Type() Type { return TypeUnsubscribe }
+
+func (p *Unsubscribe) encode(e *encoder) byte {
+	e.uint16(p.PacketID)
+	e.properties(&p.Properties)
+	for _, topic := range p.Topics {
+		e.string(topic)
+	}
+	return 0x02
+}
+
+func decodeUnsubscribe(d *decoder) Packet {
+	p := &Unsubscribe{PacketID: d.uint16()}
+	p.Properties = d.properties()
+	for d.remaining() {
+		p.Topics = append(p.Topics, d.string())
+	}
+	return p
+}
+
+// Unsuback is the response to an unsubscribe
+type Unsuback struct {
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []byte // The reason code of every topic, only sent with mqtt 5
+}
+
+// Type of the packet
+func (p *Unsuback) Type() Type { return TypeUnsuback }
+
+func (p *Unsuback) encode(e *encoder) byte {
+	e.uint16(p.PacketID)
+	if e.v5 {
+		e.properties(&p.Properties)
+		e.Write(p.ReasonCodes)
+	}
+	return 0
+}
+
+func decodeUnsuback(d *decoder) Packet {
+	p := &Unsuback{PacketID: d.uint16()}
+	if d.v5 {
+		p.Properties = d.properties()
+		p.ReasonCodes = d.rest()
+	}
+	return p
+}
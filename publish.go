@@ -3,15 +3,86 @@ package mqtt
 import (
 	"context"
 	"encoding/json"
+	"time"
 )
 
-// PublishOption are extra options when publishing a message
-type PublishOption int
+// PublishOption sets an extra option when publishing a message
+type PublishOption func(*publishOptions)
 
-const (
-	// Retain tells the broker to retain a message and send it as the first message to new subscribers.
-	Retain PublishOption = iota
-)
+type publishOptions struct {
+	retained bool
+	expiry   time.Duration
+	properties
+}
+
+func newPublishOptions(options []PublishOption) publishOptions {
+	var o publishOptions
+	for _, option := range options {
+		option(&o)
+	}
+	return o
+}
+
+// Retain tells the broker to retain a message and send it as the first message to new subscribers, it is the same
+// as WithRetain().
+var Retain = WithRetain()
+
+// WithRetain tells the broker to retain a message and send it as the first message to new subscribers
+func WithRetain() PublishOption {
+	return func(o *publishOptions) {
+		o.retained = true
+	}
+}
+
+// WithExpiry drops the message instead of sending it if it is still in the offline queue or the outbox after the
+// duration. With mqtt 5 the time that is left is sent as the message expiry, so the broker drops the message too
+// if it is not delivered in time.
+func WithExpiry(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.expiry = d
+	}
+}
+
+// WithContentType describes the content of the payload, for example as a mime type. This and the options below
+// are sent as publish properties with mqtt 5. Mqtt 3.1 and 3.1.1 have no properties, there they need the Envelope
+// option, which changes the payload format, or else the publish fails with ErrPropertiesUnsupported.
+func WithContentType(contentType string) PublishOption {
+	return func(o *publishOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithUserProperty adds a key value pair to the message, it can be used multiple times
+func WithUserProperty(key, value string) PublishOption {
+	return func(o *publishOptions) {
+		if o.userProperties == nil {
+			o.userProperties = map[string]string{}
+		}
+		o.userProperties[key] = value
+	}
+}
+
+// WithResponseTopic tells the receiver of a request which topic to publish the response on
+func WithResponseTopic(topic string) PublishOption {
+	return func(o *publishOptions) {
+		o.responseTopic = topic
+	}
+}
+
+// WithCorrelationData is sent back with the response to a request, so the requester can match them
+func WithCorrelationData(data []byte) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationData = data
+	}
+}
+
+// WithDedupKey identifies the message, a client ignores a message if it recently received one with the same key.
+// This removes the duplicates of QoS 1 redeliveries and of publishes that were retried.
+func WithDedupKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.dedupKey = key
+	}
+}
 
 // Publish a message with a byte array payload
 func (c *Client) Publish(ctx context.Context, topic string, payload []byte, qos QOS, options ...PublishOption) error {
@@ -33,14 +104,123 @@ func (c *Client) PublishJSON(ctx context.Context, topic string, payload interfac
 }
 
 func (c *Client) publish(ctx context.Context, topic string, payload []byte, qos QOS, options []PublishOption) error {
-	var retained = false
-	for _, option := range options {
-		switch option {
-		case Retain:
-			retained = true
+	return tokenWithContext(ctx, c.send(ctx, topic, payload, qos, options))
+}
+
+// send publishes a message without waiting for the broker. The token completes once the broker acknowledged the
+// message, it was queued or it failed.
+func (c *Client) send(ctx context.Context, topic string, payload []byte, qos QOS, options []PublishOption) *token {
+	o := newPublishOptions(options)
+	var span Span
+	if c.tracer != nil {
+		ctx, span = c.startPublish(ctx, topic, &o)
+	}
+	message := queuedMessage{topic: topic, payload: payload, qos: qos, retained: o.retained, queued: time.Now()}
+	if o.expiry > 0 {
+		message.expires = message.queued.Add(o.expiry)
+	}
+	var token *token
+	switch {
+	case c.Options.ProtocolVersion == ProtocolV5:
+		message.properties = o.properties
+	case o.empty():
+	case c.Options.Envelope:
+		message.payload = wrap(o.properties, payload)
+	default:
+		token = failedToken(ErrPropertiesUnsupported)
+	}
+	if token == nil {
+		token = c.deliver(ctx, message)
+	}
+	if span != nil {
+		token.then(func() {
+			if err := token.Error(); err != nil {
+				span.RecordError(err)
+			}
+			span.End()
+		})
+	}
+	return token
+}
+
+// deliver journals the message in the outbox and queues it while offline or sends it to the broker
+func (c *Client) deliver(ctx context.Context, message queuedMessage) *token {
+	if !c.inflight.acquire() {
+		return failedToken(ErrDisconnected)
+	}
+	if c.outbox != nil {
+		entry, err := c.outbox.add(message)
+		if err != nil {
+			c.inflight.release()
+			return failedToken(err)
+		}
+		message.entry = entry
+	}
+	if c.queue != nil {
+		queued, err := c.queue.enqueue(message)
+		if err != nil {
+			c.drop(message)
+		}
+		if queued || err != nil {
+			c.inflight.release()
+			return failedToken(err)
 		}
+	} else if err := c.awaitReconnect(ctx); err != nil {
+		// the message was not sent yet, so it is not published later either
+		c.drop(message)
+		c.inflight.release()
+		return failedToken(&CanceledError{Err: err})
 	}
+	token := c.core.publish(ctx, message.topic, byte(message.qos), message.retained, message.payload, message.publishProperties())
+	c.settle(token, message, true)
+	if message.entry != 0 {
+		return journaled(token)
+	}
+	return token
+}
+
+// PublishAsync publishes a message without waiting for the broker to acknowledge it, so QoS 1 and 2 messages are
+// pipelined. It only blocks while the client reconnects, while the message is written and while MaxInflight
+// messages wait for their acknowledgement, the context limits that. The delivery completes once the broker acknowledged the message, QoS 0 messages once they were written
+// and messages in the offline queue once they were queued.
+func (c *Client) PublishAsync(ctx context.Context, topic string, payload []byte, qos QOS, options ...PublishOption) *Delivery {
+	delivery := &Delivery{token: c.send(ctx, topic, payload, qos, options), topic: topic}
+	if c.Options.OnDelivery != nil {
+		delivery.token.then(func() {
+			go c.Options.OnDelivery(delivery)
+		})
+	}
+	return delivery
+}
+
+// A Delivery tracks a message published with PublishAsync
+type Delivery struct {
+	token *token
+	topic string
+}
 
-	token := c.client.Publish(topic, byte(qos), retained, payload)
-	return tokenWithContext(ctx, token)
+// Topic is the topic the message was published on
+func (d *Delivery) Topic() string {
+	return d.topic
+}
+
+// Done is closed once the delivery completed
+func (d *Delivery) Done() <-chan struct{} {
+	return d.token.Done()
+}
+
+// Err returns the error of the delivery once it completed, nil if it succeeded or did not complete yet
+func (d *Delivery) Err() error {
+	return d.token.Error()
+}
+
+// Wait blocks until the delivery completed and returns its error, or the error of the context if it is done
+// first. The message is still delivered after the context is done.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.token.Done():
+		return d.token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
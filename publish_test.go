@@ -4,21 +4,32 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+	"github.com/lucacasonato/mqtt/packets"
 )
 
 var testUUID = uuid.New().String()
 var broker = os.Getenv("MQTT_BROKER")
 
-func init() {
-	if broker == "" {
-		broker = "tcp://localhost:1883"
+// TestMain runs the tests against an in-process broker unless MQTT_BROKER points to another one
+func TestMain(m *testing.M) {
+	if broker != "" {
+		os.Exit(m.Run())
 	}
+	server := mqtttest.NewBroker()
+	broker = server.URL
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
 }
 
 // TestPublishSuccess checks that a message publish succeeds
@@ -93,6 +104,102 @@ func TestPublishContextCancelled(t *testing.T) {
 	}
 }
 
+// TestPublishCanceledInFlight checks that a publish that was sent but not acknowledged in time reports that it
+// is in flight and that nothing keeps waiting for it in the background
+func TestPublishCanceledInFlight(t *testing.T) {
+	fake := listenFakeBroker(t, "127.0.0.1:0", false)
+	defer fake.close()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		timeout, cancel := context.WithTimeout(ctx(), 10*time.Millisecond)
+		err = client.Publish(timeout, "TestPublishCanceledInFlight", []byte("hello"), mqtt.AtLeastOnce)
+		cancel()
+		var canceled *mqtt.CanceledError
+		if !errors.As(err, &canceled) || !canceled.InFlight {
+			t.Fatalf("publish should have failed with an in flight CanceledError but failed with %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("publish should have failed with context.DeadlineExceeded but failed with %v", err)
+		}
+	}
+	if count := runtime.NumGoroutine(); count >= goroutines+50 {
+		t.Fatalf("canceled publishes should not have left goroutines behind, there are %v instead of %v", count, goroutines)
+	}
+}
+
+// TestPublishCanceledBeforeSent checks that a publish that is canceled while waiting to be written is dropped and
+// never sent
+func TestPublishCanceledBeforeSent(t *testing.T) {
+	packets := make(chan fakePacket, 100)
+	release := make(chan struct{})
+	// the broker answers the connect and then stops reading until it is released, which blocks the writes
+	serve := func(conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		<-release
+		acknowledge(conn, packets, true)
+	}
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:   []string{"pipe://broker"},
+		Transport: mqtt.PipeTransport(serve),
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		first <- client.Publish(ctx(), "TestPublishCanceledBeforeSent/1", []byte("hello"), mqtt.AtLeastOnce)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	timeout, cancel := context.WithTimeout(ctx(), 50*time.Millisecond)
+	defer cancel()
+	err = client.Publish(timeout, "TestPublishCanceledBeforeSent/2", []byte("hello"), mqtt.AtLeastOnce)
+	var canceled *mqtt.CanceledError
+	if !errors.As(err, &canceled) || canceled.InFlight {
+		t.Fatalf("publish should have failed with a CanceledError that is not in flight but failed with %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish should have failed with context.DeadlineExceeded but failed with %v", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("first publish should not have failed: %v", err)
+	}
+	err = client.Publish(ctx(), "TestPublishCanceledBeforeSent/3", []byte("hello"), mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("third publish should not have failed: %v", err)
+	}
+	fake := &fakeBroker{packets: packets}
+	expectPublishes(t, fake, "TestPublishCanceledBeforeSent/1", "TestPublishCanceledBeforeSent/3")
+}
+
 // TestPublishFailed checks that a invalid publish does not get publish but errors
 func TestPublishFailed(t *testing.T) {
 	client, err := mqtt.NewClient(mqtt.ClientOptions{
@@ -201,3 +308,222 @@ func TestPublisJSONFailed(t *testing.T) {
 		t.Fatalf("publish error should be of type *json.UnsupportedTypeError: %v", err)
 	}
 }
+
+// TestPublishAsync checks that asynchronous publishes are delivered in order and reported to the callback
+func TestPublishAsync(t *testing.T) {
+	reported := make(chan *mqtt.Delivery, 100)
+	client := connectClient(t, mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		OnDelivery: func(delivery *mqtt.Delivery) {
+			reported <- delivery
+		},
+	})
+	defer client.DisconnectImmediately()
+
+	topic := testUUID + "/TestPublishAsync"
+	messages := make(chan mqtt.Message, 100)
+	client.Handle(topic, func(message mqtt.Message) {
+		messages <- message
+	})
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	deliveries := make([]*mqtt.Delivery, 100)
+	for i := range deliveries {
+		deliveries[i] = client.PublishAsync(ctx(), topic, []byte{byte(i)}, mqtt.AtLeastOnce)
+	}
+	for i, delivery := range deliveries {
+		if err := delivery.Wait(ctx()); err != nil {
+			t.Fatalf("delivery %v should not have failed: %v", i, err)
+		}
+		if delivery.Err() != nil || delivery.Topic() != topic {
+			t.Fatalf("delivery %v should have succeeded on %v: %v", i, delivery.Topic(), delivery.Err())
+		}
+		if message := receive(t, messages); message.Payload()[0] != byte(i) {
+			t.Fatalf("message %v should have been received in order but was %v", i, message.Payload()[0])
+		}
+	}
+	for range deliveries {
+		select {
+		case <-reported:
+		case <-time.After(5 * time.Second):
+			t.Fatal("every delivery should have been reported")
+		}
+	}
+}
+
+// TestPublishAsyncPipelined checks that asynchronous publishes are sent before the broker acknowledged the earlier
+// ones
+func TestPublishAsyncPipelined(t *testing.T) {
+	fake := listenFakeBroker(t, "127.0.0.1:0", false)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{Servers: []string{fake.server}})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	if err := client.Connect(ctx()); err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+
+	topics := []string{"TestPublishAsyncPipelined/1", "TestPublishAsyncPipelined/2", "TestPublishAsyncPipelined/3"}
+	deliveries := []*mqtt.Delivery{}
+	for _, topic := range topics {
+		deliveries = append(deliveries, client.PublishAsync(ctx(), topic, []byte("hello"), mqtt.AtLeastOnce))
+	}
+	expectPublishes(t, fake, topics...)
+
+	select {
+	case <-deliveries[0].Done():
+		t.Fatal("the delivery should not have completed without an acknowledgement")
+	default:
+	}
+	timeout, cancel := context.WithTimeout(ctx(), 50*time.Millisecond)
+	defer cancel()
+	if err := deliveries[0].Wait(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait should have failed with context.DeadlineExceeded: %v", err)
+	}
+	if err := deliveries[0].Err(); err != nil {
+		t.Fatalf("an incomplete delivery should not have an error: %v", err)
+	}
+}
+
+// TestPublishMaxInflight checks that publishes wait while as many as allowed are not acknowledged yet
+func TestPublishMaxInflight(t *testing.T) {
+	fake := listenFakeBroker(t, "127.0.0.1:0", false)
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, MaxInflight: 2})
+	defer client.DisconnectImmediately()
+
+	client.PublishAsync(ctx(), "TestPublishMaxInflight/1", []byte("hello"), mqtt.AtLeastOnce)
+	client.PublishAsync(ctx(), "TestPublishMaxInflight/2", []byte("hello"), mqtt.AtLeastOnce)
+	expectPublishes(t, fake, "TestPublishMaxInflight/1", "TestPublishMaxInflight/2")
+
+	timeout, cancel := context.WithTimeout(ctx(), 50*time.Millisecond)
+	defer cancel()
+	err := client.PublishAsync(timeout, "TestPublishMaxInflight/3", []byte("hello"), mqtt.AtLeastOnce).Wait(ctx())
+	var canceled *mqtt.CanceledError
+	if !errors.As(err, &canceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the third publish should have waited until the context was done but failed with %v", err)
+	}
+}
+
+// TestPublishReceiveMaximum checks that pipelined publishes stay within the receive maximum of an mqtt 5 broker,
+// which disconnects clients that send more
+func TestPublishReceiveMaximum(t *testing.T) {
+	server := mqtttest.NewBroker()
+	defer server.Close()
+	server.SetReceiveMaximum(2)
+	transport := mqtttest.NewFaultyTransport(mqtt.PipeTransport(server.ServeConn))
+	transport.SetFaults(mqtttest.Faults{Latency: 10 * time.Millisecond})
+	lost := make(chan error, 10)
+	client := connectClient(t, mqtt.ClientOptions{
+		Servers:         []string{"pipe://broker"},
+		Transport:       transport,
+		ProtocolVersion: mqtt.ProtocolV5,
+		OnEvent: func(event mqtt.Event) {
+			if event.Type == mqtt.EventConnectionLost {
+				lost <- event.Err
+			}
+		},
+	})
+	defer client.DisconnectImmediately()
+
+	deliveries := make([]*mqtt.Delivery, 10)
+	for i := range deliveries {
+		deliveries[i] = client.PublishAsync(ctx(), "TestPublishReceiveMaximum", []byte{byte(i)}, mqtt.ExactlyOnce)
+	}
+	for i, delivery := range deliveries {
+		if err := delivery.Wait(ctx()); err != nil {
+			t.Fatalf("delivery %v should not have failed: %v", i, err)
+		}
+	}
+	select {
+	case err := <-lost:
+		t.Fatalf("the connection should not have been lost: %v", err)
+	default:
+	}
+}
+
+// TestPublishTopicAliases checks that mqtt 5 publishes replace topics with the aliases the broker allows
+func TestPublishTopicAliases(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	defer listener.Close()
+	published := make(chan *packets.Publish, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		codec := packets.Codec{Level: packets.ProtocolLevelV5}
+		if _, err := codec.Read(conn); err != nil {
+			return
+		}
+		maximum := uint16(1)
+		codec.Write(conn, &packets.Connack{Properties: packets.Properties{TopicAliasMaximum: &maximum}})
+		for {
+			packet, err := codec.Read(conn)
+			if err != nil {
+				return
+			}
+			if publish, ok := packet.(*packets.Publish); ok {
+				published <- publish
+				codec.Write(conn, &packets.Puback{PacketID: publish.PacketID})
+			}
+		}
+	}()
+
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{"tcp://" + listener.Addr().String()}, ProtocolVersion: mqtt.ProtocolV5})
+	defer client.DisconnectImmediately()
+	for _, topic := range []string{"a", "a", "b"} {
+		if err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce); err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+	}
+
+	expected := []struct {
+		topic string
+		alias uint16
+	}{{"a", 1}, {"", 1}, {"b", 0}}
+	for i, e := range expected {
+		publish := <-published
+		alias := uint16(0)
+		if publish.Properties.TopicAlias != nil {
+			alias = *publish.Properties.TopicAlias
+		}
+		if publish.Topic != e.topic || alias != e.alias {
+			t.Fatalf("publish %v should have had topic %q and alias %v but had %q and %v", i, e.topic, e.alias, publish.Topic, alias)
+		}
+	}
+}
+
+// TestPublishTopicAliasesDelivered checks that messages published with topic aliases reach their topics
+func TestPublishTopicAliasesDelivered(t *testing.T) {
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, ProtocolVersion: mqtt.ProtocolV5, TopicAliasMaximum: 10})
+	defer client.DisconnectImmediately()
+
+	topic := testUUID + "/TestPublishTopicAliasesDelivered"
+	messages := make(chan mqtt.Message, 10)
+	client.Handle(topic+"/+", func(message mqtt.Message) {
+		messages <- message
+	})
+	if err := client.Subscribe(ctx(), topic+"/+", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	topics := []string{topic + "/a", topic + "/b", topic + "/a", topic + "/b"}
+	for _, topic := range topics {
+		if err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce); err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+	}
+	for _, topic := range topics {
+		if message := receive(t, messages); message.Topic() != topic {
+			t.Fatalf("the message should have been received on %v but was received on %v", topic, message.Topic())
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// OverflowPolicy decides what happens when a message does not fit in the offline queue
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects the new message and returns ErrQueueFull from the publish
+	OverflowReject OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued messages until the new message fits
+	OverflowDropOldest
+	// OverflowDropNewest silently drops the new message
+	OverflowDropNewest
+)
+
+// OfflineQueue configures the queue that holds messages published while the client is not connected
+type OfflineQueue struct {
+	MaxMessages int            // The maximum number of queued messages, 0 means no limit
+	MaxBytes    int            // The maximum total payload size of the queued messages, 0 means no limit
+	Overflow    OverflowPolicy // What happens when a message does not fit, defaults to OverflowReject
+	TTL         time.Duration  // Messages queued for longer than this are dropped instead of sent, 0 means they never expire
+}
+
+var (
+	// ErrQueueFull means that a message was published while disconnected and it did not fit in the offline queue
+	ErrQueueFull = errors.New("mqtt: the offline queue is full")
+)
+
+// tokenPollInterval is how often a token is checked while waiting for it to complete or the connection to drop
+const tokenPollInterval = 100 * time.Millisecond
+
+type queuedMessage struct {
+	topic      string
+	payload    []byte
+	qos        QOS
+	retained   bool
+	queued     time.Time
+	expires    time.Time // The message is dropped instead of sent after this, zero if it does not expire
+	entry      uint64    // The id of the message in the outbox, 0 if there is none
+	properties           // The publish properties of mqtt 5, with 3.1.1 they are in the payload
+}
+
+func (m queuedMessage) expired() bool {
+	return !m.expires.IsZero() && time.Now().After(m.expires)
+}
+
+// publishProperties returns the mqtt 5 properties of the message. The message expiry is the time that is left,
+// so it keeps counting down while the message waits in the offline queue or the outbox.
+func (m queuedMessage) publishProperties() packets.Properties {
+	p := m.properties.packet()
+	if !m.expires.IsZero() {
+		seconds := uint32(1)
+		if left := time.Until(m.expires); left > time.Second {
+			seconds = uint32((left + time.Second - 1) / time.Second)
+		}
+		p.MessageExpiry = &seconds
+	}
+	return p
+}
+
+// queue buffers messages while the client is offline and hands them back in order once it is online again
+type queue struct {
+	options  OfflineQueue
+	lock     sync.Mutex
+	online   bool
+	epoch    int // incremented every time the queue goes offline
+	messages []queuedMessage
+	bytes    int
+	dropped  func(queuedMessage) // called with every message that is dropped instead of sent
+	measure  func(messages int)  // called with the number of queued messages when it changes
+}
+
+func newQueue(options OfflineQueue, dropped func(queuedMessage), measure func(messages int)) *queue {
+	return &queue{options: options, dropped: dropped, measure: measure}
+}
+
+// enqueue queues the message if the client is offline and returns false if it is online and the message should
+// be published directly
+func (q *queue) enqueue(message queuedMessage) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.online {
+		return false, nil
+	}
+
+	size := len(message.payload)
+	if q.options.MaxBytes > 0 && size > q.options.MaxBytes {
+		return true, ErrQueueFull
+	}
+	for !q.fits(size) {
+		switch q.options.Overflow {
+		case OverflowDropOldest:
+			q.bytes -= len(q.messages[0].payload)
+			q.dropped(q.messages[0])
+			q.messages = q.messages[1:]
+			q.measure(len(q.messages))
+		case OverflowDropNewest:
+			q.dropped(message)
+			return true, nil
+		default:
+			return true, ErrQueueFull
+		}
+	}
+
+	q.messages = append(q.messages, message)
+	q.bytes += size
+	q.measure(len(q.messages))
+	return true, nil
+}
+
+func (q *queue) fits(size int) bool {
+	if q.options.MaxMessages > 0 && len(q.messages)+1 > q.options.MaxMessages {
+		return false
+	}
+	return q.options.MaxBytes <= 0 || q.bytes+size <= q.options.MaxBytes
+}
+
+func (q *queue) current() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.epoch
+}
+
+// take removes all queued messages. If there are none the queue goes online, unless it went offline again since
+// the epoch.
+func (q *queue) take(epoch int) []queuedMessage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.messages) == 0 || q.epoch != epoch {
+		q.online = q.epoch == epoch
+		return nil
+	}
+	messages := q.messages
+	q.messages = nil
+	q.bytes = 0
+	q.measure(0)
+	return messages
+}
+
+// requeue puts messages that could not be sent back in front of the queue
+func (q *queue) requeue(messages []queuedMessage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.messages = append(messages, q.messages...)
+	for _, message := range messages {
+		q.bytes += len(message.payload)
+	}
+	q.measure(len(q.messages))
+}
+
+func (q *queue) offline() {
+	q.lock.Lock()
+	q.online = false
+	q.epoch++
+	q.lock.Unlock()
+}
+
+// flush publishes all queued messages in order until the queue is empty and goes online. Messages that fail
+// because the connection dropped are queued again.
+func (c *Client) flush() {
+	epoch := c.queue.current()
+	for {
+		messages := c.queue.take(epoch)
+		if messages == nil {
+			return
+		}
+
+		tokens := make([]*token, len(messages))
+		for i, message := range messages {
+			if message.expired() || c.queue.options.TTL > 0 && time.Since(message.queued) > c.queue.options.TTL {
+				c.discard(message, "it expired in the offline queue")
+				continue
+			}
+			c.inflight.track()
+			tokens[i] = c.core.publish(context.Background(), message.topic, byte(message.qos), message.retained, message.payload, message.publishProperties())
+			c.settle(tokens[i], message, false)
+		}
+
+		failed := []queuedMessage{}
+		for i, token := range tokens {
+			if token != nil && !c.waitWhileConnected(token) {
+				failed = append(failed, messages[i])
+			}
+		}
+		if len(failed) > 0 && !c.core.connected() {
+			c.queue.requeue(failed)
+			return
+		}
+	}
+}
+
+// discard drops a queued message that will not be sent and logs why
+func (c *Client) discard(message queuedMessage, reason string) {
+	c.log.Warn("dropped message", "topic", message.topic, "qos", message.qos, "reason", reason)
+	c.drop(message)
+}
+
+// waitWhileConnected waits for the token and returns false if it failed. If the connection drops before the
+// token completes the message is pending in a persistent session and will be resent from there.
+func (c *Client) waitWhileConnected(token *token) bool {
+	for !token.WaitTimeout(tokenPollInterval) {
+		if !c.core.connected() {
+			return true
+		}
+	}
+	return token.Error() == nil
+}
@@ -0,0 +1,190 @@
+package mqtt_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// publishedTopic parses the topic of a publish packet
+func publishedTopic(packet fakePacket) string {
+	topicLength := int(packet.body[0])<<8 | int(packet.body[1])
+	return string(packet.body[2 : 2+topicLength])
+}
+
+// expectPublishes checks that the fake broker receives publishes on the topics in order
+func expectPublishes(t *testing.T, fake *fakeBroker, topics ...string) {
+	for _, topic := range topics {
+		if received := publishedTopic(fake.expect(t, 3)); received != topic {
+			t.Fatalf("publish should have been on %v but was on %v", topic, received)
+		}
+	}
+}
+
+// TestOfflineQueue checks that messages published while disconnected are sent in order once connected
+func TestOfflineQueue(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{}})
+	for _, topic := range []string{"TestOfflineQueue/1", "TestOfflineQueue/2", "TestOfflineQueue/3"} {
+		err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should have been queued: %v", err)
+		}
+	}
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOfflineQueue/1", "TestOfflineQueue/2", "TestOfflineQueue/3")
+
+	err = client.PublishString(ctx(), "TestOfflineQueue/4", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	expectPublishes(t, fake, "TestOfflineQueue/4")
+}
+
+// TestOfflineQueueReconnect checks that messages published while reconnecting are sent after the reconnect
+func TestOfflineQueueReconnect(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{
+		Servers:         []string{fake.server},
+		AutoReconnect:   true,
+		ReconnectPolicy: mqtt.ReconnectPolicy{MinDelay: 10 * time.Millisecond},
+		OfflineQueue:    &mqtt.OfflineQueue{},
+	})
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+
+	fake.close()
+	(<-fake.conns).Close()
+	for client.State() == mqtt.StateConnected {
+		<-time.After(time.Millisecond)
+	}
+	err = client.PublishString(ctx(), "TestOfflineQueueReconnect", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+
+	restarted := listenFakeBroker(t, fake.listener.Addr().String(), true)
+	expectPublishes(t, restarted, "TestOfflineQueueReconnect")
+}
+
+// TestOfflineQueueReject checks that a full queue rejects new messages
+func TestOfflineQueueReject(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{MaxMessages: 2}})
+	for i := 0; i < 2; i++ {
+		err := client.PublishString(ctx(), "TestOfflineQueueReject", "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should have been queued: %v", err)
+		}
+	}
+	err := client.PublishString(ctx(), "TestOfflineQueueReject", "hello", mqtt.AtLeastOnce)
+	if !errors.Is(err, mqtt.ErrQueueFull) {
+		t.Fatalf("publish should have failed with ErrQueueFull: %v", err)
+	}
+}
+
+// TestOfflineQueueMaxBytes checks that the queue is bounded by the size of the payloads
+func TestOfflineQueueMaxBytes(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{MaxBytes: 8}})
+	err := client.PublishString(ctx(), "TestOfflineQueueMaxBytes", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+	err = client.PublishString(ctx(), "TestOfflineQueueMaxBytes", "world", mqtt.AtLeastOnce)
+	if !errors.Is(err, mqtt.ErrQueueFull) {
+		t.Fatalf("publish should have failed with ErrQueueFull: %v", err)
+	}
+}
+
+// TestOfflineQueueDropOldest checks that the oldest messages are dropped to make room
+func TestOfflineQueueDropOldest(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{MaxMessages: 2, Overflow: mqtt.OverflowDropOldest}})
+	for _, topic := range []string{"TestOfflineQueueDropOldest/1", "TestOfflineQueueDropOldest/2", "TestOfflineQueueDropOldest/3"} {
+		err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should have been queued: %v", err)
+		}
+	}
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOfflineQueueDropOldest/2", "TestOfflineQueueDropOldest/3")
+}
+
+// TestOfflineQueueDropNewest checks that new messages are dropped when the queue is full
+func TestOfflineQueueDropNewest(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{MaxMessages: 2, Overflow: mqtt.OverflowDropNewest}})
+	for _, topic := range []string{"TestOfflineQueueDropNewest/1", "TestOfflineQueueDropNewest/2", "TestOfflineQueueDropNewest/3"} {
+		err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should have been dropped without an error: %v", err)
+		}
+	}
+	err := client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOfflineQueueDropNewest/1", "TestOfflineQueueDropNewest/2")
+	err = client.PublishString(ctx(), "TestOfflineQueueDropNewest/4", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	expectPublishes(t, fake, "TestOfflineQueueDropNewest/4")
+}
+
+// TestOfflineQueueTTL checks that expired messages are not sent
+func TestOfflineQueueTTL(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{TTL: 50 * time.Millisecond}})
+	err := client.PublishString(ctx(), "TestOfflineQueueTTL/expired", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	err = client.PublishString(ctx(), "TestOfflineQueueTTL/fresh", "hello", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOfflineQueueTTL/fresh")
+}
+
+// TestOfflineQueueExpiry checks that queued messages are not sent after their expiry
+func TestOfflineQueueExpiry(t *testing.T) {
+	fake := newFakeBroker(t)
+	client := newClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, OfflineQueue: &mqtt.OfflineQueue{}})
+	err := client.PublishString(ctx(), "TestOfflineQueueExpiry/expired", "hello", mqtt.AtLeastOnce, mqtt.WithExpiry(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+	err = client.PublishString(ctx(), "TestOfflineQueueExpiry/fresh", "hello", mqtt.AtLeastOnce, mqtt.WithExpiry(time.Minute))
+	if err != nil {
+		t.Fatalf("publish should have been queued: %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	expectPublishes(t, fake, "TestOfflineQueueExpiry/fresh")
+}
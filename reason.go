@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// ReasonCode is the outcome of an operation that an mqtt 5 broker reports, codes from 0x80 on are failures
+type ReasonCode byte
+
+// The reason codes of mqtt 5 that brokers send in connacks, acknowledgements and disconnects
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUserNameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQOSNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonNames = map[ReasonCode]string{
+	ReasonSuccess:                             "success",
+	ReasonNoMatchingSubscribers:               "no matching subscribers",
+	ReasonNoSubscriptionExisted:               "no subscription existed",
+	ReasonUnspecifiedError:                    "unspecified error",
+	ReasonMalformedPacket:                     "malformed packet",
+	ReasonProtocolError:                       "protocol error",
+	ReasonImplementationSpecificError:         "implementation specific error",
+	ReasonUnsupportedProtocolVersion:          "unsupported protocol version",
+	ReasonClientIdentifierNotValid:            "client identifier not valid",
+	ReasonBadUserNameOrPassword:               "bad user name or password",
+	ReasonNotAuthorized:                       "not authorized",
+	ReasonServerUnavailable:                   "server unavailable",
+	ReasonServerBusy:                          "server busy",
+	ReasonBanned:                              "banned",
+	ReasonServerShuttingDown:                  "server shutting down",
+	ReasonBadAuthenticationMethod:             "bad authentication method",
+	ReasonKeepAliveTimeout:                    "keep alive timeout",
+	ReasonSessionTakenOver:                    "session taken over",
+	ReasonTopicFilterInvalid:                  "topic filter invalid",
+	ReasonTopicNameInvalid:                    "topic name invalid",
+	ReasonPacketIdentifierInUse:               "packet identifier in use",
+	ReasonPacketIdentifierNotFound:            "packet identifier not found",
+	ReasonReceiveMaximumExceeded:              "receive maximum exceeded",
+	ReasonTopicAliasInvalid:                   "topic alias invalid",
+	ReasonPacketTooLarge:                      "packet too large",
+	ReasonMessageRateTooHigh:                  "message rate too high",
+	ReasonQuotaExceeded:                       "quota exceeded",
+	ReasonAdministrativeAction:                "administrative action",
+	ReasonPayloadFormatInvalid:                "payload format invalid",
+	ReasonRetainNotSupported:                  "retain not supported",
+	ReasonQOSNotSupported:                     "QoS not supported",
+	ReasonUseAnotherServer:                    "use another server",
+	ReasonServerMoved:                         "server moved",
+	ReasonSharedSubscriptionsNotSupported:     "shared subscriptions not supported",
+	ReasonConnectionRateExceeded:              "connection rate exceeded",
+	ReasonMaximumConnectTime:                  "maximum connect time",
+	ReasonSubscriptionIdentifiersNotSupported: "subscription identifiers not supported",
+	ReasonWildcardSubscriptionsNotSupported:   "wildcard subscriptions not supported",
+}
+
+func (r ReasonCode) String() string {
+	if name, ok := reasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason code %#x", byte(r))
+}
+
+// Failed is true for the reason codes of operations that did not succeed
+func (r ReasonCode) Failed() bool {
+	return r >= 0x80
+}
+
+// ReasonCodeError means that an mqtt 5 broker refused an operation or closed the connection with a reason code.
+// Refused connections also match the errors of mqtt 3.1.1, like ErrNotAuthorized and ErrConnectionRefused.
+type ReasonCodeError struct {
+	Code   ReasonCode
+	Reason string // The reason string of the broker, empty if it did not send one
+	err    error  // The matching error of mqtt 3.1.1, nil if there is none
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("mqtt: %v: %v", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("mqtt: %v", e.Code)
+}
+
+// Unwrap returns the matching error of mqtt 3.1.1
+func (e *ReasonCodeError) Unwrap() error {
+	return e.err
+}
+
+// reasonError returns the error of a failed reason code and nil for a successful one
+func reasonError(code byte, properties *packets.Properties) error {
+	if !ReasonCode(code).Failed() {
+		return nil
+	}
+	return &ReasonCodeError{Code: ReasonCode(code), Reason: properties.ReasonString}
+}
+
+// connackReasonError returns the error of a connack with a failed reason code
+func connackReasonError(code byte, properties *packets.Properties) error {
+	err := &ReasonCodeError{Code: ReasonCode(code), Reason: properties.ReasonString, err: ErrConnectionRefused}
+	switch err.Code {
+	case ReasonUnsupportedProtocolVersion:
+		err.err = errUnacceptableProtocolVersion
+	case ReasonClientIdentifierNotValid:
+		err.err = ErrIdentifierRejected
+	case ReasonServerUnavailable, ReasonServerBusy:
+		err.err = ErrServerUnavailable
+	case ReasonBadUserNameOrPassword:
+		err.err = ErrBadCredentials
+	case ReasonNotAuthorized, ReasonBanned:
+		err.err = ErrNotAuthorized
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package mqtt_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// TestConnectRefusedV5 checks that a refused mqtt 5 connection fails with its reason code and the matching error
+// of mqtt 3.1.1
+func TestConnectRefusedV5(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.SetAuthenticator(func(clientID, username string, password []byte) bool {
+		return username == "user"
+	})
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:         []string{broker.URL},
+		ProtocolVersion: mqtt.ProtocolV5,
+		Username:        "intruder",
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	var reason *mqtt.ReasonCodeError
+	if !errors.As(err, &reason) || reason.Code != mqtt.ReasonBadUserNameOrPassword || !errors.Is(err, mqtt.ErrBadCredentials) {
+		t.Fatalf("connect should have failed with bad user name or password but failed with %v", err)
+	}
+}
+
+// TestSubscribeRejectedV5 checks that a rejected mqtt 5 subscription has the reason code of the broker
+func TestSubscribeRejectedV5(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.SetAuthorizer(func(clientID, filter string) bool {
+		return filter != "secret"
+	})
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker.URL}, ProtocolVersion: mqtt.ProtocolV5})
+	defer client.DisconnectImmediately()
+
+	err := client.Subscribe(ctx(), "secret", mqtt.AtLeastOnce)
+	var rejected *mqtt.SubscriptionRejectedError
+	if !errors.As(err, &rejected) || rejected.Topic != "secret" || rejected.Code != mqtt.ReasonNotAuthorized {
+		t.Fatalf("subscribe should have been rejected as not authorized but failed with %v", err)
+	}
+}
+
+// TestSessionTakenOverV5 checks that the connection lost event has the reason code of the disconnect the broker
+// sent when another client took over the session
+func TestSessionTakenOverV5(t *testing.T) {
+	lost := make(chan error, 10)
+	clientID := testUUID + "/TestSessionTakenOverV5"
+	first := connectClient(t, mqtt.ClientOptions{
+		Servers:         []string{broker},
+		ClientID:        clientID,
+		ProtocolVersion: mqtt.ProtocolV5,
+		OnEvent: func(event mqtt.Event) {
+			if event.Type == mqtt.EventConnectionLost {
+				lost <- event.Err
+			}
+		},
+	})
+	defer first.DisconnectImmediately()
+	second := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, ClientID: clientID, ProtocolVersion: mqtt.ProtocolV5})
+	defer second.DisconnectImmediately()
+
+	select {
+	case err := <-lost:
+		var reason *mqtt.ReasonCodeError
+		if !errors.As(err, &reason) || reason.Code != mqtt.ReasonSessionTakenOver {
+			t.Fatalf("the connection should have been lost because the session was taken over but was lost with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection of the first client should have been lost")
+	}
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy configures how often and how fast the client retries connecting to the brokers
+type ReconnectPolicy struct {
+	MinDelay            time.Duration // The delay after the first failed attempt, defaults to 1 second
+	MaxDelay            time.Duration // The upper bound of the delay between attempts, defaults to 10 minutes
+	Multiplier          float64       // The factor the delay grows by after every failed attempt, defaults to 2
+	Jitter              float64       // Randomizes every delay by up to this fraction, 0.2 means ±20%, to spread out reconnecting clients
+	MaxAttempts         int           // The number of attempts before giving up, 0 means the client never gives up
+	RetryInitialConnect bool          // If Connect should retry with this policy until its context expires instead of failing on the first error
+}
+
+// delay returns how long to wait after the failed attempt, attempts start at 1
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	min, max, multiplier := p.MinDelay, p.MaxDelay, p.Multiplier
+	if min <= 0 {
+		min = 1 * time.Second
+	}
+	if max <= 0 {
+		max = 10 * time.Minute
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(min)
+	for i := 1; i < attempt && delay < float64(max); i++ {
+		delay *= multiplier
+	}
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// exhausted is true if no attempts are left after the given attempt
+func (p ReconnectPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// reconnect keeps trying to connect until it succeeds, the attempts run out or the client gets disconnected
+func (c *Client) reconnect() {
+	policy := c.Options.ReconnectPolicy
+	for attempt := 1; ; attempt++ {
+		state, changed := c.lifecycle.current()
+		if state != StateReconnecting {
+			return
+		}
+		c.lifecycle.emit(Event{Type: EventReconnecting, Attempt: attempt})
+		c.log.Info("reconnecting", "attempt", attempt)
+		token := c.core.connect()
+		token.Wait()
+		c.metrics.Reconnected(token.Error())
+		if token.Error() == nil {
+			c.recordSession(token)
+			return
+		}
+		if policy.exhausted(attempt) {
+			c.log.Error("giving up to reconnect", "attempts", attempt, "error", token.Error())
+			if c.lifecycle.compareAndSet(StateDisconnected, StateReconnecting) {
+				c.lifecycle.emit(Event{Type: EventDisconnected})
+			}
+			return
+		}
+
+		delay := policy.delay(attempt)
+		c.log.Warn("reconnect attempt failed", "attempt", attempt, "error", token.Error(), "retry_in", delay)
+		select {
+		case <-time.After(delay):
+		case <-changed:
+		}
+	}
+}
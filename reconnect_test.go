@@ -0,0 +1,132 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// TestReconnectMaxAttempts checks that the client stops reconnecting once the attempts run out
+func TestReconnectMaxAttempts(t *testing.T) {
+	fake := newFakeBroker(t)
+	events := mqtttest.NewEvents()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		AutoReconnect: true,
+		ReconnectPolicy: mqtt.ReconnectPolicy{
+			MinDelay:    10 * time.Millisecond,
+			MaxDelay:    20 * time.Millisecond,
+			Jitter:      0.5,
+			MaxAttempts: 3,
+		},
+		OnEvent: events.Record,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	events.Expect(t, mqtt.EventConnected)
+
+	fake.close()
+	(<-fake.conns).Close()
+	events.Expect(t, mqtt.EventConnectionLost)
+	for attempt := 1; attempt <= 3; attempt++ {
+		event := events.Expect(t, mqtt.EventReconnecting)
+		if event.Attempt != attempt {
+			t.Fatalf("reconnect attempt should be %v but is %v", attempt, event.Attempt)
+		}
+	}
+	events.Expect(t, mqtt.EventDisconnected)
+	if client.State() != mqtt.StateDisconnected {
+		t.Fatalf("state should be disconnected but is %v", client.State())
+	}
+}
+
+// TestRetryInitialConnect checks that connect keeps retrying until the broker becomes available
+func TestRetryInitialConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			"tcp://" + address,
+		},
+		ReconnectPolicy: mqtt.ReconnectPolicy{
+			MinDelay:            10 * time.Millisecond,
+			RetryInitialConnect: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	go func() {
+		<-time.After(100 * time.Millisecond)
+		listenFakeBroker(t, address, true)
+	}()
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	client.DisconnectImmediately()
+}
+
+// TestRetryInitialConnectTimeout checks that retrying connect stops when the context expires
+func TestRetryInitialConnectTimeout(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			"tcp://127.0.0.1:1",
+		},
+		ReconnectPolicy: mqtt.ReconnectPolicy{
+			MinDelay:            10 * time.Millisecond,
+			RetryInitialConnect: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx(), 100*time.Millisecond)
+	defer cancel()
+	err = client.Connect(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("connect should have failed with context.DeadlineExceeded: %v", err)
+	}
+	if client.State() != mqtt.StateDisconnected {
+		t.Fatalf("state should be disconnected but is %v", client.State())
+	}
+}
+
+// TestRetryInitialConnectMaxAttempts checks that retrying connect returns the last error once the attempts run out
+func TestRetryInitialConnectMaxAttempts(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			"tcp://127.0.0.1:1",
+		},
+		ReconnectPolicy: mqtt.ReconnectPolicy{
+			MinDelay:            10 * time.Millisecond,
+			MaxAttempts:         2,
+			RetryInitialConnect: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("connect should have failed with connection refused: %v", err)
+	}
+}
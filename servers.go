@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServerSelection decides in which order the servers are tried when connecting
+type ServerSelection int
+
+const (
+	// SelectOrdered tries the servers in the order of the list, starting at the first one on every connect
+	SelectOrdered ServerSelection = iota
+	// SelectRoundRobin starts every connect at the server after the one the previous connect started at
+	SelectRoundRobin
+	// SelectRandom tries the servers in a random order
+	SelectRandom
+	// SelectSticky starts at the server of the last connection and only moves on to the next one when it fails
+	SelectSticky
+)
+
+// selector keeps track of the servers and how healthy they are. Servers that failed recently are tried after
+// the others, so a broker that is down does not delay every connect.
+type selector struct {
+	servers  []*url.URL
+	strategy ServerSelection
+	cooldown time.Duration // How long a failed server is tried last
+	lock     sync.Mutex
+	next     int         // The server the next round robin connect starts at
+	current  int         // The server of the last connection, for sticky connects
+	failures []time.Time // When every server last failed, zero if it did not
+}
+
+func newSelector(servers []*url.URL, strategy ServerSelection, cooldown time.Duration) *selector {
+	return &selector{servers: servers, strategy: strategy, cooldown: cooldown, failures: make([]time.Time, len(servers))}
+}
+
+// order returns the indices of the servers in the order they should be tried
+func (s *selector) order() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := len(s.servers)
+	order := make([]int, n)
+	start := 0
+	switch s.strategy {
+	case SelectRoundRobin:
+		start = s.next
+		s.next = (s.next + 1) % n
+	case SelectSticky:
+		start = s.current
+	case SelectRandom:
+		return s.healthyFirst(rand.Perm(n))
+	}
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return s.healthyFirst(order)
+}
+
+// healthyFirst moves the servers that failed within the cooldown to the end, the ones that failed longest ago
+// first
+func (s *selector) healthyFirst(order []int) []int {
+	now := time.Now()
+	failed := func(i int) bool {
+		return !s.failures[i].IsZero() && now.Sub(s.failures[i]) < s.cooldown
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		failedA, failedB := failed(order[a]), failed(order[b])
+		if failedA && failedB {
+			return s.failures[order[a]].Before(s.failures[order[b]])
+		}
+		return !failedA && failedB
+	})
+	return order
+}
+
+// failed records that connecting to the server failed or that its connection was lost
+func (s *selector) failed(server int) {
+	s.lock.Lock()
+	s.failures[server] = time.Now()
+	s.lock.Unlock()
+}
+
+// connected records that the server accepted a connection
+func (s *selector) connected(server int) {
+	s.lock.Lock()
+	s.current = server
+	s.failures[server] = time.Time{}
+	s.lock.Unlock()
+}
+
+// redact returns a server url with its password masked, for logs
+func redact(server *url.URL) string {
+	if _, ok := server.User.Password(); !ok {
+		return server.String()
+	}
+	masked := *server
+	masked.User = url.UserPassword(server.User.Username(), "xxxxx")
+	return masked.String()
+}
@@ -0,0 +1,181 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// cluster is a set of brokers reachable over pipes as pipe://a, pipe://b and so on, some of which can be down
+type cluster struct {
+	lock    sync.Mutex
+	brokers map[string]*mqtttest.Broker
+	down    map[string]bool
+	dialed  []string
+	conns   []net.Conn
+}
+
+func newCluster(names ...string) *cluster {
+	c := &cluster{brokers: map[string]*mqtttest.Broker{}, down: map[string]bool{}}
+	for _, name := range names {
+		c.brokers[name] = mqtttest.NewBroker()
+	}
+	return c
+}
+
+func (c *cluster) close() {
+	for _, broker := range c.brokers {
+		broker.Close()
+	}
+}
+
+func (c *cluster) Dial(ctx context.Context, server *url.URL) (net.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dialed = append(c.dialed, server.Host)
+	if c.down[server.Host] {
+		return nil, errors.New("broker is down")
+	}
+	conn, err := mqtt.PipeTransport(c.brokers[server.Host].ServeConn).Dial(ctx, server)
+	c.conns = append(c.conns, conn)
+	return conn, err
+}
+
+func (c *cluster) setDown(name string, down bool) {
+	c.lock.Lock()
+	c.down[name] = down
+	c.lock.Unlock()
+}
+
+// takeDialed returns the brokers that were dialed since the last call
+func (c *cluster) takeDialed() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	dialed := c.dialed
+	c.dialed = nil
+	return dialed
+}
+
+// clusterServers are the urls of the brokers of a cluster with the names a, b and c
+var clusterServers = []string{"pipe://a", "pipe://b", "pipe://c"}
+
+// dropConnections closes the client side of all connections
+func (c *cluster) dropConnections() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+// connectedServers connects and disconnects the client a number of times and returns the servers it connected to
+func connectedServers(t *testing.T, client *mqtt.Client, times int) []string {
+	t.Helper()
+	servers := []string{}
+	for i := 0; i < times; i++ {
+		if err := client.Connect(ctx()); err != nil {
+			t.Fatalf("connect should not have failed: %v", err)
+		}
+		servers = append(servers, client.ConnectedServer())
+		client.DisconnectImmediately()
+		if server := client.ConnectedServer(); server != "" {
+			t.Fatalf("connected server should have been empty after disconnecting but is %v", server)
+		}
+	}
+	return servers
+}
+
+func expectServers(t *testing.T, actual []string, expected ...string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("servers should have been %v but are %v", expected, actual)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("servers should have been %v but are %v", expected, actual)
+		}
+	}
+}
+
+// TestSelectOrdered checks that every connect starts at the first server and skips servers that are down
+func TestSelectOrdered(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	defer c.close()
+	client := newClient(t, mqtt.ClientOptions{Servers: clusterServers, Transport: c, FailedServerCooldown: 200 * time.Millisecond})
+
+	expectServers(t, connectedServers(t, client, 2), "pipe://a", "pipe://a")
+	c.takeDialed()
+
+	c.setDown("a", true)
+	expectServers(t, connectedServers(t, client, 2), "pipe://b", "pipe://b")
+	// a failed recently, so the second connect does not try it first
+	expectServers(t, c.takeDialed(), "a", "b", "b")
+
+	c.setDown("a", false)
+	time.Sleep(300 * time.Millisecond)
+	expectServers(t, connectedServers(t, client, 1), "pipe://a")
+}
+
+// TestSelectRoundRobin checks that connects start at the next server every time
+func TestSelectRoundRobin(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	defer c.close()
+	client := newClient(t, mqtt.ClientOptions{Servers: clusterServers, Transport: c, ServerSelection: mqtt.SelectRoundRobin})
+
+	expectServers(t, connectedServers(t, client, 4), "pipe://a", "pipe://b", "pipe://c", "pipe://a")
+}
+
+// TestSelectRandom checks that random connects spread over the servers
+func TestSelectRandom(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	defer c.close()
+	client := newClient(t, mqtt.ClientOptions{Servers: clusterServers, Transport: c, ServerSelection: mqtt.SelectRandom})
+
+	seen := map[string]bool{}
+	for _, server := range connectedServers(t, client, 30) {
+		seen[server] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("random selection should have used more than one server but used %v", seen)
+	}
+}
+
+// TestSelectSticky checks that the client stays on a server until it fails, also after losing the connection
+func TestSelectSticky(t *testing.T) {
+	c := newCluster("a", "b", "c")
+	defer c.close()
+	client := newClient(t, mqtt.ClientOptions{Servers: clusterServers, Transport: c, ServerSelection: mqtt.SelectSticky})
+
+	c.setDown("a", true)
+	expectServers(t, connectedServers(t, client, 1), "pipe://b")
+	c.setDown("a", false)
+	expectServers(t, connectedServers(t, client, 2), "pipe://b", "pipe://b")
+
+	// a lost connection counts as a failure, so the client fails over to another server
+	events := mqtttest.NewEvents()
+	options := client.Options
+	options.AutoReconnect = true
+	options.OnEvent = events.Record
+	client = newClient(t, options)
+	defer client.DisconnectImmediately()
+	if err := client.Connect(ctx()); err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	events.Expect(t, mqtt.EventConnected)
+	first := client.ConnectedServer()
+	c.dropConnections()
+	events.Expect(t, mqtt.EventConnectionLost)
+	events.Expect(t, mqtt.EventReconnecting)
+	events.Expect(t, mqtt.EventConnected)
+	if server := client.ConnectedServer(); server == first || server == "" {
+		t.Fatalf("client should have failed over from %v but is connected to %v", first, server)
+	}
+}
@@ -0,0 +1,239 @@
+package mqtt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store persists the encoded packets of QoS 1 and 2 messages that are still in flight, so they can be resumed
+// on a persistent session after reconnecting or restarting. Keys are unique per client id, direction and message
+// id, so clients with different client ids can share a store. Reset deletes all keys of the store, the client only
+// resets its own keys.
+type Store interface {
+	Put(key string, packet []byte) error
+	Get(key string) ([]byte, error) // Returns nil without an error if the key does not exist
+	Keys() ([]string, error)
+	Delete(key string) error
+	Reset() error // Deletes all keys
+}
+
+// clientStore prefixes the keys of a store with the client id, so every client only sees its own packets
+type clientStore struct {
+	store     Store
+	namespace string
+}
+
+func newClientStore(store Store, clientID string) *clientStore {
+	return &clientStore{store: store, namespace: storeNamespace(clientID)}
+}
+
+// storeNamespace escapes every character of the client id but letters, digits, - and _ as %XX and ends it with a
+// dot, so the namespaces of different client ids never overlap and are valid file names
+func storeNamespace(clientID string) string {
+	namespace := strings.Builder{}
+	for _, b := range []byte(clientID) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '_' {
+			namespace.WriteByte(b)
+		} else {
+			fmt.Fprintf(&namespace, "%%%02X", b)
+		}
+	}
+	namespace.WriteByte('.')
+	return namespace.String()
+}
+
+func (s *clientStore) Put(key string, packet []byte) error {
+	return s.store.Put(s.namespace+key, packet)
+}
+
+func (s *clientStore) Get(key string) ([]byte, error) {
+	return s.store.Get(s.namespace + key)
+}
+
+func (s *clientStore) Keys() ([]string, error) {
+	keys, err := s.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	own := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, s.namespace) {
+			own = append(own, strings.TrimPrefix(key, s.namespace))
+		}
+	}
+	return own, nil
+}
+
+func (s *clientStore) Delete(key string) error {
+	return s.store.Delete(s.namespace + key)
+}
+
+// Reset only deletes the keys of the client
+func (s *clientStore) Reset() error {
+	keys, err := s.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryStore keeps the packets in memory, so they only survive reconnects
+type memoryStore struct {
+	lock    sync.Mutex
+	packets map[string][]byte
+}
+
+// NewMemoryStore creates a store that keeps the in-flight packets in memory. They survive reconnects, but not
+// restarts of the process.
+func NewMemoryStore() Store {
+	return &memoryStore{packets: map[string][]byte{}}
+}
+
+func (s *memoryStore) Put(key string, packet []byte) error {
+	s.lock.Lock()
+	s.packets[key] = packet
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.packets[key], nil
+}
+
+func (s *memoryStore) Keys() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.packets))
+	for key := range s.packets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.lock.Lock()
+	delete(s.packets, key)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Reset() error {
+	s.lock.Lock()
+	s.packets = map[string][]byte{}
+	s.lock.Unlock()
+	return nil
+}
+
+// fileExtension is appended to the key of every packet stored by a file store
+const fileExtension = ".msg"
+
+// fileStore keeps every packet in its own file in a directory
+type fileStore struct {
+	lock      sync.Mutex
+	directory string
+}
+
+// NewFileStore creates a store that keeps every in-flight packet in a file in the directory, so they survive
+// restarts of the process. The directory is created if it does not exist.
+func NewFileStore(directory string) (Store, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("mqtt: failed to create store directory: %w", err)
+	}
+	return &fileStore{directory: directory}, nil
+}
+
+func (s *fileStore) path(key string) string {
+	return filepath.Join(s.directory, key+fileExtension)
+}
+
+// Put writes the packet to a temporary file first and renames it, so a crash never leaves a partial packet behind
+func (s *fileStore) Put(key string, packet []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, err := ioutil.TempFile(s.directory, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(packet)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path(key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s *fileStore) Get(key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	packet, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return packet, err
+}
+
+func (s *fileStore) Keys() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keys()
+}
+
+func (s *fileStore) keys() ([]string, error) {
+	files, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
+			keys = append(keys, strings.TrimSuffix(file.Name(), fileExtension))
+		}
+	}
+	return keys, nil
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) Reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
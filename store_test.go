@@ -0,0 +1,281 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+func testStore(t *testing.T, store mqtt.Store) {
+	err := store.Put("o.1", []byte("first"))
+	if err != nil {
+		t.Fatalf("put should not have failed: %v", err)
+	}
+	err = store.Put("i.2", []byte("second"))
+	if err != nil {
+		t.Fatalf("put should not have failed: %v", err)
+	}
+	packet, err := store.Get("o.1")
+	if err != nil {
+		t.Fatalf("get should not have failed: %v", err)
+	}
+	if string(packet) != "first" {
+		t.Fatalf("packet should be 'first' but is %v", string(packet))
+	}
+	packet, err = store.Get("o.3")
+	if err != nil || packet != nil {
+		t.Fatalf("get of a missing key should return nil without an error but returned %v, %v", packet, err)
+	}
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatalf("keys should not have failed: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "i.2" || keys[1] != "o.1" {
+		t.Fatalf("keys should be [i.2 o.1] but are %v", keys)
+	}
+	err = store.Delete("o.1")
+	if err != nil {
+		t.Fatalf("delete should not have failed: %v", err)
+	}
+	keys, _ = store.Keys()
+	if len(keys) != 1 || keys[0] != "i.2" {
+		t.Fatalf("keys should be [i.2] but are %v", keys)
+	}
+	err = store.Reset()
+	if err != nil {
+		t.Fatalf("reset should not have failed: %v", err)
+	}
+	keys, _ = store.Keys()
+	if len(keys) != 0 {
+		t.Fatalf("keys should be empty but are %v", keys)
+	}
+}
+
+// TestMemoryStore checks that the memory store keeps packets
+func TestMemoryStore(t *testing.T) {
+	testStore(t, mqtt.NewMemoryStore())
+}
+
+// TestFileStore checks that the file store keeps packets
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-store")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := mqtt.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("creating store should not have failed: %v", err)
+	}
+	testStore(t, store)
+
+	err = store.Put("o.1", []byte("first"))
+	if err != nil {
+		t.Fatalf("put should not have failed: %v", err)
+	}
+	reopened, err := mqtt.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("creating store should not have failed: %v", err)
+	}
+	packet, err := reopened.Get("o.1")
+	if err != nil || string(packet) != "first" {
+		t.Fatalf("packet should have survived reopening the store but is %v, %v", packet, err)
+	}
+}
+
+// TestPersistentSession checks that an unacknowledged publish is resent by a new client using the same store
+func TestPersistentSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-store")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := mqtt.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("creating store should not have failed: %v", err)
+	}
+
+	unacknowledged := listenFakeBroker(t, "127.0.0.1:0", false)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			unacknowledged.server,
+		},
+		ClientID:          "TestPersistentSession",
+		PersistentSession: true,
+		Store:             store,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	if !client.SessionPresent() {
+		t.Fatal("session should be present")
+	}
+	timeout, cancel := context.WithTimeout(ctx(), 100*time.Millisecond)
+	defer cancel()
+	err = client.PublishString(timeout, "TestPersistentSession", "hello", mqtt.AtLeastOnce)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish should have failed with context.DeadlineExceeded: %v", err)
+	}
+	client.DisconnectImmediately()
+	keys, _ := store.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("the unacknowledged publish should be stored but the keys are %v", keys)
+	}
+
+	fake := newFakeBroker(t)
+	client, err = mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		ClientID:          "TestPersistentSession",
+		PersistentSession: true,
+		Store:             store,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	publish := fake.expect(t, 3)
+	if string(publish.body[2:23]) != "TestPersistentSession" {
+		t.Fatalf("the resent publish should have the topic TestPersistentSession but is %v", string(publish.body[2:23]))
+	}
+	for {
+		keys, _ = store.Keys()
+		if len(keys) == 0 {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+// TestCleanSession checks that the session is not present for clean sessions
+func TestCleanSession(t *testing.T) {
+	fake := newFakeBroker(t)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	if client.SessionPresent() {
+		t.Fatal("session should not be present")
+	}
+}
+
+// TestSharedStore checks that clients with different client ids that share a store do not resend or reset the
+// packets of each other
+func TestSharedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-store")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := mqtt.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("creating store should not have failed: %v", err)
+	}
+
+	unacknowledged := listenFakeBroker(t, "127.0.0.1:0", false)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			unacknowledged.server,
+		},
+		ClientID:          "TestSharedStore/a",
+		PersistentSession: true,
+		Store:             store,
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(ctx(), 100*time.Millisecond)
+	defer cancel()
+	err = client.PublishString(timeout, "TestSharedStore/a", "hello", mqtt.AtLeastOnce)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("publish should have failed with context.DeadlineExceeded: %v", err)
+	}
+	client.DisconnectImmediately()
+
+	for _, persistent := range []bool{true, false} {
+		fake := newFakeBroker(t)
+		other, err := mqtt.NewClient(mqtt.ClientOptions{
+			Servers: []string{
+				fake.server,
+			},
+			ClientID:          "TestSharedStore/b",
+			PersistentSession: persistent,
+			Store:             store,
+		})
+		if err != nil {
+			t.Fatalf("creating client failed: %v", err)
+		}
+		err = other.Connect(ctx())
+		if err != nil {
+			t.Fatalf("connect should not have failed: %v", err)
+		}
+		err = other.PublishString(ctx(), "TestSharedStore/b", "hello", mqtt.AtLeastOnce)
+		if err != nil {
+			t.Fatalf("publish should not have failed: %v", err)
+		}
+		expectPublishes(t, fake, "TestSharedStore/b")
+		other.DisconnectImmediately()
+	}
+
+	keys, _ := store.Keys()
+	if len(keys) != 1 || keys[0] != "TestSharedStore%2Fa.o.1" {
+		t.Fatalf("only the publish of the first client should be stored but the keys are %v", keys)
+	}
+}
+
+// TestSessionExpiryV5 checks that an mqtt 5 broker keeps a persistent session only for the session expiry
+func TestSessionExpiryV5(t *testing.T) {
+	options := mqtt.ClientOptions{
+		Servers:           []string{broker},
+		ClientID:          testUUID + "/TestSessionExpiryV5",
+		ProtocolVersion:   mqtt.ProtocolV5,
+		PersistentSession: true,
+		SessionExpiry:     time.Second,
+	}
+	client := connectClient(t, options)
+	if err := client.Subscribe(ctx(), testUUID+"/TestSessionExpiryV5", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	client.Disconnect(ctx())
+
+	client = connectClient(t, options)
+	if !client.SessionPresent() {
+		t.Fatal("the session should have been kept")
+	}
+	client.Disconnect(ctx())
+
+	time.Sleep(2 * time.Second)
+	client = connectClient(t, options)
+	defer client.DisconnectImmediately()
+	if client.SessionPresent() {
+		t.Fatal("the session should have expired")
+	}
+}
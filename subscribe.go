@@ -3,14 +3,26 @@ package mqtt
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"time"
 
-	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/lucacasonato/mqtt/packets"
 )
 
 // A Message from or to the broker
 type Message struct {
-	message paho.Message
-	vars    []string
+	topic     string
+	payload   []byte
+	qos       QOS
+	duplicate bool
+	retained  bool
+	ack       func() // Sends the acknowledgement, nil for QoS 0
+	vars      []string
+	ctx       context.Context // Carries the span the message is handled in, nil if the client has no tracer
+	expiry    time.Duration   // The message expiry of mqtt 5, 0 if the message does not expire
+	properties
 }
 
 // A MessageHandler to handle incoming messages
@@ -24,37 +36,84 @@ func (m *Message) TopicVars() []string {
 
 // Topic is the topic the message was recieved on
 func (m *Message) Topic() string {
-	return m.message.Topic()
+	return m.topic
 }
 
 // QOS is the quality of service the message was recieved with
 func (m *Message) QOS() QOS {
-	return QOS(m.message.Qos())
+	return m.qos
 }
 
 // IsDuplicate is true if this exact message has been recieved before (due to a AtLeastOnce QOS)
 func (m *Message) IsDuplicate() bool {
-	return m.message.Duplicate()
+	return m.duplicate
 }
 
-// Acknowledge explicitly acknowledges to a broker that the message has been recieved
+// IsRetained is true if the broker sent this message because it was retained on the topic
+func (m *Message) IsRetained() bool {
+	return m.retained
+}
+
+// Context returns the context the message is handled in. If the client has a Tracer it carries the span of the
+// handlers, which is a child of the span the message was published in.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// ContentType describes the content of the payload, empty if the publisher did not set it
+func (m *Message) ContentType() string {
+	return m.contentType
+}
+
+// UserProperties are the key value pairs the publisher added to the message, including the trace context
+func (m *Message) UserProperties() map[string]string {
+	return m.userProperties
+}
+
+// ResponseTopic is the topic a response to this request should be published on
+func (m *Message) ResponseTopic() string {
+	return m.responseTopic
+}
+
+// CorrelationData should be sent back with the response to this request
+func (m *Message) CorrelationData() []byte {
+	return m.correlationData
+}
+
+// Expiry is how long the message stays valid, as sent by an mqtt 5 broker. It is 0 if the message does not expire.
+func (m *Message) Expiry() time.Duration {
+	return m.expiry
+}
+
+// DedupKey identifies the message, messages with a key that was recently received are not handled again
+func (m *Message) DedupKey() string {
+	return m.dedupKey
+}
+
+// Acknowledge explicitly acknowledges to a broker that the message has been recieved. This happens automatically
+// once all handlers returned, so it is only needed to acknowledge early.
 func (m *Message) Acknowledge() {
-	m.message.Ack()
+	if m.ack != nil {
+		m.ack()
+	}
 }
 
 // Payload returns the payload as a byte array
 func (m *Message) Payload() []byte {
-	return m.message.Payload()
+	return m.payload
 }
 
 // PayloadString returns the payload as a string
 func (m *Message) PayloadString() string {
-	return string(m.message.Payload())
+	return string(m.payload)
 }
 
 // PayloadJSON unmarshals the payload into the provided interface using encoding/json and returns an error if anything fails
 func (m *Message) PayloadJSON(v interface{}) error {
-	return json.Unmarshal(m.message.Payload(), v)
+	return json.Unmarshal(m.payload, v)
 }
 
 // Handle adds a handler for a certain topic. This handler gets called if any message arrives that matches the topic.
@@ -63,6 +122,21 @@ func (c *Client) Handle(topic string, handler MessageHandler) Route {
 	return c.router.addRoute(topic, handler)
 }
 
+// handle calls the handler of a route with a message. A panicking handler is logged and returned as an error, it
+// does not stop the other handlers or the client.
+func (c *Client) handle(route Route, message Message) (err error) {
+	started := time.Now()
+	defer func() {
+		c.metrics.HandlerDuration(route.topic, time.Since(started))
+		if recovered := recover(); recovered != nil {
+			c.log.Error("message handler panicked", "route", route.topic, "topic", message.topic, "panic", recovered, "stack", string(debug.Stack()))
+			err = fmt.Errorf("mqtt: message handler panicked: %v", recovered)
+		}
+	}()
+	route.handler(message)
+	return nil
+}
+
 // Listen returns a stream of messages that match the topic.
 // Also returns a route that can be used to unsubsribe. Does not automatically subscribe.
 func (c *Client) Listen(topic string) (chan Message, Route) {
@@ -73,27 +147,105 @@ func (c *Client) Listen(topic string) (chan Message, Route) {
 	return queue, route
 }
 
-// Subscribe subscribes to a certain topic and errors if this fails.
-func (c *Client) Subscribe(ctx context.Context, topic string, qos QOS) error {
-	token := c.client.Subscribe(topic, byte(qos), nil)
-	err := tokenWithContext(ctx, token)
+// SubscribeOption sets an mqtt 5 option of a subscription, they are ignored with 3.1.1
+type SubscribeOption func(*packets.Subscription)
+
+// RetainHandling decides when the broker sends the retained messages of a subscription
+type RetainHandling byte
+
+const (
+	// RetainSendAlways sends the retained messages on every subscribe, like mqtt 3.1.1
+	RetainSendAlways RetainHandling = iota
+	// RetainSendNew only sends the retained messages if the subscription did not exist yet
+	RetainSendNew
+	// RetainSendNever does not send retained messages
+	RetainSendNever
+)
+
+// WithNoLocal tells the broker not to send the messages that the client published itself
+func WithNoLocal() SubscribeOption {
+	return func(s *packets.Subscription) {
+		s.NoLocal = true
+	}
+}
+
+// WithRetainAsPublished keeps the retain flag of the messages as they were published, instead of only setting it
+// for the retained messages that are sent on subscribing
+func WithRetainAsPublished() SubscribeOption {
+	return func(s *packets.Subscription) {
+		s.RetainAsPublished = true
+	}
+}
+
+// WithRetainHandling decides when the broker sends the retained messages of the subscription
+func WithRetainHandling(handling RetainHandling) SubscribeOption {
+	return func(s *packets.Subscription) {
+		s.RetainHandling = byte(handling)
+	}
+}
+
+// Subscribe subscribes to a certain topic and errors if this fails. The subscription is restored automatically
+// after the client reconnects. If the broker rejects the topic the error is a *SubscriptionRejectedError.
+func (c *Client) Subscribe(ctx context.Context, topic string, qos QOS, options ...SubscribeOption) error {
+	_, err := c.SubscribeGranted(ctx, map[string]QOS{topic: qos}, options...)
 	return err
 }
 
-// SubscribeMultiple subscribes to multiple topics and errors if this fails.
-func (c *Client) SubscribeMultiple(ctx context.Context, subscriptions map[string]QOS) error {
-	subs := make(map[string]byte, len(subscriptions))
+// SubscribeMultiple subscribes to multiple topics and errors if this fails. The options apply to every topic.
+func (c *Client) SubscribeMultiple(ctx context.Context, subscriptions map[string]QOS, options ...SubscribeOption) error {
+	_, err := c.SubscribeGranted(ctx, subscriptions, options...)
+	return err
+}
+
+// SubscribeGranted subscribes to multiple topics and returns the QoS the broker granted for every topic, which
+// can be lower than the requested one. If the broker rejects some of the topics the others are still subscribed,
+// they are returned along with a *SubscriptionRejectedError for the first rejected topic.
+func (c *Client) SubscribeGranted(ctx context.Context, subscriptions map[string]QOS, options ...SubscribeOption) (map[string]QOS, error) {
+	subs := make([]packets.Subscription, 0, len(subscriptions))
 	for topic, qos := range subscriptions {
-		subs[topic] = byte(qos)
+		sub := packets.Subscription{Topic: topic, QOS: byte(qos)}
+		for _, option := range options {
+			option(&sub)
+		}
+		subs = append(subs, sub)
 	}
-	token := c.client.SubscribeMultiple(subs, nil)
-	err := tokenWithContext(ctx, token)
-	return err
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Topic < subs[j].Topic
+	})
+	if err := c.begin(ctx); err != nil {
+		return nil, err
+	}
+	token := c.core.subscribe(ctx, subs)
+	c.releaseWhenDone(token)
+	if err := tokenWithContext(ctx, token); err != nil {
+		return nil, err
+	}
+	granted, err := grantedQOS(subs, token.granted)
+	for _, sub := range subs {
+		if qos, ok := granted[sub.Topic]; ok {
+			c.subscriptions.add(sub)
+			c.log.Info("subscribed", "topic", sub.Topic, "qos", qos)
+		}
+	}
+	for _, sub := range subs {
+		if _, ok := granted[sub.Topic]; !ok {
+			c.log.Warn("subscription rejected", "topic", sub.Topic)
+		}
+	}
+	return granted, err
 }
 
 // Unsubscribe unsubscribes from a certain topic and errors if this fails.
 func (c *Client) Unsubscribe(ctx context.Context, topic string) error {
-	token := c.client.Unsubscribe(topic)
+	if err := c.begin(ctx); err != nil {
+		return err
+	}
+	c.subscriptions.remove(topic)
+	token := c.core.unsubscribe(ctx, []string{topic})
+	c.releaseWhenDone(token)
 	err := tokenWithContext(ctx, token)
+	if err == nil {
+		c.log.Info("unsubscribed", "topic", topic)
+	}
 	return err
 }
@@ -1,18 +1,16 @@
 package mqtt_test
 
 import (
-	"context"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+	"github.com/lucacasonato/mqtt/packets"
 )
 
-func ctx() context.Context {
-	c, _ := context.WithTimeout(context.Background(), 1*time.Second)
-	return c
-}
-
 // TestSubcribeSuccess checks that a message gets recieved correctly
 func TestSubcribeSuccess(t *testing.T) {
 	client, err := mqtt.NewClient(mqtt.ClientOptions{
@@ -184,6 +182,47 @@ func TestSubcribeFailure(t *testing.T) {
 	}
 }
 
+// TestSubscribeRejected checks that topics rejected by the broker fail with their topic while the others are granted
+func TestSubscribeRejected(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.SetAuthorizer(func(clientID, filter string) bool {
+		return !strings.HasPrefix(filter, "secret/")
+	})
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker.URL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+
+	granted, err := client.SubscribeGranted(ctx(), map[string]mqtt.QOS{
+		"public/#": mqtt.ExactlyOnce,
+		"secret/a": mqtt.AtLeastOnce,
+		"secret/b": mqtt.AtLeastOnce,
+		"public/b": mqtt.AtMostOnce,
+	})
+	var rejected *mqtt.SubscriptionRejectedError
+	if !errors.As(err, &rejected) || rejected.Topic != "secret/a" {
+		t.Fatalf("subscribe should have been rejected for secret/a but failed with %v", err)
+	}
+	if len(granted) != 2 || granted["public/#"] != mqtt.ExactlyOnce || granted["public/b"] != mqtt.AtMostOnce {
+		t.Fatalf("the public topics should have been granted but granted is %v", granted)
+	}
+
+	err = client.Subscribe(ctx(), "secret/c", mqtt.AtMostOnce)
+	if !errors.As(err, &rejected) || rejected.Topic != "secret/c" {
+		t.Fatalf("subscribe should have been rejected for secret/c but failed with %v", err)
+	}
+}
+
 // TestSubcribeSuccess checks that a message gets recieved correctly
 func TestSubcribeSuccessAdvancedRouting(t *testing.T) {
 	client, err := mqtt.NewClient(mqtt.ClientOptions{
@@ -324,3 +363,94 @@ func TestEmptyRoute(t *testing.T) {
 	}
 	client.Handle(testUUID+"/TestEmptyRoute/abc", nil)
 }
+
+// TestReceive checks that received QoS 1 and 2 messages are acknowledged and that a resent QoS 2 message is only
+// handled once
+func TestReceive(t *testing.T) {
+	fake := newFakeBroker(t)
+	defer fake.close()
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	messages, _ := client.Listen("TestReceive/#")
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	conn := <-fake.conns
+
+	packets.Write(conn, &packets.Publish{QOS: 1, Topic: "TestReceive/1", PacketID: 1, Payload: []byte("hello")})
+	message := <-messages
+	if message.Topic() != "TestReceive/1" || message.PayloadString() != "hello" || message.QOS() != mqtt.AtLeastOnce {
+		t.Fatalf("received the wrong message: %v %v %v", message.Topic(), message.PayloadString(), message.QOS())
+	}
+	fake.expect(t, byte(packets.TypePuback))
+
+	publish := &packets.Publish{QOS: 2, Topic: "TestReceive/2", PacketID: 2, Payload: []byte("hello")}
+	packets.Write(conn, publish)
+	message = <-messages
+	if message.Topic() != "TestReceive/2" {
+		t.Fatalf("received the wrong message: %v", message.Topic())
+	}
+	fake.expect(t, byte(packets.TypePubrec))
+	publish.Dup = true
+	packets.Write(conn, publish)
+	fake.expect(t, byte(packets.TypePubrec))
+	packets.Write(conn, &packets.Pubrel{PacketID: 2})
+	fake.expect(t, byte(packets.TypePubcomp))
+
+	select {
+	case message := <-messages:
+		t.Fatalf("the resent message should not have been handled again: %v", message.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestSubscribeOptionsV5 checks that the broker applies the mqtt 5 subscription options
+func TestSubscribeOptionsV5(t *testing.T) {
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, ProtocolVersion: mqtt.ProtocolV5})
+	defer client.DisconnectImmediately()
+	other := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}})
+	defer other.DisconnectImmediately()
+
+	topic := testUUID + "/TestSubscribeOptionsV5"
+	messages := make(chan mqtt.Message, 10)
+	client.Handle(topic+"/#", func(message mqtt.Message) {
+		messages <- message
+	})
+	if err := other.PublishString(ctx(), topic+"/retained", "old", mqtt.AtLeastOnce, mqtt.WithRetain()); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	defer other.Publish(ctx(), topic+"/retained", nil, mqtt.AtLeastOnce, mqtt.WithRetain())
+
+	err := client.Subscribe(ctx(), topic+"/local", mqtt.AtLeastOnce, mqtt.WithNoLocal())
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.Subscribe(ctx(), topic+"/retained", mqtt.AtLeastOnce, mqtt.WithRetainHandling(mqtt.RetainSendNever), mqtt.WithRetainAsPublished())
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if err := client.PublishString(ctx(), topic+"/local", "own", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if err := other.PublishString(ctx(), topic+"/local", "other", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if err := other.PublishString(ctx(), topic+"/retained", "new", mqtt.AtLeastOnce, mqtt.WithRetain()); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+
+	if message := receive(t, messages); message.PayloadString() != "other" {
+		t.Fatalf("the own message should not have been received but received %v", message.PayloadString())
+	}
+	if message := receive(t, messages); message.PayloadString() != "new" || !message.IsRetained() {
+		t.Fatalf("only the new message should have been received with its retain flag but received %v", message.PayloadString())
+	}
+}
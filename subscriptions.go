@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lucacasonato/mqtt/packets"
+)
+
+// An ErrorHandler gets called with errors that happen in the background and can not be returned to a caller
+type ErrorHandler func(error)
+
+// subscriptions remembers the active subscriptions so they can be restored after reconnecting
+type subscriptions struct {
+	lock   sync.Mutex
+	topics map[string]packets.Subscription
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{topics: map[string]packets.Subscription{}}
+}
+
+func (s *subscriptions) add(subscription packets.Subscription) {
+	s.lock.Lock()
+	s.topics[subscription.Topic] = subscription
+	s.lock.Unlock()
+}
+
+func (s *subscriptions) remove(topic string) {
+	s.lock.Lock()
+	delete(s.topics, topic)
+	s.lock.Unlock()
+}
+
+func (s *subscriptions) clear() {
+	s.lock.Lock()
+	s.topics = map[string]packets.Subscription{}
+	s.lock.Unlock()
+}
+
+func (s *subscriptions) all() []packets.Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	topics := make([]packets.Subscription, 0, len(s.topics))
+	for _, subscription := range s.topics {
+		topics = append(topics, subscription)
+	}
+	return topics
+}
+
+// resubscribe restores all active subscriptions on a new connection and reports failures to the error handler
+func (c *Client) resubscribe() {
+	topics := c.subscriptions.all()
+	if len(topics) == 0 {
+		return
+	}
+	token := c.core.subscribe(context.Background(), topics)
+	token.Wait()
+	err := token.Error()
+	if err == nil {
+		// topics the broker rejects now are forgotten, they would be rejected after every reconnect
+		var granted map[string]QOS
+		granted, err = grantedQOS(topics, token.granted)
+		for _, topic := range topics {
+			if _, ok := granted[topic.Topic]; !ok {
+				c.log.Warn("subscription rejected after reconnecting", "topic", topic.Topic)
+				c.subscriptions.remove(topic.Topic)
+			}
+		}
+		c.log.Info("restored subscriptions", "topics", len(granted))
+	}
+	if err != nil {
+		c.log.Error("failed to restore subscriptions", "error", err)
+	}
+	if err != nil && c.Options.OnResubscribeError != nil {
+		c.Options.OnResubscribeError(fmt.Errorf("mqtt: failed to restore subscriptions: %w", err))
+	}
+}
+
+// grantedQOS matches the return codes of a suback with the topics. Rejected topics are left out and the first
+// one is returned as error. Mqtt 5 brokers reject topics with any reason code from SubackFailure on.
+func grantedQOS(topics []packets.Subscription, codes []byte) (map[string]QOS, error) {
+	granted := map[string]QOS{}
+	var err error
+	for i, topic := range topics {
+		if i >= len(codes) || codes[i] >= packets.SubackFailure {
+			if err == nil {
+				code := ReasonUnspecifiedError
+				if i < len(codes) {
+					code = ReasonCode(codes[i])
+				}
+				err = &SubscriptionRejectedError{Topic: topic.Topic, Code: code}
+			}
+			continue
+		}
+		granted[topic.Topic] = QOS(codes[i])
+	}
+	return granted, err
+}
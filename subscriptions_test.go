@@ -0,0 +1,61 @@
+package mqtt_test
+
+import (
+	"testing"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// TestResubscribe checks that active subscriptions are restored after the client reconnects
+func TestResubscribe(t *testing.T) {
+	fake := newFakeBroker(t)
+	connected := make(chan struct{}, 10)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			fake.server,
+		},
+		AutoReconnect: true,
+		OnEvent: func(event mqtt.Event) {
+			if event.Type == mqtt.EventConnected {
+				connected <- struct{}{}
+			}
+		},
+		OnResubscribeError: func(err error) {
+			t.Errorf("resubscribing should not have failed: %v", err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	defer client.DisconnectImmediately()
+	<-connected
+
+	err = client.Subscribe(ctx(), "TestResubscribe/a", mqtt.AtLeastOnce)
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.SubscribeMultiple(ctx(), map[string]mqtt.QOS{
+		"TestResubscribe/b": mqtt.ExactlyOnce,
+		"TestResubscribe/c": mqtt.AtMostOnce,
+	})
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.Unsubscribe(ctx(), "TestResubscribe/c")
+	if err != nil {
+		t.Fatalf("unsubscribe should not have failed: %v", err)
+	}
+
+	fake.expect(t, 10)
+	(<-fake.conns).Close()
+	fake.expect(t, 1)
+	topics := subscribedTopics(fake.expect(t, 8))
+	if len(topics) != 2 || topics["TestResubscribe/a"] != 1 || topics["TestResubscribe/b"] != 2 {
+		t.Fatalf("the restored subscriptions should be a and b but are %v", topics)
+	}
+	<-connected
+}
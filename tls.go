@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// TLSOptions configures the tls connection used for the ssl, tls, tcps, mqtts and wss schemes
+type TLSOptions struct {
+	Config     *tls.Config // A base config that is cloned, the fields below take precedence over it when set
+	CAFile     string      // A PEM bundle of certificate authorities used to verify the server instead of the system pool
+	CertFile   string      // A PEM client certificate used for mutual tls, KeyFile needs to be set as well
+	KeyFile    string      // The PEM private key belonging to CertFile
+	ServerName string      // Overrides the name used to verify the server certificate
+}
+
+var (
+	// ErrIncompleteKeyPair means that only one of the client certificate and key files was specified in the tls options
+	ErrIncompleteKeyPair = errors.New("mqtt: both the tls certificate and key file need to be specified")
+	// ErrInvalidCA means that no certificates could be parsed from the CA file in the tls options
+	ErrInvalidCA = errors.New("mqtt: the tls CA file does not contain any PEM certificates")
+)
+
+func (o *TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{}
+	if o.Config != nil {
+		config = o.Config.Clone()
+	}
+
+	// server verification
+	if o.ServerName != "" {
+		config.ServerName = o.ServerName
+	}
+	if o.CAFile != "" {
+		data, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: failed to read tls CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCA
+		}
+		config.RootCAs = pool
+	}
+
+	// client certificate
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, ErrIncompleteKeyPair
+		}
+		loader := &certificateLoader{certFile: o.CertFile, keyFile: o.KeyFile}
+		if _, err := loader.load(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = loader.clientCertificate
+	}
+
+	return config, nil
+}
+
+// certificateLoader reads the client key pair from disk on every handshake so rotated certificates are
+// picked up when reconnecting
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	last     *tls.Certificate
+}
+
+func (l *certificateLoader) load() (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: failed to load tls key pair: %w", err)
+	}
+	l.lock.Lock()
+	l.last = &certificate
+	l.lock.Unlock()
+	return &certificate, nil
+}
+
+// clientCertificate falls back to the last certificate that loaded successfully, so a rotation that is
+// only half written does not break the reconnect
+func (l *certificateLoader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certificate, err := l.load()
+	if err != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return l.last, nil
+	}
+	return certificate, nil
+}
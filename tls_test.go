@@ -0,0 +1,273 @@
+package mqtt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate signed by the parent or a self-signed CA if the parent is nil
+func newTestCertificate(t *testing.T, parent *testCertificate, name string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("creating certificate failed: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key failed: %v", err)
+	}
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// tlsBroker starts a tls listener that requires a client certificate signed by the CA and acknowledges every
+// connect packet it receives. The common names of the client certificates are sent on the returned channel.
+func tlsBroker(t *testing.T, ca *testCertificate, server *testCertificate) (string, chan string) {
+	keyPair, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatalf("loading server key pair failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handshake(conn.(*tls.Conn), clients)
+		}
+	}()
+	return "ssl://" + listener.Addr().String(), clients
+}
+
+func handshake(conn *tls.Conn, clients chan string) {
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	clients <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	acknowledge(conn, nil, true)
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("writing %v failed: %v", name, err)
+	}
+	return path
+}
+
+// TestTLSMutualAuthentication checks that a client verifies the server with a CA file and authenticates with a client certificate
+func TestTLSMutualAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, nil, "ca")
+	serverCertificate := newTestCertificate(t, ca, "broker.test")
+	clientCertificate := newTestCertificate(t, ca, "client")
+
+	server, clients := tlsBroker(t, ca, serverCertificate)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			server,
+		},
+		TLS: &mqtt.TLSOptions{
+			CAFile:     writeTestFile(t, dir, "ca.pem", ca.certPEM),
+			CertFile:   writeTestFile(t, dir, "client.pem", clientCertificate.certPEM),
+			KeyFile:    writeTestFile(t, dir, "client.key", clientCertificate.keyPEM),
+			ServerName: "broker.test",
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	client.DisconnectImmediately()
+	if name := <-clients; name != "client" {
+		t.Fatalf("server should have seen the client certificate 'client' but saw %v", name)
+	}
+}
+
+// TestTLSCertificateReload checks that a rotated client certificate is used when connecting again
+func TestTLSCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, nil, "ca")
+	serverCertificate := newTestCertificate(t, ca, "broker.test")
+	clientCertificate := newTestCertificate(t, ca, "client")
+	rotatedCertificate := newTestCertificate(t, ca, "rotated")
+
+	server, clients := tlsBroker(t, ca, serverCertificate)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			server,
+		},
+		TLS: &mqtt.TLSOptions{
+			CAFile:     writeTestFile(t, dir, "ca.pem", ca.certPEM),
+			CertFile:   writeTestFile(t, dir, "client.pem", clientCertificate.certPEM),
+			KeyFile:    writeTestFile(t, dir, "client.key", clientCertificate.keyPEM),
+			ServerName: "broker.test",
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	client.DisconnectImmediately()
+	if name := <-clients; name != "client" {
+		t.Fatalf("server should have seen the client certificate 'client' but saw %v", name)
+	}
+
+	writeTestFile(t, dir, "client.pem", rotatedCertificate.certPEM)
+	writeTestFile(t, dir, "client.key", rotatedCertificate.keyPEM)
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	client.DisconnectImmediately()
+	if name := <-clients; name != "rotated" {
+		t.Fatalf("server should have seen the client certificate 'rotated' but saw %v", name)
+	}
+}
+
+// TestTLSUnknownAuthority checks that a client does not connect to a server signed by an unknown CA
+func TestTLSUnknownAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, nil, "ca")
+	serverCertificate := newTestCertificate(t, ca, "broker.test")
+	clientCertificate := newTestCertificate(t, ca, "client")
+
+	server, _ := tlsBroker(t, ca, serverCertificate)
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			server,
+		},
+		TLS: &mqtt.TLSOptions{
+			CertFile:   writeTestFile(t, dir, "client.pem", clientCertificate.certPEM),
+			KeyFile:    writeTestFile(t, dir, "client.key", clientCertificate.keyPEM),
+			ServerName: "broker.test",
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err == nil {
+		t.Fatal("connect should have failed")
+	}
+}
+
+// TestTLSIncompleteKeyPair checks that creating a client with only a certificate file fails
+func TestTLSIncompleteKeyPair(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		TLS: &mqtt.TLSOptions{
+			CertFile: "client.pem",
+		},
+	})
+	if !errors.Is(err, mqtt.ErrIncompleteKeyPair) {
+		t.Fatalf("err should be ErrIncompleteKeyPair: %v", err)
+	}
+	if client != nil {
+		t.Fatal("client should be nil")
+	}
+}
+
+// TestTLSInvalidCA checks that creating a client with a CA file without certificates fails
+func TestTLSInvalidCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		TLS: &mqtt.TLSOptions{
+			CAFile: writeTestFile(t, dir, "ca.pem", []byte("not a certificate")),
+		},
+	})
+	if !errors.Is(err, mqtt.ErrInvalidCA) {
+		t.Fatalf("err should be ErrInvalidCA: %v", err)
+	}
+}
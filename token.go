@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// token tracks an operation on the broker that completes in the background
+type token struct {
+	done           chan struct{}
+	once           sync.Once
+	err            error
+	sessionPresent bool   // Only set for connect
+	granted        []byte // The granted QoS of every topic, only set for subscribe
+	lock           sync.Mutex
+	callbacks      []func()
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+// failedToken returns a token that already completed with the error
+func failedToken(err error) *token {
+	t := newToken()
+	t.complete(err)
+	return t
+}
+
+// complete finishes the operation, only the first call has an effect
+func (t *token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+		t.lock.Lock()
+		callbacks := t.callbacks
+		t.callbacks = nil
+		t.lock.Unlock()
+		for _, callback := range callbacks {
+			callback()
+		}
+	})
+}
+
+// then calls the callback once the operation completed, right away if it already did. Callbacks run in the
+// goroutine that completes the operation so they should not block, but no goroutine waits for every operation.
+func (t *token) then(callback func()) {
+	t.lock.Lock()
+	select {
+	case <-t.done:
+		t.lock.Unlock()
+		callback()
+		return
+	default:
+	}
+	t.callbacks = append(t.callbacks, callback)
+	t.lock.Unlock()
+}
+
+// Done returns a channel that is closed once the operation completed
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the operation completed
+func (t *token) Wait() {
+	<-t.done
+}
+
+// WaitTimeout blocks until the operation completed or the timeout passed and returns false in the latter case
+func (t *token) WaitTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Error returns the error of the completed operation
+func (t *token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package mqtt
+
+import "context"
+
+// A Tracer starts the spans of published and handled messages and propagates their context between services. It
+// is modeled after OpenTelemetry, so an adapter only needs a trace.Tracer and a propagation.TextMapPropagator.
+type Tracer interface {
+	// Start starts a span that is a child of the span in the context and returns a context that carries it
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+	// Inject writes the span context of ctx into the carrier, for example as a W3C traceparent
+	Inject(ctx context.Context, carrier map[string]string)
+	// Extract returns a context that carries the remote span context from the carrier
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+// A Span started by a Tracer
+type Span interface {
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// End finishes the span
+	End()
+}
+
+// SpanKind is the role of the client in a span
+type SpanKind int
+
+const (
+	// SpanKindProducer is used for the span of a publish
+	SpanKindProducer SpanKind = iota
+	// SpanKindConsumer is used for the span of the handlers processing a message
+	SpanKindConsumer
+)
+
+// startPublish starts the span of a publish and adds its context to the user properties. The context is only
+// propagated if the message can carry properties, as mqtt 5 or with the Envelope option, the tracer never changes
+// the payload on its own.
+func (c *Client) startPublish(ctx context.Context, topic string, options *publishOptions) (context.Context, Span) {
+	ctx, span := c.tracer.Start(ctx, "publish "+topic, SpanKindProducer)
+	if c.Options.ProtocolVersion != ProtocolV5 && !c.Options.Envelope {
+		return ctx, span
+	}
+	if options.userProperties == nil {
+		options.userProperties = map[string]string{}
+	}
+	c.tracer.Inject(ctx, options.userProperties)
+	return ctx, span
+}
+
+// startProcess starts the span of the handlers of a message as a child of the span it was published in
+func (c *Client) startProcess(message *Message) Span {
+	ctx := c.tracer.Extract(context.Background(), message.userProperties)
+	ctx, span := c.tracer.Start(ctx, "process "+message.topic, SpanKindConsumer)
+	message.ctx = ctx
+	return span
+}
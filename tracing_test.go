@@ -0,0 +1,196 @@
+package mqtt_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+type spanKey struct{}
+
+// fakeSpan records how it was started and ended
+type fakeSpan struct {
+	tracer *fakeTracer
+	id     string
+	name   string
+	kind   mqtt.SpanKind
+	parent string
+	err    error
+	ended  bool
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.tracer.lock.Lock()
+	s.err = err
+	s.tracer.lock.Unlock()
+}
+
+func (s *fakeSpan) End() {
+	s.tracer.lock.Lock()
+	s.ended = true
+	s.tracer.lock.Unlock()
+}
+
+// fakeTracer keeps the id of the current span in the context and propagates it as traceparent
+type fakeTracer struct {
+	lock  sync.Mutex
+	spans map[string]*fakeSpan
+}
+
+func newFakeTracer() *fakeTracer {
+	return &fakeTracer{spans: map[string]*fakeSpan{}}
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, kind mqtt.SpanKind) (context.Context, mqtt.Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	parent, _ := ctx.Value(spanKey{}).(string)
+	span := &fakeSpan{tracer: t, id: strconv.Itoa(len(t.spans) + 1), name: name, kind: kind, parent: parent}
+	t.spans[span.id] = span
+	return context.WithValue(ctx, spanKey{}, span.id), span
+}
+
+func (t *fakeTracer) Inject(ctx context.Context, carrier map[string]string) {
+	if id, ok := ctx.Value(spanKey{}).(string); ok {
+		carrier["traceparent"] = id
+	}
+}
+
+func (t *fakeTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if id, ok := carrier["traceparent"]; ok {
+		return context.WithValue(ctx, spanKey{}, id)
+	}
+	return ctx
+}
+
+// find returns a copy of the span with the id
+func (t *fakeTracer) find(id string) fakeSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if span, ok := t.spans[id]; ok {
+		return *span
+	}
+	return fakeSpan{}
+}
+
+// current returns a copy of the span in the context
+func (t *fakeTracer) current(ctx context.Context) fakeSpan {
+	id, _ := ctx.Value(spanKey{}).(string)
+	return t.find(id)
+}
+
+// TestTracing checks that the span of a publish is the parent of the span the message is handled in
+func TestTracing(t *testing.T) {
+	tracer := newFakeTracer()
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Tracer: tracer, Envelope: true})
+	defer client.DisconnectImmediately()
+	plain := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Envelope: true})
+	defer plain.DisconnectImmediately()
+
+	topic := testUUID + "/TestTracing"
+	traced := make(chan mqtt.Message, 2)
+	client.Handle(topic, func(message mqtt.Message) {
+		traced <- message
+	})
+	raw := make(chan mqtt.Message, 2)
+	plain.Handle(topic, func(message mqtt.Message) {
+		raw <- message
+	})
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if err := plain.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+
+	request, requestSpan := tracer.Start(ctx(), "GET /orders", mqtt.SpanKindConsumer)
+	err := client.PublishJSON(request, topic, map[string]string{"order": "42"}, mqtt.AtLeastOnce)
+	requestSpan.End()
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+
+	message := receive(t, traced)
+	if message.PayloadString() != `{"order":"42"}` {
+		t.Fatalf("payload should have been unwrapped but is %v", message.PayloadString())
+	}
+	process := tracer.current(message.Context())
+	if process.name != "process "+topic || process.kind != mqtt.SpanKindConsumer {
+		t.Fatalf("the message should have been handled in a consumer span but is %+v", process)
+	}
+	// the span of the publish ends right after the publish returned
+	publish := tracer.find(process.parent)
+	for deadline := time.Now().Add(5 * time.Second); !publish.ended && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		publish = tracer.find(process.parent)
+	}
+	if publish.name != "publish "+topic || publish.kind != mqtt.SpanKindProducer || publish.parent != "1" || !publish.ended {
+		t.Fatalf("the parent should have been the ended publish span in the request but is %+v", publish)
+	}
+
+	// clients without a tracer get the trace context as a user property
+	message = receive(t, raw)
+	if message.PayloadString() != `{"order":"42"}` || message.UserProperties()["traceparent"] != publish.id {
+		t.Fatalf("the message should have had the payload and the trace context but is %v %v", message.PayloadString(), message.UserProperties())
+	}
+	if message.Context() != context.Background() {
+		t.Fatal("the message should not have been handled in a span")
+	}
+
+	// binary payloads are base64 encoded and messages without an envelope are passed on unchanged
+	if err := client.Publish(ctx(), topic, []byte{0, 1, 2}, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if message = receive(t, traced); message.PayloadString() != "\x00\x01\x02" {
+		t.Fatalf("binary payload should have been unwrapped but is %q", message.PayloadString())
+	}
+	receive(t, raw)
+	if err := plain.PublishString(ctx(), topic, `{"properties":"none"}`, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	message = receive(t, traced)
+	if message.PayloadString() != `{"properties":"none"}` || tracer.current(message.Context()).parent != "" {
+		t.Fatalf("message without an envelope should have been handled in a new trace: %v", message.PayloadString())
+	}
+	receive(t, raw)
+}
+
+// TestTracingWithoutProperties checks that the tracer does not change the payload when the messages can not carry
+// the trace context
+func TestTracingWithoutProperties(t *testing.T) {
+	tracer := newFakeTracer()
+	fake := newFakeBroker(t)
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{fake.server}, Tracer: tracer})
+	defer client.DisconnectImmediately()
+
+	if err := client.PublishString(ctx(), "TestTracingWithoutProperties", "hello", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if payload := string(publishedPayload(fake.expect(t, 3))); payload != "hello" {
+		t.Fatalf("the payload should have been sent as is but was %v", payload)
+	}
+}
+
+// TestTracingV5 checks that mqtt 5 propagates the trace context as a user property without an envelope
+func TestTracingV5(t *testing.T) {
+	tracer := newFakeTracer()
+	client := connectClient(t, mqtt.ClientOptions{Servers: []string{broker}, Tracer: tracer, ProtocolVersion: mqtt.ProtocolV5})
+	defer client.DisconnectImmediately()
+
+	topic := testUUID + "/TestTracingV5"
+	messages, _ := client.Listen(topic)
+	if err := client.Subscribe(ctx(), topic, mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	if err := client.PublishString(ctx(), topic, "hello", mqtt.AtLeastOnce); err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	message := receive(t, messages)
+	if message.PayloadString() != "hello" || message.UserProperties()["traceparent"] == "" {
+		t.Fatalf("the message should have had the payload and the trace context but is %v %v", message.PayloadString(), message.UserProperties())
+	}
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+)
+
+// tracker keeps count of the operations that are still running so they can be drained before disconnecting
+type tracker struct {
+	lock   sync.Mutex
+	closed bool
+	count  int
+	idle   chan struct{}
+}
+
+func newTracker() *tracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &tracker{idle: idle}
+}
+
+// acquire registers a new operation and returns false if the tracker is closed and no new operations are accepted
+func (t *tracker) acquire() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.add()
+	return true
+}
+
+// track registers an operation that is already running, even if the tracker is closed
+func (t *tracker) track() {
+	t.lock.Lock()
+	t.add()
+	t.lock.Unlock()
+}
+
+func (t *tracker) add() {
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+}
+
+// release marks an operation as finished
+func (t *tracker) release() {
+	t.lock.Lock()
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+	}
+	t.lock.Unlock()
+}
+
+// close stops the tracker from accepting new operations
+func (t *tracker) close() {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+}
+
+// open allows the tracker to accept new operations again
+func (t *tracker) open() {
+	t.lock.Lock()
+	t.closed = false
+	t.lock.Unlock()
+}
+
+// wait blocks until all operations have finished or the context expires
+func (t *tracker) wait(ctx context.Context) error {
+	t.lock.Lock()
+	idle := t.idle
+	t.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-idle:
+		return nil
+	}
+}
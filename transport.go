@@ -0,0 +1,33 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"net/url"
+)
+
+// Transport opens the network connection to a broker. Set it in the client options to connect through something
+// else than the built-in schemes, like an in-memory pipe or a custom proxy.
+type Transport interface {
+	// Dial connects to one of the servers in the client options, ctx is done when the connect timeout passed
+	Dial(ctx context.Context, server *url.URL) (net.Conn, error)
+}
+
+// TransportFunc is a function that dials a server, it implements Transport
+type TransportFunc func(ctx context.Context, server *url.URL) (net.Conn, error)
+
+// Dial calls the function
+func (f TransportFunc) Dial(ctx context.Context, server *url.URL) (net.Conn, error) {
+	return f(ctx, server)
+}
+
+// PipeTransport connects to a broker in the same process through in-memory pipes instead of the network. For
+// every connection serve is started in its own goroutine with the broker side of the pipe, for example with
+// the ServeConn method of an mqtttest broker.
+func PipeTransport(serve func(conn net.Conn)) Transport {
+	return TransportFunc(func(ctx context.Context, server *url.URL) (net.Conn, error) {
+		client, broker := net.Pipe()
+		go serve(broker)
+		return client, nil
+	})
+}
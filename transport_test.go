@@ -0,0 +1,71 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/lucacasonato/mqtt"
+	"github.com/lucacasonato/mqtt/mqtttest"
+)
+
+// TestPipeTransport checks that a client can talk to an in-process broker without the network
+func TestPipeTransport(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers:   []string{"pipe://broker"},
+		Transport: mqtt.PipeTransport(broker.ServeConn),
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	defer client.DisconnectImmediately()
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+
+	messages, route := client.Listen("pipe")
+	defer route.Stop()
+	err = client.Subscribe(ctx(), "pipe", mqtt.ExactlyOnce)
+	if err != nil {
+		t.Fatalf("subscribe should not have failed: %v", err)
+	}
+	err = client.PublishString(ctx(), "pipe", "hello", mqtt.ExactlyOnce)
+	if err != nil {
+		t.Fatalf("publish should not have failed: %v", err)
+	}
+	if message := <-messages; message.PayloadString() != "hello" {
+		t.Fatalf("message payload should have been hello but is %v", message.PayloadString())
+	}
+}
+
+// TestTransportFunc checks that a custom transport dials the servers in order and that its errors are returned
+func TestTransportFunc(t *testing.T) {
+	failed := errors.New("unreachable")
+	dialed := []string{}
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{"first:1883", "custom://second"},
+		Transport: mqtt.TransportFunc(func(ctx context.Context, server *url.URL) (net.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("dial context should have the connect timeout as deadline")
+			}
+			dialed = append(dialed, server.String())
+			return nil, failed
+		}),
+	})
+	if err != nil {
+		t.Fatalf("creating client should not have failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if !errors.Is(err, failed) {
+		t.Fatalf("connect should have failed with the transport error but failed with %v", err)
+	}
+	if len(dialed) != 2 || dialed[0] != "tcp://first:1883" || dialed[1] != "custom://second" {
+		t.Fatalf("both servers should have been dialed but were %v", dialed)
+	}
+}
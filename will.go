@@ -0,0 +1,34 @@
+package mqtt
+
+import "encoding/json"
+
+// Will is a message the broker publishes on behalf of the client when the connection is lost unexpectedly
+type Will struct {
+	Topic    string // The topic the will is published on
+	Payload  []byte // The payload of the will
+	QOS      QOS    // The quality of service the will is published with
+	Retained bool   // If the broker should retain the will
+}
+
+// NewWill creates a will with a byte array payload. Of the publish options only the retain option applies to wills.
+func NewWill(topic string, payload []byte, qos QOS, options ...PublishOption) *Will {
+	return newWill(topic, payload, qos, options)
+}
+
+// NewWillString creates a will with a string payload
+func NewWillString(topic string, payload string, qos QOS, options ...PublishOption) *Will {
+	return newWill(topic, []byte(payload), qos, options)
+}
+
+// NewWillJSON creates a will with the payload encoded as JSON using encoding/json
+func NewWillJSON(topic string, payload interface{}, qos QOS, options ...PublishOption) (*Will, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return newWill(topic, data, qos, options), nil
+}
+
+func newWill(topic string, payload []byte, qos QOS, options []PublishOption) *Will {
+	return &Will{Topic: topic, Payload: payload, QOS: qos, Retained: newPublishOptions(options).retained}
+}
@@ -0,0 +1,65 @@
+package mqtt_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lucacasonato/mqtt"
+)
+
+// TestNewWillString checks that a string will gets created with the right fields
+func TestNewWillString(t *testing.T) {
+	will := mqtt.NewWillString(testUUID+"/TestNewWillString", "offline", mqtt.AtLeastOnce, mqtt.Retain)
+	if will.Topic != testUUID+"/TestNewWillString" {
+		t.Fatalf("will topic should be %v but is %v", testUUID+"/TestNewWillString", will.Topic)
+	}
+	if string(will.Payload) != "offline" {
+		t.Fatalf("will payload should be 'offline' but is %v", string(will.Payload))
+	}
+	if will.QOS != mqtt.AtLeastOnce {
+		t.Fatalf("will qos should be mqtt.AtLeastOnce but is %v", will.QOS)
+	}
+	if !will.Retained {
+		t.Fatal("will should be retained")
+	}
+}
+
+// TestNewWillJSON checks that a json will gets encoded
+func TestNewWillJSON(t *testing.T) {
+	will, err := mqtt.NewWillJSON(testUUID+"/TestNewWillJSON", map[string]bool{"online": false}, mqtt.AtMostOnce)
+	if err != nil {
+		t.Fatalf("creating will should not have failed: %v", err)
+	}
+	if string(will.Payload) != `{"online":false}` {
+		t.Fatalf("will payload should be '{\"online\":false}' but is %v", string(will.Payload))
+	}
+	if will.Retained {
+		t.Fatal("will should not be retained")
+	}
+}
+
+// TestNewWillJSONFailed checks that a json will fails to encode
+func TestNewWillJSONFailed(t *testing.T) {
+	_, err := mqtt.NewWillJSON(testUUID+"/TestNewWillJSONFailed", make(chan int), mqtt.AtMostOnce)
+	if _, ok := err.(*json.UnsupportedTypeError); !ok {
+		t.Fatalf("will error should be of type *json.UnsupportedTypeError: %v", err)
+	}
+}
+
+// TestConnectWithWill checks that connecting with a will works
+func TestConnectWithWill(t *testing.T) {
+	client, err := mqtt.NewClient(mqtt.ClientOptions{
+		Servers: []string{
+			broker,
+		},
+		Will: mqtt.NewWill(testUUID+"/TestConnectWithWill", []byte("offline"), mqtt.AtLeastOnce),
+	})
+	if err != nil {
+		t.Fatalf("creating client failed: %v", err)
+	}
+	err = client.Connect(ctx())
+	if err != nil {
+		t.Fatalf("connect should not have failed: %v", err)
+	}
+	client.DisconnectImmediately()
+}